@@ -2,13 +2,26 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
+	"picker/backend/go/pkg/email"
 	"picker/backend/go/pkg/environment"
+	"picker/backend/go/pkg/export"
 	"picker/backend/go/pkg/middleware"
+	"picker/backend/go/pkg/oidc"
 	"picker/backend/go/pkg/option"
+	"picker/backend/go/pkg/recurrence"
 	"picker/backend/go/pkg/room"
+	"picker/backend/go/pkg/roomid"
+	"picker/backend/go/pkg/sessionstore"
+	"picker/backend/go/pkg/sms"
+	"picker/backend/go/pkg/snapshot"
+	"picker/backend/go/pkg/template"
+	"picker/backend/go/pkg/user"
+	"regexp"
 	"strings"
 
 	"github.com/aws/aws-lambda-go/events"
@@ -19,23 +32,113 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	ginadapter "github.com/awslabs/aws-lambda-go-api-proxy/gin"
 	"github.com/gin-contrib/sessions"
-	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
 )
 
 var ginLambda *ginadapter.GinLambdaV2
 
+// Unlocked rooms are kept in the session cookie, which has to stay under 4KB
+const maxUnlockedRooms = 20
+
+// tokenScopes is what an API token needs to use each route, routes that aren't here only work with the session
+var tokenScopes = map[string]string{
+	"GET /api/room":                                     user.ScopeReadRooms,
+	"GET /api/room/:id":                                 user.ScopeReadRooms,
+	"GET /api/room/:id/export":                          user.ScopeReadRooms,
+	"GET /api/room/:id/snapshots":                       user.ScopeReadRooms,
+	"GET /api/room/:id/snapshots/:snapshotID":           user.ScopeReadRooms,
+	"GET /api/room/:id/invites":                         user.ScopeReadRooms,
+	"GET /api/room/:id/members":                         user.ScopeReadRooms,
+	"GET /api/publicRoom/:id":                           user.ScopeReadRooms,
+	"GET /api/publicRoom/:id/available":                 user.ScopeReadRooms,
+	"GET /api/template":                                 user.ScopeReadRooms,
+	"GET /api/template/:id":                             user.ScopeReadRooms,
+	"POST /api/room":                                    user.ScopeWriteRooms,
+	"PATCH /api/room/:roomID":                           user.ScopeWriteRooms,
+	"DELETE /api/room/:roomID":                          user.ScopeWriteRooms,
+	"POST /api/room/:roomID/restore":                    user.ScopeWriteRooms,
+	"POST /api/room/:roomID/reset":                      user.ScopeWriteRooms,
+	"POST /api/room/:roomID/duplicate":                  user.ScopeWriteRooms,
+	"POST /api/room/:roomID/rename":                     user.ScopeWriteRooms,
+	"POST /api/room/:roomID/template":                   user.ScopeWriteRooms,
+	"PUT /api/room/:roomID/recurrence":                  user.ScopeWriteRooms,
+	"DELETE /api/room/:roomID/recurrence":               user.ScopeWriteRooms,
+	"PUT /api/room/:roomID/passcode":                    user.ScopeWriteRooms,
+	"DELETE /api/room/:roomID/passcode":                 user.ScopeWriteRooms,
+	"PUT /api/room/:roomID/domain":                      user.ScopeWriteRooms,
+	"DELETE /api/room/:roomID/domain":                   user.ScopeWriteRooms,
+	"POST /api/room/:roomID/invites":                    user.ScopeWriteRooms,
+	"DELETE /api/room/:roomID/invite/:inviteID":         user.ScopeWriteRooms,
+	"PUT /api/room/:roomID/member/:memberID":            user.ScopeWriteRooms,
+	"DELETE /api/room/:roomID/member/:memberID":         user.ScopeWriteRooms,
+	"POST /api/template/:templateID/room":               user.ScopeWriteRooms,
+	"DELETE /api/template/:templateID":                  user.ScopeWriteRooms,
+	"POST /api/room/:roomID/option":                     user.ScopeManageOptions,
+	"POST /api/room/:roomID/options":                    user.ScopeManageOptions,
+	"PUT /api/room/:roomID/options/order":               user.ScopeManageOptions,
+	"PATCH /api/room/:roomID/option/:optionID":          user.ScopeManageOptions,
+	"DELETE /api/room/:roomID/option/:optionID":         user.ScopeManageOptions,
+	"POST /api/room/:roomID/option/:optionID/restore":   user.ScopeManageOptions,
+	"PATCH /api/room/:roomID/option/:optionID/select":   user.ScopeManageOptions,
+	"PATCH /api/room/:roomID/options/select":            user.ScopeManageOptions,
+	"PATCH /api/room/:roomID/option/:optionID/unselect": user.ScopeManageOptions,
+}
+
+// The sign in in progress with the identity provider is kept in its own cookie, only sent back to the callback
+const oidcLoginCookie = "oidc_login"
+
+// A verified sign in waiting for the person to agree to merging their device into the account
+const oidcConfirmCookie = "oidc_confirm"
+
 var client *dynamodb.Client
 var ssmClient *ssm.Client
 
 var ssmEnvironment *environment.Environment
 
+var roomIDs *roomid.Checker
+var roomIDGenerator *roomid.Generator
+
+var smsSender sms.Sender
+var emailSender email.Sender
+var oidcProvider *oidc.Provider
+
 func Handler(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
 	// This doesn't map the cookies
 	// API Gateway strips the cookie header into req.Cookies, but aws-lambda-go-api-proxy doesn't seem to take this into account
 	// https://github.com/awslabs/aws-lambda-go-api-proxy/issues/108
-	req.Headers["cookie"] = strings.Join(req.Cookies, ",")
-	return ginLambda.ProxyWithContext(ctx, req)
+	req.Headers["cookie"] = strings.Join(req.Cookies, "; ")
+
+	res, err := ginLambda.ProxyWithContext(ctx, req)
+
+	// It also joins every Set-Cookie header into one, which browsers read as a single cookie
+	if joined, ok := res.Headers["Set-Cookie"]; ok {
+		res.Cookies = splitCookies(joined)
+		delete(res.Headers, "Set-Cookie")
+	}
+
+	return res, err
+}
+
+var expiresDay = regexp.MustCompile(`(?i)expires=[a-z]{3}$`)
+
+// splitCookies splits on the commas between cookies, leaving the one inside each Expires date
+func splitCookies(joined string) []string {
+	cookies := []string{}
+
+	for _, part := range strings.Split(joined, ",") {
+		last := len(cookies) - 1
+
+		if last >= 0 && expiresDay.MatchString(cookies[last]) {
+			cookies[last] += "," + part
+			continue
+		}
+
+		cookies = append(cookies, strings.TrimSpace(part))
+	}
+
+	return cookies
 }
 
 func init() {
@@ -53,10 +156,21 @@ func init() {
 
 	ssmPath := os.Getenv("ssm_path")
 	ssmEnvironment = environment.New(ssmClient, &ssmPath)
+	roomIDs = roomid.New(ssmEnvironment.ReservedRoomIDs, ssmEnvironment.BlockedRoomWords)
+	roomIDGenerator = roomid.NewGenerator(ssmEnvironment.RoomIDAdjectives, ssmEnvironment.RoomIDNouns, roomIDs)
+	smsSender = sms.New(ssmEnvironment.SmsProvider, ssmEnvironment.TwilioAccountSID, ssmEnvironment.TwilioAuthToken, ssmEnvironment.TwilioFrom)
+	oidcProvider = oidc.New(ssmEnvironment.OidcIssuer, ssmEnvironment.OidcClientID, ssmEnvironment.OidcClientSecret, ssmEnvironment.OidcRedirectURL)
+	emailSender = email.New(ssmEnvironment.SmtpAddr, ssmEnvironment.SmtpUsername, ssmEnvironment.SmtpPassword, ssmEnvironment.EmailFrom)
+
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterValidation("roomid", func(fl validator.FieldLevel) bool {
+			return roomid.Valid(fl.Field().String())
+		})
+	}
 
 	r := gin.Default()
 
-	store := cookie.NewStore([]byte(ssmEnvironment.CookieSecret))
+	store := sessionstore.New(ssmEnvironment.CookieSecret, client)
 	r.Use(sessions.Sessions(os.Getenv("session_cookie"), store))
 
 	// Set a user ID cookie on every request
@@ -64,29 +178,96 @@ func init() {
 
 	api := r.Group("/api")
 
-	api.GET("/room/:id", func(c *gin.Context) {
-		id := c.Param("id")
-		res, err := room.GetRoom(id, client, getUserID(c))
+	api.Use(middleware.RoomID(func(id string) (string, error) {
+		return room.ResolveID(id, client)
+	}))
+
+	api.Use(middleware.BearerToken(func(secret string) (string, []string, error) {
+		token, err := user.ResolveToken(secret, client)
 
 		if err != nil {
+			return "", nil, err
+		}
+
+		return token.UserID, token.Scopes, nil
+	}, tokenScopes, user.ErrInvalidToken))
+
+	api.GET("/room/:id", requireRole(room.RoleViewer), func(c *gin.Context) {
+		res := currentRoom(c)
+
+		filter := option.Filter{}
+
+		if err := c.ShouldBindQuery(&filter); err != nil {
 			c.AbortWithError(http.StatusBadRequest, err)
+			return
 		}
 
-		if res == nil {
+		res.Options = filter.Options(res.Options)
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	api.GET("/room/:id/export", requireRole(room.RoleViewer), func(c *gin.Context) {
+		res := currentRoom(c)
+
+		filter := option.Filter{}
+
+		if err := c.ShouldBindQuery(&filter); err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("%s.csv", res.ID)))
+		c.Header("Content-Type", "text/csv")
+
+		if err := export.CSV(c.Writer, filter.Options(res.Options)); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+		}
+	})
+
+	api.GET("/room/:id/snapshots", requireRole(room.RoleViewer), func(c *gin.Context) {
+		res := currentRoom(c)
+
+		snapshots, err := snapshot.List(res.ID, client)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, snapshots)
+	})
+
+	api.GET("/room/:id/snapshots/:snapshotID", requireRole(room.RoleViewer), func(c *gin.Context) {
+		res := currentRoom(c)
+
+		saved, err := snapshot.Get(res.ID, c.Param("snapshotID"), client)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		if saved == nil {
 			c.AbortWithStatus(http.StatusNotFound)
 			return
 		}
 
-		if res.OwnerID != getUserID(c) {
-			c.AbortWithStatus(http.StatusForbidden)
+		if c.Query("format") != "csv" {
+			c.JSON(http.StatusOK, saved)
 			return
 		}
 
-		c.JSON(http.StatusOK, res)
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("%s-%s.csv", res.ID, saved.CreatedAt.Format("2006-01-02"))))
+		c.Header("Content-Type", "text/csv")
+
+		if err := export.CSV(c.Writer, saved.Options); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+		}
 	})
 
 	api.GET("/room", func(c *gin.Context) {
-		res, err := room.RoomsForUser(getUserID(c), client)
+		res, err := room.RoomsForUser(getUserID(c), c.Query("deleted") == "true", client)
 
 		if err != nil {
 			c.AbortWithError(http.StatusBadRequest, err)
@@ -102,7 +283,7 @@ func init() {
 
 	api.GET("/publicRoom/:id", func(c *gin.Context) {
 		id := c.Param("id")
-		res, err := room.GetPublicRoom(id, client, getUserID(c))
+		res, err := room.GetPublicRoom(id, client, getUserID(c), getUnlockedRooms(c), getVerifiedEmail(c))
 
 		if err != nil {
 			c.AbortWithError(http.StatusBadRequest, err)
@@ -113,60 +294,108 @@ func init() {
 			return
 		}
 
+		filter := option.Filter{}
+
+		if err := c.ShouldBindQuery(&filter); err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		res.Options = filter.PublicOptions(res.Options)
+
 		c.JSON(http.StatusOK, res)
 	})
 
 	api.GET("/publicRoom/:id/available", func(c *gin.Context) {
 		id := c.Param("id")
-		res, err := room.GetPublicRoom(id, client, getUserID(c))
+		res, err := room.CheckAvailable(id, roomIDs, client)
 
 		if err != nil {
 			c.AbortWithError(http.StatusBadRequest, err)
 			return
 		}
 
-		if res == nil {
-			c.JSON(http.StatusOK, gin.H{"available": true})
+		c.JSON(http.StatusOK, res)
+	})
+
+	api.POST("/publicRoom/:id/unlock", func(c *gin.Context) {
+		id := c.Param("id")
+
+		request := room.UnlockRequest{}
+
+		err := c.ShouldBindJSON(&request)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"available": false})
-	})
+		userID := getUserID(c)
 
-	api.POST("/room", func(c *gin.Context) {
-		createRoomRequest := &room.CreateRoomRequest{}
+		protected, err := room.GetRoom(id, client, userID)
 
-		err = c.ShouldBindJSON(&createRoomRequest)
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		if protected == nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		key, err := protected.Unlock(request.Passcode, userID, client)
+
+		if errors.Is(err, room.ErrTooManyAttempts) {
+			c.AbortWithError(http.StatusTooManyRequests, err)
+			return
+		}
+
+		if errors.Is(err, room.ErrWrongPasscode) {
+			c.AbortWithError(http.StatusUnauthorized, err)
+			return
+		}
 
 		if err != nil {
 			c.AbortWithError(http.StatusBadRequest, err)
 			return
 		}
 
-		room, err := room.NewRoom(createRoomRequest, getUserID(c), client)
+		addUnlockedRoom(c, protected.ID, key)
+
+		res, err := room.GetPublicRoom(protected.ID, client, userID, getUnlockedRooms(c), getVerifiedEmail(c))
 
 		if err != nil {
 			c.AbortWithError(http.StatusBadRequest, err)
 			return
 		}
 
-		c.JSON(http.StatusOK, room)
+		c.JSON(http.StatusOK, res)
 	})
 
-	api.PATCH("/room/:roomID/option/:optionID/select", func(c *gin.Context) {
-		roomID := c.Param("roomID")
-		optionID := c.Param("optionID")
+	api.POST("/publicRoom/:id/invite", func(c *gin.Context) {
+		id := c.Param("id")
 
-		selectOptionRequest := option.SelectOptionRequest{}
+		request := room.AcceptInviteRequest{}
 
-		err = c.ShouldBindJSON(&selectOptionRequest)
+		err := c.ShouldBindJSON(&request)
 
 		if err != nil {
 			c.AbortWithError(http.StatusBadRequest, err)
 			return
 		}
 
-		res, err := option.SelectOption(optionID, getUserID(c), roomID, selectOptionRequest, client)
+		res, err := room.AcceptInvite(id, request.Token, getUserID(c), ssmEnvironment.CookieSecret, client)
+
+		if errors.Is(err, room.ErrInviteNotFound) {
+			c.AbortWithError(http.StatusNotFound, err)
+			return
+		}
+
+		if errors.Is(err, room.ErrInviteUsed) {
+			c.AbortWithError(http.StatusConflict, err)
+			return
+		}
 
 		if err != nil {
 			c.AbortWithError(http.StatusBadRequest, err)
@@ -176,11 +405,36 @@ func init() {
 		c.JSON(http.StatusOK, res)
 	})
 
-	api.PATCH("/room/:roomID/option/:optionID/unselect", func(c *gin.Context) {
-		roomID := c.Param("roomID")
-		optionID := c.Param("optionID")
+	api.POST("/publicRoom/:id/join", func(c *gin.Context) {
+		id := c.Param("id")
+
+		request := room.JoinRequest{}
+
+		err := c.ShouldBindJSON(&request)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		shared, err := room.GetRoom(id, client, getUserID(c))
 
-		res, err := option.UnselectOption(optionID, getUserID(c), roomID, client)
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		if shared == nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		res, err := shared.Join(request.Token, getUserID(c), request.Name, ssmEnvironment.CookieSecret, client)
+
+		if errors.Is(err, room.ErrInvalidLink) {
+			c.AbortWithError(http.StatusForbidden, err)
+			return
+		}
 
 		if err != nil {
 			c.AbortWithError(http.StatusBadRequest, err)
@@ -190,19 +444,29 @@ func init() {
 		c.JSON(http.StatusOK, res)
 	})
 
-	api.PATCH("/room/:roomID", func(c *gin.Context) {
-		roomID := c.Param("roomID")
+	api.POST("/publicRoom/:id/transfer", func(c *gin.Context) {
+		id := c.Param("id")
 
-		request := room.UpdateRoomRequest{}
+		request := room.RedeemTransferRequest{}
 
-		err = c.ShouldBindJSON(&request)
+		err := c.ShouldBindJSON(&request)
 
 		if err != nil {
 			c.AbortWithError(http.StatusBadRequest, err)
 			return
 		}
 
-		res, err := room.Update(getUserID(c), roomID, request, client)
+		res, err := room.RedeemTransfer(id, request.Token, getUserID(c), ssmEnvironment.CookieSecret, client)
+
+		if errors.Is(err, room.ErrRoomNotFound) || errors.Is(err, room.ErrTransferNotFound) {
+			c.AbortWithError(http.StatusNotFound, err)
+			return
+		}
+
+		if errors.Is(err, room.ErrTransferInProgress) || errors.Is(err, room.ErrRenameInProgress) {
+			c.AbortWithError(http.StatusConflict, err)
+			return
+		}
 
 		if err != nil {
 			c.AbortWithError(http.StatusBadRequest, err)
@@ -212,12 +476,49 @@ func init() {
 		c.JSON(http.StatusOK, res)
 	})
 
-	api.POST("/room/:roomID/option", func(c *gin.Context) {
+	api.POST("/room", func(c *gin.Context) {
+		createRoomRequest := &room.CreateRoomRequest{}
+
+		err = c.ShouldBindJSON(&createRoomRequest)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		if createRoomRequest.ID == "" {
+			room, err := room.NewRoomWithGeneratedID(createRoomRequest, roomIDGenerator.Generate, getUserID(c), client)
+
+			if err != nil {
+				c.AbortWithError(http.StatusBadRequest, err)
+				return
+			}
+
+			c.JSON(http.StatusOK, room)
+			return
+		}
+
+		if !checkRoomID(c, createRoomRequest.ID) {
+			return
+		}
+
+		room, err := room.NewRoom(createRoomRequest, getUserID(c), client)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, room)
+	})
+
+	api.PATCH("/room/:roomID/option/:optionID/select", func(c *gin.Context) {
 		roomID := c.Param("roomID")
+		optionID := c.Param("optionID")
 
-		createOptionRequest := option.CreateOptionRequest{}
+		selectOptionRequest := option.SelectOptionRequest{}
 
-		err = c.ShouldBindJSON(&createOptionRequest)
+		err = c.ShouldBindJSON(&selectOptionRequest)
 
 		if err != nil {
 			c.AbortWithError(http.StatusBadRequest, err)
@@ -226,8 +527,6 @@ func init() {
 
 		userID := getUserID(c)
 
-		opt := option.NewOption(createOptionRequest.Option, userID, roomID)
-
 		room, err := room.GetRoom(roomID, client, userID)
 
 		if err != nil {
@@ -236,52 +535,1440 @@ func init() {
 		}
 
 		if room == nil {
-			c.AbortWithError(http.StatusNotFound, err)
+			c.AbortWithStatus(http.StatusNotFound)
 			return
 		}
 
-		if room.OwnerID != userID {
-			c.AbortWithError(http.StatusForbidden, err)
+		if !room.CanAccess(userID, getUnlockedRooms(c), getVerifiedEmail(c)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		if !room.CanSelect(userID) {
+			c.AbortWithStatus(http.StatusForbidden)
 			return
 		}
 
-		opts := []*option.Option{&opt}
+		guards, err := room.CheckSelection([]string{optionID}, userID, client)
 
-		writeErr := option.BatchWriteOptions(opts, client)
+		if err != nil {
+			c.AbortWithError(http.StatusConflict, err)
+			return
+		}
 
-		if writeErr != nil {
-			c.AbortWithError(http.StatusBadRequest, writeErr)
+		// A pick in a row with a limit has to go in a transaction with its guard
+		if len(guards) > 0 {
+			request := option.SelectOptionsRequest{OptionIDs: []string{optionID}, Name: selectOptionRequest.Name}
+			res, err := option.SelectOptions([]option.Option{*room.Option(optionID)}, userID, request, guards, client)
+
+			if err != nil {
+				c.AbortWithError(http.StatusBadRequest, err)
+				return
+			}
+
+			c.JSON(http.StatusOK, res[0])
 			return
 		}
 
-		// marshal then unmarshal the option so it is initialised with non saved values (Available)
-		optMarshalled, err := attributevalue.MarshalMap(opt)
+		res, err := option.SelectOption(optionID, userID, room.ID, selectOptionRequest, client)
 
 		if err != nil {
-			panic(err)
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
 		}
 
-		c.JSON(http.StatusOK, option.Unmarshal(optMarshalled))
+		c.JSON(http.StatusOK, res)
 	})
 
-	api.DELETE("/room/:roomID/option/:optionID", func(c *gin.Context) {
+	api.PATCH("/room/:roomID/options/select", func(c *gin.Context) {
 		roomID := c.Param("roomID")
-		optionID := c.Param("optionID")
 
-		res, err := option.Delete(optionID, getUserID(c), roomID, client)
+		request := option.SelectOptionsRequest{}
+
+		err := c.ShouldBindJSON(&request)
 
 		if err != nil {
-			c.AbortWithError(http.StatusForbidden, err)
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		userID := getUserID(c)
+
+		room, err := room.GetRoom(roomID, client, userID)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		if room == nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		if !room.CanAccess(userID, getUnlockedRooms(c), getVerifiedEmail(c)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		if !room.CanSelect(userID) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		guards, err := room.CheckSelection(request.OptionIDs, userID, client)
+
+		if err != nil {
+			c.AbortWithError(http.StatusConflict, err)
+			return
+		}
+
+		var opts []option.Option
+		for _, id := range request.OptionIDs {
+			opts = append(opts, *room.Option(id))
+		}
+
+		res, err := option.SelectOptions(opts, userID, request, guards, client)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
 			return
 		}
 
 		c.JSON(http.StatusOK, res)
 	})
 
-	ginLambda = ginadapter.NewV2(r)
-}
+	api.PATCH("/room/:roomID/option/:optionID/unselect", func(c *gin.Context) {
+		roomID := c.Param("roomID")
+		optionID := c.Param("optionID")
+
+		userID := getUserID(c)
+
+		room, err := room.GetRoom(roomID, client, userID)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		if room == nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		if !room.CanAccess(userID, getUnlockedRooms(c), getVerifiedEmail(c)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		// A seat picked as part of a group is released with the rest of it
+		if group := room.Group(optionID, userID); len(group) > 1 {
+			released, err := option.UnselectOptions(group, userID, client)
+
+			if err != nil {
+				c.AbortWithError(http.StatusBadRequest, err)
+				return
+			}
+
+			for _, opt := range released {
+				if opt.ID == optionID {
+					c.JSON(http.StatusOK, opt)
+					return
+				}
+			}
+		}
+
+		res, err := option.UnselectOption(optionID, userID, room.ID, client)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	api.PATCH("/room/:roomID", requireRole(room.RoleOwner), func(c *gin.Context) {
+		current := currentRoom(c)
+
+		request := room.UpdateRoomRequest{}
+
+		err = c.ShouldBindJSON(&request)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		res, err := room.Update(current.OwnerID, current.ID, request, client)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	api.POST("/room/:roomID/option", requireRole(room.RoleEditor), func(c *gin.Context) {
+		room := currentRoom(c)
+
+		createOptionRequest := option.CreateOptionRequest{}
+
+		err = c.ShouldBindJSON(&createOptionRequest)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		// Options belong to the room's owner whoever adds them
+		opts, err := option.NewOptions(createOptionRequest, room.OwnerID, room.ID)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		if room.Grid != nil || room.SeatMap != nil {
+			c.AbortWithError(http.StatusBadRequest, errors.New("options can't be added to a matrix or seat map room"))
+			return
+		}
+
+		if len(room.Options)+len(opts) > option.MaxPerRoom {
+			c.AbortWithError(http.StatusBadRequest, option.ErrTooManyOptions)
+			return
+		}
+
+		next := room.NextPosition()
+		for i, opt := range opts {
+			opt.Position = next + i
+		}
+
+		writeErr := option.BatchWriteOptions(opts, client)
+
+		if writeErr != nil {
+			c.AbortWithError(http.StatusBadRequest, writeErr)
+			return
+		}
+
+		// marshal then unmarshal the options so they are initialised with non saved values (Available)
+		created := make([]option.Option, len(opts))
+
+		for i, opt := range opts {
+			optMarshalled, err := attributevalue.MarshalMap(opt)
+
+			if err != nil {
+				panic(err)
+			}
+
+			created[i] = option.Unmarshal(optMarshalled)
+		}
+
+		// A single option keeps the original response shape, slots return every option created
+		if createOptionRequest.Slots == nil {
+			c.JSON(http.StatusOK, created[0])
+			return
+		}
+
+		c.JSON(http.StatusOK, created)
+	})
+
+	api.POST("/room/:roomID/options", requireRole(room.RoleEditor), func(c *gin.Context) {
+		request := option.BatchRequest{}
+
+		err := c.ShouldBindJSON(&request)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		room := currentRoom(c)
+
+		adds := request.Adds()
+
+		if adds > 0 && (room.Grid != nil || room.SeatMap != nil) {
+			c.AbortWithError(http.StatusBadRequest, errors.New("options can't be added to a matrix or seat map room"))
+			return
+		}
+
+		if len(room.Options)+adds > option.MaxPerRoom {
+			c.AbortWithError(http.StatusBadRequest, option.ErrTooManyOptions)
+			return
+		}
+
+		res := option.Batch(request, room.OwnerID, room.ID, room.NextPosition(), client)
+
+		status := http.StatusOK
+		if res.Failed > 0 {
+			status = http.StatusMultiStatus
+		}
+
+		c.JSON(status, res)
+	})
+
+	api.PUT("/room/:roomID/options/order", requireRole(room.RoleEditor), func(c *gin.Context) {
+		request := room.ReorderOptionsRequest{}
+
+		err := c.ShouldBindJSON(&request)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		room := currentRoom(c)
+
+		changed, err := room.Reorder(request.OptionIDs)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		err = option.SetPositions(changed, client)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		for _, opt := range changed {
+			room.Option(opt.ID).Position = opt.Position
+		}
+
+		option.Sort(room.Options)
+
+		c.JSON(http.StatusOK, room)
+	})
+
+	api.PATCH("/room/:roomID/option/:optionID", requireRole(room.RoleEditor), func(c *gin.Context) {
+		current := currentRoom(c)
+		optionID := c.Param("optionID")
+
+		request := option.EditOptionRequest{}
+
+		err := c.ShouldBindJSON(&request)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		res, err := option.Edit(optionID, current.OwnerID, current.ID, request, client)
+
+		if errors.Is(err, option.ErrNotFound) {
+			c.AbortWithError(http.StatusNotFound, err)
+			return
+		}
+
+		if errors.Is(err, option.ErrNotOwner) {
+			c.AbortWithError(http.StatusForbidden, err)
+			return
+		}
+
+		if errors.Is(err, option.ErrEditConflict) {
+			c.AbortWithError(http.StatusConflict, err)
+			return
+		}
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	api.POST("/room/:roomID/option/:optionID/restore", requireRole(room.RoleEditor), func(c *gin.Context) {
+		current := currentRoom(c)
+		optionID := c.Param("optionID")
+
+		if len(current.Options) >= option.MaxPerRoom {
+			c.AbortWithError(http.StatusBadRequest, option.ErrTooManyOptions)
+			return
+		}
+
+		res, err := option.Restore(optionID, current.OwnerID, current.ID, client)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	api.DELETE("/room/:roomID", requireRole(room.RoleOwner), func(c *gin.Context) {
+		current := currentRoom(c)
+
+		res, err := room.Delete(current.ID, current.OwnerID, client)
+
+		if err != nil {
+			c.AbortWithError(http.StatusForbidden, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	api.POST("/room/:roomID/reset", requireRole(room.RoleOwner), func(c *gin.Context) {
+		request := room.ResetRequest{}
+
+		err := c.ShouldBindJSON(&request)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		room := currentRoom(c)
+
+		res, err := room.Reset(request, client)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	api.POST("/room/:roomID/duplicate", requireRole(room.RoleOwner), func(c *gin.Context) {
+		request := room.CopyRoomRequest{}
+
+		err := c.ShouldBindJSON(&request)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		userID := getUserID(c)
+		room := currentRoom(c)
+
+		if !checkRoomID(c, request.ID) {
+			return
+		}
+
+		res, err := room.Duplicate(request.ID, userID, client)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	api.POST("/room/:roomID/rename", requireRole(room.RoleOwner), func(c *gin.Context) {
+		current := currentRoom(c)
+
+		request := room.RenameRoomRequest{}
+
+		err := c.ShouldBindJSON(&request)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		if !checkRoomID(c, request.ID) {
+			return
+		}
+
+		res, err := room.Rename(current.ID, request.ID, current.OwnerID, client)
+
+		if errors.Is(err, room.ErrRoomNotFound) {
+			c.AbortWithError(http.StatusNotFound, err)
+			return
+		}
+
+		if errors.Is(err, room.ErrRoomIDTaken) || errors.Is(err, room.ErrRenameInProgress) {
+			c.AbortWithError(http.StatusConflict, err)
+			return
+		}
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	api.POST("/room/:roomID/template", requireRole(room.RoleOwner), func(c *gin.Context) {
+		request := template.SaveTemplateRequest{}
+
+		err := c.ShouldBindJSON(&request)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		userID := getUserID(c)
+		room := currentRoom(c)
+
+		res, err := room.SaveTemplate(request.Name, userID, client)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	api.PUT("/room/:roomID/recurrence", requireRole(room.RoleOwner), func(c *gin.Context) {
+		current := currentRoom(c)
+
+		request := recurrence.Request{}
+
+		err := c.ShouldBindJSON(&request)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		res, err := room.SetRecurrence(current.ID, current.OwnerID, &request, client)
+
+		if errors.Is(err, room.ErrRoomNotFound) {
+			c.AbortWithError(http.StatusNotFound, err)
+			return
+		}
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	api.DELETE("/room/:roomID/recurrence", requireRole(room.RoleOwner), func(c *gin.Context) {
+		current := currentRoom(c)
+
+		res, err := room.SetRecurrence(current.ID, current.OwnerID, nil, client)
+
+		if errors.Is(err, room.ErrRoomNotFound) {
+			c.AbortWithError(http.StatusNotFound, err)
+			return
+		}
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	api.PUT("/room/:roomID/passcode", requireRole(room.RoleOwner), func(c *gin.Context) {
+		current := currentRoom(c)
+
+		request := room.SetPasscodeRequest{}
+
+		err := c.ShouldBindJSON(&request)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		res, err := room.SetPasscode(current.ID, current.OwnerID, request.Passcode, client)
+
+		if errors.Is(err, room.ErrRoomNotFound) {
+			c.AbortWithError(http.StatusNotFound, err)
+			return
+		}
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	api.DELETE("/room/:roomID/passcode", requireRole(room.RoleOwner), func(c *gin.Context) {
+		current := currentRoom(c)
+
+		res, err := room.SetPasscode(current.ID, current.OwnerID, "", client)
+
+		if errors.Is(err, room.ErrRoomNotFound) {
+			c.AbortWithError(http.StatusNotFound, err)
+			return
+		}
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	api.PUT("/room/:roomID/domain", requireRole(room.RoleOwner), func(c *gin.Context) {
+		current := currentRoom(c)
+
+		request := room.SetAllowedDomainRequest{}
+
+		err := c.ShouldBindJSON(&request)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		res, err := room.SetAllowedDomain(current.ID, current.OwnerID, request.Domain, client)
+
+		if errors.Is(err, room.ErrRoomNotFound) {
+			c.AbortWithError(http.StatusNotFound, err)
+			return
+		}
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	api.DELETE("/room/:roomID/domain", requireRole(room.RoleOwner), func(c *gin.Context) {
+		current := currentRoom(c)
+
+		res, err := room.SetAllowedDomain(current.ID, current.OwnerID, "", client)
+
+		if errors.Is(err, room.ErrRoomNotFound) {
+			c.AbortWithError(http.StatusNotFound, err)
+			return
+		}
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	api.POST("/room/:roomID/invites", requireRole(room.RoleOwner), func(c *gin.Context) {
+		request := room.CreateInvitesRequest{}
+
+		err := c.ShouldBindJSON(&request)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		room := currentRoom(c)
+
+		res, err := room.CreateInvites(request.Names, ssmEnvironment.CookieSecret, client)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	api.GET("/room/:id/invites", requireRole(room.RoleViewer), func(c *gin.Context) {
+		current := currentRoom(c)
+		statuses := current.InviteStatuses(ssmEnvironment.CookieSecret)
+
+		// The links let anyone in, only owners share them and API tokens can't be used for sharing
+		_, viaToken := c.Get(middleware.TokenUserID)
+		if viaToken || !current.Can(getUserID(c), room.RoleOwner) {
+			for i := range statuses {
+				statuses[i].Token = ""
+			}
+		}
+
+		c.JSON(http.StatusOK, statuses)
+	})
+
+	api.DELETE("/room/:roomID/invite/:inviteID", requireRole(room.RoleOwner), func(c *gin.Context) {
+		room := currentRoom(c)
+
+		inviteID := c.Param("inviteID")
+
+		if room.Invite(inviteID) == nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		err := room.RevokeInvite(inviteID, client)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	})
+
+	api.GET("/room/:id/members", requireRole(room.RoleOwner), func(c *gin.Context) {
+		c.JSON(http.StatusOK, currentRoom(c).Members)
+	})
+
+	api.PUT("/room/:roomID/member/:memberID", requireRole(room.RoleOwner), func(c *gin.Context) {
+		request := room.UpdateMemberRequest{}
+
+		err := c.ShouldBindJSON(&request)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		res, err := currentRoom(c).UpdateMember(c.Param("memberID"), request.Role, client)
+
+		if errors.Is(err, room.ErrMemberNotFound) {
+			c.AbortWithError(http.StatusNotFound, err)
+			return
+		}
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	api.DELETE("/room/:roomID/member/:memberID", requireRole(room.RoleOwner), func(c *gin.Context) {
+		err := currentRoom(c).RemoveMember(c.Param("memberID"), client)
+
+		if errors.Is(err, room.ErrMemberNotFound) {
+			c.AbortWithError(http.StatusNotFound, err)
+			return
+		}
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	})
+
+	api.POST("/room/:roomID/adminLink", requireRole(room.RoleOwner), func(c *gin.Context) {
+		request := room.AdminLinkRequest{}
+
+		err := c.ShouldBindJSON(&request)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, currentRoom(c).AdminLink(request.Role, ssmEnvironment.CookieSecret))
+	})
+
+	api.DELETE("/room/:roomID/adminLinks", requireRole(room.RoleOwner), func(c *gin.Context) {
+		res, err := currentRoom(c).RevokeAdminLinks(client)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	api.POST("/room/:roomID/transfer", requireRole(room.RoleOwner), func(c *gin.Context) {
+		// Co-owners have the owner role too, only the room's owner can give it away
+		if currentRoom(c).OwnerID != getUserID(c) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		res, err := currentRoom(c).CreateTransfer(ssmEnvironment.CookieSecret, client)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	api.POST("/room/:roomID/restore", func(c *gin.Context) {
+		roomID := c.Param("roomID")
+
+		res, err := room.Restore(roomID, getUserID(c), client)
+
+		if errors.Is(err, room.ErrRoomNotFound) {
+			c.AbortWithError(http.StatusNotFound, err)
+			return
+		}
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	api.DELETE("/room/:roomID/option/:optionID", requireRole(room.RoleEditor), func(c *gin.Context) {
+		current := currentRoom(c)
+		optionID := c.Param("optionID")
+
+		res, err := option.Delete(optionID, current.OwnerID, current.ID, client)
+
+		if err != nil {
+			c.AbortWithError(http.StatusForbidden, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	api.GET("/template", func(c *gin.Context) {
+		res, err := template.List(getUserID(c), client)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	api.GET("/template/:id", func(c *gin.Context) {
+		res, err := template.Get(c.Param("id"), getUserID(c), client)
+
+		if errors.Is(err, template.ErrTemplateNotFound) {
+			c.AbortWithError(http.StatusNotFound, err)
+			return
+		}
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	api.POST("/template/:templateID/room", func(c *gin.Context) {
+		request := room.CopyRoomRequest{}
+
+		err := c.ShouldBindJSON(&request)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		userID := getUserID(c)
+
+		saved, err := template.Get(c.Param("templateID"), userID, client)
+
+		if errors.Is(err, template.ErrTemplateNotFound) {
+			c.AbortWithError(http.StatusNotFound, err)
+			return
+		}
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		if !checkRoomID(c, request.ID) {
+			return
+		}
+
+		res, err := room.FromTemplate(*saved, request.ID, userID, client)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	api.DELETE("/template/:templateID", func(c *gin.Context) {
+		err := template.Delete(c.Param("templateID"), getUserID(c), client)
+
+		if errors.Is(err, template.ErrTemplateNotFound) {
+			c.AbortWithError(http.StatusNotFound, err)
+			return
+		}
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	})
+
+	api.GET("/user", func(c *gin.Context) {
+		res, err := user.Get(getUserID(c), client)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	api.POST("/user/phone", func(c *gin.Context) {
+		request := user.PhoneRequest{}
+
+		err := c.ShouldBindJSON(&request)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		err = user.RequestLink(request.Phone, getUserID(c), smsSender, client)
+
+		if !abortWithPhoneError(c, err) {
+			c.Status(http.StatusNoContent)
+		}
+	})
+
+	api.POST("/user/phone/verify", func(c *gin.Context) {
+		request := user.VerifyPhoneRequest{}
+
+		err := c.ShouldBindJSON(&request)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		res, err := user.VerifyLink(request.Phone, request.Code, getUserID(c), client)
+
+		if !abortWithPhoneError(c, err) {
+			c.JSON(http.StatusOK, res)
+		}
+	})
+
+	api.DELETE("/user/phone", func(c *gin.Context) {
+		res, err := user.Unlink(getUserID(c), client)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	api.POST("/user/pairing", func(c *gin.Context) {
+		res, err := user.CreatePairing(getUserID(c), ssmEnvironment.SiteURL, client)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.JSON(http.StatusCreated, res)
+	})
+
+	api.GET("/user/tokens", func(c *gin.Context) {
+		res, err := user.ListTokens(getUserID(c), client)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	api.POST("/user/tokens", func(c *gin.Context) {
+		request := user.CreateTokenRequest{}
+
+		err := c.ShouldBindJSON(&request)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		res, err := user.CreateToken(request, getUserID(c), client)
+
+		if errors.Is(err, user.ErrTooManyTokens) {
+			c.AbortWithError(http.StatusConflict, err)
+			return
+		}
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.JSON(http.StatusCreated, res)
+	})
+
+	api.DELETE("/user/tokens/:tokenID", func(c *gin.Context) {
+		err := user.RevokeToken(c.Param("tokenID"), getUserID(c), client)
+
+		if errors.Is(err, user.ErrTokenNotFound) {
+			c.AbortWithError(http.StatusNotFound, err)
+			return
+		}
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	})
+
+	api.GET("/user/sessions", func(c *gin.Context) {
+		res, err := sessionstore.List(getUserID(c), client)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		current := sessions.Default(c).ID()
+
+		for i := range res {
+			res[i].Current = res[i].ID == current
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	// Signs out every device, this one carries on with a new session
+	api.DELETE("/user/sessions", func(c *gin.Context) {
+		if err := sessionstore.RevokeAll(getUserID(c), client); err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		session := sessions.Default(c)
+		sessionstore.Renew(session)
+
+		if err := session.Save(); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	})
+
+	api.DELETE("/user/sessions/:sessionID", func(c *gin.Context) {
+		err := sessionstore.Revoke(c.Param("sessionID"), getUserID(c), client)
+
+		if errors.Is(err, sessionstore.ErrSessionNotFound) {
+			c.AbortWithError(http.StatusNotFound, err)
+			return
+		}
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	})
+
+	api.POST("/recover", func(c *gin.Context) {
+		request := user.PhoneRequest{}
+
+		err := c.ShouldBindJSON(&request)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		err = user.RequestRecovery(request.Phone, getUserID(c), smsSender, client)
+
+		if !abortWithPhoneError(c, err) {
+			c.Status(http.StatusNoContent)
+		}
+	})
+
+	api.POST("/recover/verify", func(c *gin.Context) {
+		request := user.VerifyPhoneRequest{}
+
+		err := c.ShouldBindJSON(&request)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		res, err := user.Recover(request.Phone, request.Code, getUserID(c), client)
+
+		if abortWithPhoneError(c, err) {
+			return
+		}
+
+		// Switch this browser to the recovered user, the rooms it owned come with it
+		switchUser(c, res.ID, "")
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	api.POST("/signin", func(c *gin.Context) {
+		request := user.SignInRequest{}
+
+		err := c.ShouldBindJSON(&request)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		sessionNonce, err := user.RequestSignIn(request.Email, ssmEnvironment.CookieSecret, ssmEnvironment.SiteURL, emailSender, client)
+
+		if abortWithSignInError(c, err) {
+			return
+		}
+
+		// Only this session can merge what it has into the account when the link comes back
+		session := sessions.Default(c)
+		session.Set("signin_nonce", sessionNonce)
+		session.Save()
+
+		c.Status(http.StatusNoContent)
+	})
+
+	api.POST("/signin/verify", func(c *gin.Context) {
+		request := user.VerifySignInRequest{}
+
+		err := c.ShouldBindJSON(&request)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		sessionNonce, _ := sessions.Default(c).Get("signin_nonce").(string)
+
+		res, err := user.SignIn(request.Token, getUserID(c), sessionNonce, request.ConfirmMerge, ssmEnvironment.CookieSecret, client)
+
+		// The page names the account and sends the address back once the user agrees
+		if errors.Is(err, user.ErrConfirmMerge) {
+			address, _ := user.SignInAddress(request.Token, ssmEnvironment.CookieSecret)
+			c.AbortWithStatusJSON(http.StatusPreconditionRequired, gin.H{"email": address})
+			return
+		}
+
+		if abortWithSignInError(c, err) {
+			return
+		}
+
+		// Anything this browser had has been merged into the account if it asked for the link
+		sessions.Default(c).Delete("signin_nonce")
+		switchUser(c, res.ID, "")
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	api.POST("/pair", func(c *gin.Context) {
+		request := user.PairRequest{}
+
+		err := c.ShouldBindJSON(&request)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		res, err := user.RedeemPairing(request.Code, client)
+
+		if errors.Is(err, user.ErrInvalidPairingCode) {
+			c.AbortWithError(http.StatusNotFound, err)
+			return
+		}
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		// This browser becomes the same user as the one that made the code, whatever it had under its own ID stays there
+		switchUser(c, res.ID, "")
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	api.GET("/oidc/login", func(c *gin.Context) {
+		login, err := oidc.NewLogin(getUserID(c), c.Query("redirect"))
+
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		url, err := oidcProvider.AuthCodeURL(c.Request.Context(), login.State, login.Nonce, login.Verifier)
+
+		if errors.Is(err, oidc.ErrNotConfigured) {
+			c.AbortWithError(http.StatusServiceUnavailable, err)
+			return
+		}
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadGateway, err)
+			return
+		}
+
+		// Lax so it comes back with the issuer's redirect, unlike the session cookie
+		c.SetSameSite(http.SameSiteLaxMode)
+		c.SetCookie(oidcLoginCookie, login.Encode(ssmEnvironment.CookieSecret), int(oidc.LoginTTL.Seconds()), "/api/oidc", "", true, true)
+
+		c.Redirect(http.StatusFound, url)
+	})
+
+	api.GET("/oidc/callback", func(c *gin.Context) {
+		value, _ := c.Cookie(oidcLoginCookie)
+
+		c.SetSameSite(http.SameSiteLaxMode)
+		c.SetCookie(oidcLoginCookie, "", -1, "/api/oidc", "", true, true)
+
+		login, err := oidc.DecodeLogin(ssmEnvironment.CookieSecret, value, c.Query("state"))
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		// The person said no, or the issuer wouldn't sign them in
+		if reason := c.Query("error"); reason != "" {
+			c.AbortWithError(http.StatusUnauthorized, fmt.Errorf("identity provider returned %s", reason))
+			return
+		}
+
+		claims, err := oidcProvider.Exchange(c.Request.Context(), c.Query("code"), login.Verifier, login.Nonce)
+
+		if errors.Is(err, oidc.ErrInvalidToken) {
+			c.AbortWithError(http.StatusUnauthorized, err)
+			return
+		}
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadGateway, err)
+			return
+		}
+
+		res, err := user.SignInWithOidc(claims.Issuer, claims.Subject, claims.VerifiedEmail(), login.UserID, "", client)
+
+		// The sign in page names the account and asks before anything is moved into it
+		if errors.Is(err, user.ErrConfirmMerge) {
+			confirmation := oidc.NewConfirmation(claims.Issuer, claims.Subject, claims.VerifiedEmail(), login.UserID)
+			c.SetCookie(oidcConfirmCookie, confirmation.Encode(ssmEnvironment.CookieSecret), int(oidc.LoginTTL.Seconds()), "/api/oidc", "", true, true)
+
+			// The session cookie doesn't come back from the issuer, the device stays who it was until they agree
+			switchUser(c, login.UserID, "")
+
+			query := url.Values{"confirmOidc": {user.OidcAccountName(claims.Subject, claims.VerifiedEmail())}}
+			c.Redirect(http.StatusFound, strings.TrimRight(ssmEnvironment.SiteURL, "/")+"/signin?"+query.Encode())
+			return
+		}
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		switchUser(c, res.ID, claims.VerifiedEmail())
+
+		c.Redirect(http.StatusFound, strings.TrimRight(ssmEnvironment.SiteURL, "/")+login.Redirect)
+	})
+
+	// Finishes a sign in that would merge the device into the account, once the person has agreed
+	api.POST("/oidc/confirm", func(c *gin.Context) {
+		request := user.ConfirmOidcRequest{}
+
+		err := c.ShouldBindJSON(&request)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		value, _ := c.Cookie(oidcConfirmCookie)
+
+		confirmation, err := oidc.DecodeConfirmation(ssmEnvironment.CookieSecret, value)
+
+		// Only the device the sign in was verified for can finish it
+		if err != nil || confirmation.UserID != getUserID(c) {
+			c.AbortWithError(http.StatusBadRequest, oidc.ErrInvalidLogin)
+			return
+		}
+
+		res, err := user.SignInWithOidc(confirmation.Issuer, confirmation.Subject, confirmation.Email, confirmation.UserID, request.ConfirmMerge, client)
+
+		if errors.Is(err, user.ErrConfirmMerge) {
+			c.AbortWithStatusJSON(http.StatusPreconditionRequired, gin.H{"email": user.OidcAccountName(confirmation.Subject, confirmation.Email)})
+			return
+		}
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		c.SetSameSite(http.SameSiteLaxMode)
+		c.SetCookie(oidcConfirmCookie, "", -1, "/api/oidc", "", true, true)
+
+		switchUser(c, res.ID, confirmation.Email)
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	ginLambda = ginadapter.NewV2(r)
+}
+
+// checkRoomID rejects reserved and blocked IDs with the reason
+func checkRoomID(c *gin.Context, id string) bool {
+	if reason := roomIDs.Check(id); reason != "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"reason": reason})
+		return false
+	}
+
+	return true
+}
+
+// abortWithPhoneError maps errors from linking and recovering with a phone number, it is false when there wasn't one
+func abortWithPhoneError(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, user.ErrInvalidCode):
+		c.AbortWithError(http.StatusUnauthorized, err)
+	case errors.Is(err, user.ErrPhoneTaken):
+		c.AbortWithError(http.StatusConflict, err)
+	case errors.Is(err, user.ErrTooSoon), errors.Is(err, user.ErrDailyLimit):
+		c.AbortWithError(http.StatusTooManyRequests, err)
+	case errors.Is(err, sms.ErrNotConfigured):
+		c.AbortWithError(http.StatusServiceUnavailable, err)
+	default:
+		c.AbortWithError(http.StatusBadRequest, err)
+	}
+
+	return true
+}
+
+// abortWithSignInError maps errors from signing in by email, it is false when there wasn't one
+func abortWithSignInError(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, user.ErrInvalidLink):
+		c.AbortWithError(http.StatusUnauthorized, err)
+	case errors.Is(err, user.ErrEmailTaken):
+		c.AbortWithError(http.StatusConflict, err)
+	case errors.Is(err, user.ErrTooSoon):
+		c.AbortWithError(http.StatusTooManyRequests, err)
+	case errors.Is(err, email.ErrNotConfigured):
+		c.AbortWithError(http.StatusServiceUnavailable, err)
+	default:
+		c.AbortWithError(http.StatusBadRequest, err)
+	}
+
+	return true
+}
+
+// getUnlockedRooms is the unlock key of each protected room the session has the passcode for
+func getUnlockedRooms(c *gin.Context) []string {
+	unlocked, _ := sessions.Default(c).Get("unlocked_rooms").([]string)
+
+	return unlocked
+}
+
+// addUnlockedRoom replaces any older key for the room, only the most recent rooms are kept to stay inside the cookie
+func addUnlockedRoom(c *gin.Context, roomID string, key string) {
+	unlocked := []string{key}
+
+	for _, existing := range getUnlockedRooms(c) {
+		if !strings.HasPrefix(existing, roomID+"@") && len(unlocked) < maxUnlockedRooms {
+			unlocked = append(unlocked, existing)
+		}
+	}
+
+	session := sessions.Default(c)
+	session.Set("unlocked_rooms", unlocked)
+	session.Save()
+}
+
+// getVerifiedEmail is the address the session signed in with at the identity provider, if it did
+func getVerifiedEmail(c *gin.Context) string {
+	email, _ := sessions.Default(c).Get("verified_email").(string)
+
+	return email
+}
+
+// switchUser moves the session to userID, verifiedEmail is only set by signing in with the identity provider.
+// The session gets a new secret so a cookie from before signing in can't be used as the account.
+func switchUser(c *gin.Context, userID string, verifiedEmail string) {
+	session := sessions.Default(c)
+	session.Set("user_id", userID)
+	sessionstore.Renew(session)
+
+	if verifiedEmail != "" {
+		session.Set("verified_email", verifiedEmail)
+	} else {
+		session.Delete("verified_email")
+	}
+
+	session.Save()
+}
+
+// requireRole loads the room in the path and stops anyone whose role in it is below role
+func requireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("roomID")
+		if id == "" {
+			id = c.Param("id")
+		}
+
+		userID := getUserID(c)
+
+		res, err := room.GetRoom(id, client, userID)
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		if res == nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		if !res.Can(userID, role) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		c.Set("room", res)
+	}
+}
+
+// currentRoom is the room loaded by requireRole
+func currentRoom(c *gin.Context) *room.Room {
+	return c.MustGet("room").(*room.Room)
+}
+
+// getUserID is the user an API token acts as, otherwise the session's
+func getUserID(c *gin.Context) string {
+	if userID, ok := c.Get(middleware.TokenUserID); ok {
+		return userID.(string)
+	}
 
-func getUserID(c *gin.Context) string {
 	return fmt.Sprintf("%v", sessions.Default(c).Get("user_id"))
 }
 
@@ -0,0 +1,36 @@
+// Runs an OpenID Connect issuer that signs in whoever asks, for trying identity provider sign in locally
+//
+//	go run ./cmd/mock-oidc -addr localhost:9000 -client-id picker
+//
+// then set /picker/oidc_issuer to http://localhost:9000 and /picker/oidc_client_id to picker.
+// The sign in page asks for an email, the subject is derived from it so the same email is always the same person.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"picker/backend/go/pkg/oidc/oidctest"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:9000", "address to listen on")
+	issuerURL := flag.String("issuer", "", "issuer URL, defaults to http://addr")
+	clientID := flag.String("client-id", "picker", "the only client allowed to sign in")
+	email := flag.String("email", "someone@example.com", "email filled in on the sign in page")
+
+	flag.Parse()
+
+	if *issuerURL == "" {
+		*issuerURL = "http://" + *addr
+	}
+
+	issuer, err := oidctest.New(*issuerURL, *clientID, *email)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("issuer %s for client %s", issuer.URL, issuer.ClientID)
+	log.Fatal(http.ListenAndServe(*addr, issuer.Handler()))
+}
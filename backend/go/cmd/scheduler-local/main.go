@@ -0,0 +1,67 @@
+// Runs the scheduler once against a local table, e.g. DynamoDB Local
+//
+//	go run ./cmd/scheduler-local -endpoint http://localhost:8000 -table picker -now 2021-11-01T09:00:00Z
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"picker/backend/go/pkg/room"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+func main() {
+	endpoint := flag.String("endpoint", "http://localhost:8000", "DynamoDB endpoint")
+	table := flag.String("table", "picker", "table name")
+	region := flag.String("region", "ap-southeast-2", "region")
+	at := flag.String("now", "", "run as if it is this time (RFC3339), defaults to now")
+
+	flag.Parse()
+
+	now := time.Now()
+
+	if *at != "" {
+		parsed, err := time.Parse(time.RFC3339, *at)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		now = parsed
+	}
+
+	// The room package reads the table name from the environment
+	os.Setenv("table", *table)
+
+	cfg, err := config.LoadDefaultConfig(context.TODO(), func(o *config.LoadOptions) error {
+		o.Region = *region
+		return nil
+	})
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	client := dynamodb.NewFromConfig(cfg, dynamodb.WithEndpointResolver(dynamodb.EndpointResolverFromURL(*endpoint)))
+
+	results, err := room.RunDue(now.UTC(), client)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	out, err := json.MarshalIndent(results, "", "  ")
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	os.Stdout.Write(out)
+	os.Stdout.Write([]byte("\n"))
+}
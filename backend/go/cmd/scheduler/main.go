@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"picker/backend/go/pkg/room"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+var client *dynamodb.Client
+
+// Handler is run on a schedule by EventBridge and ends the cycle of every recurring room that is due
+func Handler(ctx context.Context, event events.CloudWatchEvent) ([]room.CycleResult, error) {
+	now := event.Time
+
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	results, err := room.RunDue(now.UTC(), client)
+
+	for _, result := range results {
+		log.Default().Printf("Room %s next runs at %s %s", result.RoomID, result.NextRunAt.Format(time.RFC3339), result.Error)
+	}
+
+	return results, err
+}
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.TODO(), func(o *config.LoadOptions) error {
+		o.Region = os.Getenv("region")
+		return nil
+	})
+
+	if err != nil {
+		panic(err)
+	}
+
+	client = dynamodb.NewFromConfig(cfg)
+}
+
+func main() {
+	lambda.Start(Handler)
+}
@@ -1,20 +1,69 @@
 package dynamodbTypes
 
 import (
+	"time"
+
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
 
 const (
-	Room   = "room"
-	User   = "user"
-	Option = "option"
+	Room     = "room"
+	User     = "user"
+	Option   = "option"
+	Snapshot = "snapshot"
+	Template = "template"
+	Redirect = "redirect"
+	Attempt  = "attempt"
+	Invite   = "invite"
+	Member   = "member"
+	Transfer = "transfer"
+	Phone    = "phone"
+	Code     = "code"
+	Email    = "email"
+	SignIn   = "signin"
+	Pairing  = "pairing"
+	Identity = "identity"
+	Token    = "token"
+	Session  = "session"
+	RowGuard = "rowguard"
+
+	SnapshotOption = "snapshotoption"
+	TemplateOption = "templateoption"
+	Budget         = "budget"
+	LegacyCookie   = "legacycookie"
 )
 
+// Tombstoned items are kept for this long before the table's TTL removes them
+const Retention = 30 * 24 * time.Hour
+
 type Simple struct {
 	Type string
 }
 
+type Expiring struct {
+	// ExpiresAt is the table's TTL attribute, in unix seconds
+	ExpiresAt int64 `dynamodbav:"expiresAt"`
+}
+
+// ExpiresAt is when an item tombstoned now should be removed
+func ExpiresAt(now time.Time) int64 {
+	return now.Add(Retention).Unix()
+}
+
+// Expired items can still be returned until DynamoDB gets around to removing them
+func Expired(item map[string]types.AttributeValue) bool {
+	expiring := &Expiring{}
+
+	err := attributevalue.UnmarshalMap(item, expiring)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return expiring.ExpiresAt > 0 && expiring.ExpiresAt <= time.Now().Unix()
+}
+
 func GetType(item map[string]types.AttributeValue) string {
 	base := &Simple{}
 
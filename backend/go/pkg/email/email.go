@@ -0,0 +1,116 @@
+package email
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+var ErrNotConfigured = errors.New("email is not configured")
+
+// Sender sends a plain text email
+type Sender interface {
+	Send(ctx context.Context, to string, subject string, body string) error
+}
+
+// New sends through the SMTP server at addr, leave username empty for a local catcher that doesn't need auth
+func New(addr string, username string, password string, from string) Sender {
+	if addr == "" {
+		return disabled{}
+	}
+
+	return &SMTP{Addr: addr, Username: username, Password: password, From: from}
+}
+
+type SMTP struct {
+	// Addr is host:port
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+func (s *SMTP) Send(ctx context.Context, to string, subject string, body string) error {
+	// Headers can't be smuggled in through the address or subject
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return fmt.Errorf("invalid email header")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", s.Addr)
+
+	if err != nil {
+		return err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	host, _, err := net.SplitHostPort(s.Addr)
+
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	client, err := smtp.NewClient(conn, host)
+
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+
+	if s.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(s.From); err != nil {
+		return err
+	}
+
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+
+	w, err := client.Data()
+
+	if err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n", s.From, to, subject, body)
+
+	if _, err := w.Write([]byte(message)); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+type disabled struct{}
+
+func (disabled) Send(ctx context.Context, to string, subject string, body string) error {
+	return ErrNotConfigured
+}
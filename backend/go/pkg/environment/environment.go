@@ -10,6 +10,30 @@ import (
 
 type Environment struct {
 	CookieSecret string `mapstructure:"COOKIE_SECRET"`
+	// Comma separated, added to the built in lists
+	ReservedRoomIDs  string `mapstructure:"RESERVED_ROOM_IDS"`
+	BlockedRoomWords string `mapstructure:"BLOCKED_ROOM_WORDS"`
+	// Comma separated, replace the built in words for generated room IDs
+	RoomIDAdjectives string `mapstructure:"ROOM_ID_ADJECTIVES"`
+	RoomIDNouns      string `mapstructure:"ROOM_ID_NOUNS"`
+	// SmsProvider is twilio, or log to write codes to the log when running locally
+	SmsProvider      string `mapstructure:"SMS_PROVIDER"`
+	TwilioAccountSID string `mapstructure:"TWILIO_ACCOUNT_SID"`
+	TwilioAuthToken  string `mapstructure:"TWILIO_AUTH_TOKEN"`
+	TwilioFrom       string `mapstructure:"TWILIO_FROM"`
+	// SmtpAddr is host:port, sign in emails are disabled without it
+	SmtpAddr     string `mapstructure:"SMTP_ADDR"`
+	SmtpUsername string `mapstructure:"SMTP_USERNAME"`
+	SmtpPassword string `mapstructure:"SMTP_PASSWORD"`
+	EmailFrom    string `mapstructure:"EMAIL_FROM"`
+	// SiteURL is where links in emails point, without a trailing slash
+	SiteURL string `mapstructure:"SITE_URL"`
+	// OidcIssuer is the identity provider to sign in with, it is disabled without one
+	OidcIssuer       string `mapstructure:"OIDC_ISSUER"`
+	OidcClientID     string `mapstructure:"OIDC_CLIENT_ID"`
+	OidcClientSecret string `mapstructure:"OIDC_CLIENT_SECRET"`
+	// OidcRedirectURL is the API's /oidc/callback as registered with the issuer
+	OidcRedirectURL string `mapstructure:"OIDC_REDIRECT_URL"`
 }
 
 // these will hang around for the entire life of the lambda
@@ -33,7 +57,9 @@ func New(client *ssm.Client, path *string) *Environment {
 		environmentMap[name] = p.Value
 	}
 
-	environment := &Environment{}
+	environment := &Environment{
+		SiteURL: "https://picknow.io",
+	}
 
 	decodeErr := mapstructure.Decode(&environmentMap, environment)
 
@@ -0,0 +1,81 @@
+package export
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"picker/backend/go/pkg/option"
+	"time"
+)
+
+var header = []string{
+	"position",
+	"value",
+	"description",
+	"location",
+	"url",
+	"image",
+	"price",
+	"currency",
+	"notes",
+	"startsAt",
+	"endsAt",
+	"selectedBy",
+}
+
+// CSV writes one row per option with whoever picked it, deleted options are left out
+func CSV(w io.Writer, options []option.Option) error {
+	writer := csv.NewWriter(w)
+
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+
+	for _, opt := range options {
+		if opt.DeletedAt != nil {
+			continue
+		}
+
+		price, currency := "", ""
+		if opt.Price != nil {
+			price = fmt.Sprint(opt.Price.Amount)
+			currency = opt.Price.Currency
+		}
+
+		selectedBy := ""
+		if opt.SelectedByName != nil {
+			selectedBy = *opt.SelectedByName
+		}
+
+		err := writer.Write([]string{
+			fmt.Sprint(opt.Position),
+			opt.Value,
+			opt.Description,
+			opt.Location,
+			opt.URL,
+			opt.Image,
+			price,
+			currency,
+			opt.Notes,
+			formatTime(opt.StartsAt),
+			formatTime(opt.EndsAt),
+			selectedBy,
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+
+	return writer.Error()
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,82 @@
+package grid
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Spec describes a matrix room, e.g. dates down the side and time blocks across the top
+type Spec struct {
+	Rows    []string `json:"rows" binding:"required,gt=0,lt=200,dive,required,min=1,max=200"`
+	Columns []string `json:"columns" binding:"required,gt=0,lt=200,dive,required,min=1,max=200"`
+	// MaxPerRow limits how many cells one person can pick in each row, 0 is unlimited
+	MaxPerRow int `json:"maxPerRow" binding:"min=0"`
+	// RowMaxSelections overrides MaxPerRow for each row, in the same order as Rows
+	RowMaxSelections []int `json:"rowMaxSelections" binding:"omitempty,dive,min=0"`
+}
+
+type Row struct {
+	Label         string `json:"label" dynamodbav:"label"`
+	MaxSelections int    `json:"maxSelections,omitempty" dynamodbav:"maxSelections,omitempty"`
+}
+
+type Grid struct {
+	Rows    []Row    `json:"rows" dynamodbav:"rows"`
+	Columns []string `json:"columns" dynamodbav:"columns"`
+}
+
+type Cell struct {
+	Row    int
+	Column int
+	Label  string
+}
+
+func (spec Spec) Grid() (*Grid, error) {
+	if len(spec.RowMaxSelections) > 0 && len(spec.RowMaxSelections) != len(spec.Rows) {
+		return nil, errors.New("rowMaxSelections must have one entry per row")
+	}
+
+	rows := make([]Row, len(spec.Rows))
+
+	for i, label := range spec.Rows {
+		rows[i] = Row{
+			Label:         label,
+			MaxSelections: spec.MaxPerRow,
+		}
+
+		if len(spec.RowMaxSelections) > 0 {
+			rows[i].MaxSelections = spec.RowMaxSelections[i]
+		}
+	}
+
+	return &Grid{
+		Rows:    rows,
+		Columns: spec.Columns,
+	}, nil
+}
+
+// Cells lists every cell row by row, each cell becomes an option
+func (grid Grid) Cells() []Cell {
+	var cells []Cell
+
+	for r, row := range grid.Rows {
+		for c, column := range grid.Columns {
+			cells = append(cells, Cell{
+				Row:    r,
+				Column: c,
+				Label:  fmt.Sprintf("%s · %s", row.Label, column),
+			})
+		}
+	}
+
+	return cells
+}
+
+// MaxSelections for a row, 0 is unlimited
+func (grid Grid) MaxSelections(row int) int {
+	if row < 0 || row >= len(grid.Rows) {
+		return 0
+	}
+
+	return grid.Rows[row].MaxSelections
+}
@@ -1,8 +1,10 @@
 package middleware
 
 import (
+	"errors"
 	"log"
 	"net/http"
+	"strings"
 
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
@@ -11,6 +13,11 @@ import (
 
 func UserId() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		// Scripts using an API token don't keep cookies, a session for each request would only fill the table
+		if strings.HasPrefix(c.GetHeader("Authorization"), "Bearer ") {
+			return
+		}
+
 		session := sessions.Default(c)
 		userID := session.Get("user_id")
 
@@ -28,8 +35,87 @@ func UserId() gin.HandlerFunc {
 			session.Set("user_id", userID)
 		}
 
-		session.Save()
+		// Sessions are kept in the table now, don't carry on as someone new when it can't be read
+		if err := session.Save(); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
 
 		log.Default().Printf("UserID %s accessing %s", userID, c.Request.URL)
 	}
 }
+
+// RoomID swaps the room ID in the path for the one the room is stored under, so IDs work in any casing
+func RoomID(resolve func(id string) (string, error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for i, param := range c.Params {
+			if param.Key != "id" && param.Key != "roomID" {
+				continue
+			}
+
+			resolved, err := resolve(param.Value)
+
+			if err != nil {
+				c.AbortWithError(http.StatusBadRequest, err)
+				return
+			}
+
+			c.Params[i].Value = resolved
+		}
+	}
+}
+
+// TokenUserID is set on the context to the user an API token acts as
+const TokenUserID = "token_user_id"
+
+// BearerToken lets scripts send an API token instead of the session cookie.
+//
+// routeScopes is the scope a token needs for each "METHOD /full/path", tokens can't be used on any other route.
+// resolve returns invalid for unknown tokens. Requests without an Authorization header carry on with the session as before.
+func BearerToken(resolve func(token string) (userID string, scopes []string, err error), routeScopes map[string]string, invalid error) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+
+		if header == "" {
+			return
+		}
+
+		token := strings.TrimPrefix(header, "Bearer ")
+
+		if token == header {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+
+		userID, scopes, err := resolve(token)
+
+		if errors.Is(err, invalid) {
+			c.AbortWithError(http.StatusUnauthorized, err)
+			return
+		}
+
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		scope, ok := routeScopes[c.Request.Method+" "+c.FullPath()]
+
+		if !ok || !contains(scopes, scope) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		c.Set(TokenUserID, userID)
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
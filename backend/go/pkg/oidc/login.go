@@ -0,0 +1,155 @@
+package oidc
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"picker/backend/go/pkg/signing"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LoginTTL is how long someone has at the issuer before they have to start again
+const LoginTTL = 10 * time.Minute
+
+var ErrInvalidLogin = errors.New("sign in has expired or was started somewhere else")
+
+// Login is what the browser keeps while it is away at the issuer.
+//
+// The session cookie is SameSite strict so it isn't sent when the issuer redirects back,
+// Login carries the user ID across instead so their rooms can be merged into the account.
+type Login struct {
+	ExpiresAt int64
+	State     string
+	Nonce     string
+	Verifier  string
+	UserID    string
+	// Redirect is the path on the site to go back to afterwards
+	Redirect string
+}
+
+// NewLogin only keeps redirects to paths on the site
+func NewLogin(userID string, redirect string) (*Login, error) {
+	login := &Login{
+		ExpiresAt: time.Now().Add(LoginTTL).Unix(),
+		UserID:    userID,
+		Redirect:  "/",
+	}
+
+	if strings.HasPrefix(redirect, "/") && !strings.HasPrefix(redirect, "//") && !strings.HasPrefix(redirect, "/\\") {
+		login.Redirect = redirect
+	}
+
+	for _, value := range []*string{&login.State, &login.Nonce, &login.Verifier} {
+		random, err := RandomString()
+
+		if err != nil {
+			return nil, err
+		}
+
+		*value = random
+	}
+
+	return login, nil
+}
+
+// Encode signs the login for a cookie, it isn't encrypted so the cookie should be http only
+func (login Login) Encode(secret string) string {
+	// The redirect goes last, it is the only part that can contain a colon
+	return signing.Sign(secret, fmt.Sprintf("oidc:%d:%s:%s:%s:%s:%s", login.ExpiresAt, login.State, login.Nonce, login.Verifier, login.UserID, login.Redirect))
+}
+
+// DecodeLogin checks the cookie is ours and hasn't expired, state is the one the issuer sent back
+func DecodeLogin(secret string, value string, state string) (*Login, error) {
+	payload, err := signing.Verify(secret, value)
+
+	if err != nil {
+		return nil, ErrInvalidLogin
+	}
+
+	parts := strings.SplitN(payload, ":", 7)
+
+	if len(parts) != 7 || parts[0] != "oidc" {
+		return nil, ErrInvalidLogin
+	}
+
+	expiresAt, err := strconv.ParseInt(parts[1], 10, 64)
+
+	if err != nil || time.Now().Unix() > expiresAt || parts[2] != state {
+		return nil, ErrInvalidLogin
+	}
+
+	return &Login{
+		ExpiresAt: expiresAt,
+		State:     parts[2],
+		Nonce:     parts[3],
+		Verifier:  parts[4],
+		UserID:    parts[5],
+		Redirect:  parts[6],
+	}, nil
+}
+
+// Confirmation is a verified sign in waiting for the person to agree to their device being merged into the account.
+//
+// It is kept in a cookie like Login while the site asks, UserID is the device's user it was verified for.
+type Confirmation struct {
+	ExpiresAt int64
+	Issuer    string
+	Subject   string
+	Email     string
+	UserID    string
+}
+
+// NewConfirmation can be used until the login it came from would have expired
+func NewConfirmation(issuer string, subject string, email string, userID string) Confirmation {
+	return Confirmation{
+		ExpiresAt: time.Now().Add(LoginTTL).Unix(),
+		Issuer:    issuer,
+		Subject:   subject,
+		Email:     email,
+		UserID:    userID,
+	}
+}
+
+// Encode signs the confirmation for a cookie, the issuer is a URL so the parts are query encoded
+func (confirmation Confirmation) Encode(secret string) string {
+	values := url.Values{
+		"exp":    {strconv.FormatInt(confirmation.ExpiresAt, 10)},
+		"iss":    {confirmation.Issuer},
+		"sub":    {confirmation.Subject},
+		"email":  {confirmation.Email},
+		"userID": {confirmation.UserID},
+	}
+
+	return signing.Sign(secret, "oidcconfirm:"+values.Encode())
+}
+
+// DecodeConfirmation checks the cookie is ours and hasn't expired
+func DecodeConfirmation(secret string, value string) (*Confirmation, error) {
+	payload, err := signing.Verify(secret, value)
+
+	if err != nil || !strings.HasPrefix(payload, "oidcconfirm:") {
+		return nil, ErrInvalidLogin
+	}
+
+	values, err := url.ParseQuery(strings.TrimPrefix(payload, "oidcconfirm:"))
+
+	if err != nil {
+		return nil, ErrInvalidLogin
+	}
+
+	expiresAt, err := strconv.ParseInt(values.Get("exp"), 10, 64)
+
+	if err != nil || time.Now().Unix() > expiresAt || values.Get("sub") == "" {
+		return nil, ErrInvalidLogin
+	}
+
+	return &Confirmation{
+		ExpiresAt: expiresAt,
+		Issuer:    values.Get("iss"),
+		Subject:   values.Get("sub"),
+		Email:     values.Get("email"),
+		UserID:    values.Get("userID"),
+	}, nil
+}
@@ -0,0 +1,403 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Allowed difference between our clock and the issuer's when checking expiry
+const leeway = time.Minute
+
+var ErrNotConfigured = errors.New("sign in with an identity provider is not configured")
+var ErrInvalidToken = errors.New("id token is invalid")
+
+// Provider signs users in with an OpenID Connect issuer using the authorization code flow with PKCE
+type Provider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the callback registered with the issuer
+	RedirectURL string
+
+	client *http.Client
+
+	// The issuer's endpoints and keys are fetched the first time they are needed
+	mu        sync.Mutex
+	discovery *discovery
+	keys      map[string]*rsa.PublicKey
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Claims are the parts of a verified ID token we use
+type Claims struct {
+	Issuer          string   `json:"iss"`
+	Subject         string   `json:"sub"`
+	Audience        audience `json:"aud"`
+	AuthorizedParty string   `json:"azp"`
+	Expiry          int64    `json:"exp"`
+	Nonce           string   `json:"nonce"`
+	Email           string   `json:"email"`
+	EmailVerified   boolish  `json:"email_verified"`
+}
+
+// VerifiedEmail is empty unless the issuer says it checked the address
+func (claims Claims) VerifiedEmail() string {
+	if !claims.EmailVerified {
+		return ""
+	}
+
+	return strings.ToLower(claims.Email)
+}
+
+// audience can be a single string or a list
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+
+	var list []string
+
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+
+	*a = list
+
+	return nil
+}
+
+func (a audience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// boolish accepts the "true" some issuers send instead of true
+type boolish bool
+
+func (b *boolish) UnmarshalJSON(data []byte) error {
+	*b = boolish(string(data) == "true" || string(data) == `"true"`)
+
+	return nil
+}
+
+// New is disabled when issuer is empty, its methods return ErrNotConfigured
+func New(issuer string, clientID string, clientSecret string, redirectURL string) *Provider {
+	return &Provider{
+		Issuer:       issuer,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// RandomString is for state, nonces and PKCE verifiers
+func RandomString() (string, error) {
+	b := make([]byte, 32)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Challenge is the S256 PKCE challenge for verifier
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL is where to send the browser to sign in, state, nonce and verifier should be kept in the session
+func (p *Provider) AuthCodeURL(ctx context.Context, state string, nonce string, verifier string) (string, error) {
+	d, err := p.getDiscovery(ctx)
+
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {"openid email profile"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {Challenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+
+	separator := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	return d.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Exchange swaps the code from the callback for an ID token and verifies it
+func (p *Provider) Exchange(ctx context.Context, code string, verifier string, nonce string) (*Claims, error) {
+	d, err := p.getDiscovery(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"client_id":     {p.ClientID},
+		"code_verifier": {verifier},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	// Public clients don't have a secret, PKCE stands in for it
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	res, err := p.client.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	body := struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}{}
+
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&body); err != nil {
+		return nil, fmt.Errorf("token endpoint returned %s: %w", res.Status, err)
+	}
+
+	if res.StatusCode != http.StatusOK || body.Error != "" {
+		return nil, fmt.Errorf("token endpoint returned %s: %s %s", res.Status, body.Error, body.ErrorDescription)
+	}
+
+	return p.verify(ctx, body.IDToken, nonce)
+}
+
+// verify checks an RS256 ID token was signed by the issuer for us and for this sign in
+func (p *Provider) verify(ctx context.Context, raw string, nonce string) (*Claims, error) {
+	parts := strings.Split(raw, ".")
+
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	// Anything else, including none, is refused
+	if header.Alg != "RS256" {
+		return nil, ErrInvalidToken
+	}
+
+	key, err := p.getKey(ctx, header.Kid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	signed := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	if rsa.VerifyPKCS1v15(key, crypto.SHA256, signed[:], signature) != nil {
+		return nil, ErrInvalidToken
+	}
+
+	claims := &Claims{}
+
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	switch {
+	case claims.Issuer != p.Issuer,
+		!claims.Audience.contains(p.ClientID),
+		len(claims.Audience) > 1 && claims.AuthorizedParty != p.ClientID,
+		time.Unix(claims.Expiry, 0).Add(leeway).Before(time.Now()),
+		claims.Nonce != nonce,
+		claims.Subject == "":
+		return nil, ErrInvalidToken
+	}
+
+	return claims, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func (p *Provider) getDiscovery(ctx context.Context) (*discovery, error) {
+	if p.Issuer == "" {
+		return nil, ErrNotConfigured
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	d := &discovery{}
+
+	if err := p.getJSON(ctx, strings.TrimRight(p.Issuer, "/")+"/.well-known/openid-configuration", d); err != nil {
+		return nil, err
+	}
+
+	// Stops a compromised discovery document pointing us at someone else's tokens
+	if d.Issuer != p.Issuer {
+		return nil, fmt.Errorf("discovery document is for %q, not %q", d.Issuer, p.Issuer)
+	}
+
+	p.discovery = d
+
+	return d, nil
+}
+
+// getKey fetches the issuer's keys again when it sees a new key ID, they are rotated from time to time
+func (p *Provider) getKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	d, err := p.getDiscovery(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	set := struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}{}
+
+	if err := p.getJSON(ctx, d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+
+		if errN != nil || errE != nil || len(e) > 4 {
+			continue
+		}
+
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	p.keys = keys
+
+	key, ok := keys[kid]
+
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+
+	return key, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	res, err := p.client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, res.Status)
+	}
+
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(v)
+}
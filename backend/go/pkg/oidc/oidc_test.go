@@ -0,0 +1,311 @@
+package oidc
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"picker/backend/go/pkg/oidc/oidctest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const clientID = "picker"
+const redirectURL = "https://picknow.example/api/oidc/callback"
+
+// newIssuer starts the mock issuer and a provider that signs in with it
+func newIssuer(t *testing.T) (*oidctest.Issuer, *Provider) {
+	t.Helper()
+
+	issuer, err := oidctest.New("", clientID, "")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(issuer.Handler())
+	t.Cleanup(server.Close)
+
+	issuer.URL = server.URL
+
+	return issuer, New(server.URL, clientID, "", redirectURL)
+}
+
+// authorize signs in at the issuer's page the way a browser would and returns the code it sends back
+func authorize(t *testing.T, p *Provider, email string, unverified bool, state string, nonce string, verifier string) string {
+	t.Helper()
+
+	authURL, err := p.AuthCodeURL(context.Background(), state, nonce, verifier)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{"email": {email}}
+	if unverified {
+		form.Set("unverified", "on")
+	}
+
+	// The redirect goes to the API, which isn't running
+	browser := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	res, err := browser.PostForm(authURL, form)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("authorize returned %s", res.Status)
+	}
+
+	location, err := url.Parse(res.Header.Get("Location"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if callback := location.Scheme + "://" + location.Host + location.Path; callback != redirectURL {
+		t.Fatalf("redirected to %s, want %s", callback, redirectURL)
+	}
+
+	if got := location.Query().Get("state"); got != state {
+		t.Fatalf("state %q, want %q", got, state)
+	}
+
+	return location.Query().Get("code")
+}
+
+func TestExchange(t *testing.T) {
+	_, p := newIssuer(t)
+
+	code := authorize(t, p, "Someone@Example.com", false, "state", "nonce", "verifier")
+
+	claims, err := p.Exchange(context.Background(), code, "verifier", "nonce")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.Subject != oidctest.Subject("someone@example.com") {
+		t.Errorf("subject %q, want the one for someone@example.com", claims.Subject)
+	}
+
+	if claims.Issuer != p.Issuer {
+		t.Errorf("issuer %q, want %q", claims.Issuer, p.Issuer)
+	}
+
+	if got := claims.VerifiedEmail(); got != "someone@example.com" {
+		t.Errorf("verified email %q, want someone@example.com", got)
+	}
+}
+
+func TestExchangeUnverifiedEmail(t *testing.T) {
+	_, p := newIssuer(t)
+
+	code := authorize(t, p, "someone@example.com", true, "state", "nonce", "verifier")
+
+	claims, err := p.Exchange(context.Background(), code, "verifier", "nonce")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.Email != "someone@example.com" {
+		t.Errorf("email %q, want someone@example.com", claims.Email)
+	}
+
+	if got := claims.VerifiedEmail(); got != "" {
+		t.Errorf("verified email %q, want none", got)
+	}
+}
+
+func TestExchangePKCE(t *testing.T) {
+	_, p := newIssuer(t)
+
+	code := authorize(t, p, "someone@example.com", false, "state", "nonce", "verifier")
+
+	if _, err := p.Exchange(context.Background(), code, "someone else's verifier", "nonce"); err == nil {
+		t.Error("exchanged a code with the wrong verifier")
+	}
+
+	// The issuer throws the code away after a failed attempt too
+	if _, err := p.Exchange(context.Background(), code, "verifier", "nonce"); err == nil {
+		t.Error("exchanged a code after a failed attempt")
+	}
+}
+
+func TestExchangeCodeOnce(t *testing.T) {
+	_, p := newIssuer(t)
+
+	code := authorize(t, p, "someone@example.com", false, "state", "nonce", "verifier")
+
+	if _, err := p.Exchange(context.Background(), code, "verifier", "nonce"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.Exchange(context.Background(), code, "verifier", "nonce"); err == nil {
+		t.Error("exchanged the same code twice")
+	}
+}
+
+func TestExchangeNonce(t *testing.T) {
+	_, p := newIssuer(t)
+
+	code := authorize(t, p, "someone@example.com", false, "state", "nonce", "verifier")
+
+	if _, err := p.Exchange(context.Background(), code, "verifier", "another sign in's nonce"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("got %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestNotConfigured(t *testing.T) {
+	p := New("", clientID, "", redirectURL)
+
+	if _, err := p.AuthCodeURL(context.Background(), "state", "nonce", "verifier"); !errors.Is(err, ErrNotConfigured) {
+		t.Errorf("got %v, want ErrNotConfigured", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	issuer, p := newIssuer(t)
+
+	// claims are a valid token's, changed by each case
+	claims := func(change func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":            issuer.URL,
+			"sub":            "subject",
+			"aud":            clientID,
+			"exp":            time.Now().Add(time.Hour).Unix(),
+			"nonce":          "nonce",
+			"email":          "someone@example.com",
+			"email_verified": true,
+		}
+
+		if change != nil {
+			change(c)
+		}
+
+		return c
+	}
+
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		valid  bool
+	}{
+		{"valid", claims(nil), true},
+		{"another issuer", claims(func(c map[string]interface{}) { c["iss"] = "https://issuer.example" }), false},
+		{"another audience", claims(func(c map[string]interface{}) { c["aud"] = "someone-else" }), false},
+		{"audiences without azp", claims(func(c map[string]interface{}) { c["aud"] = []string{"someone-else", clientID} }), false},
+		{"audiences with another azp", claims(func(c map[string]interface{}) {
+			c["aud"] = []string{"someone-else", clientID}
+			c["azp"] = "someone-else"
+		}), false},
+		{"audiences with our azp", claims(func(c map[string]interface{}) {
+			c["aud"] = []string{"someone-else", clientID}
+			c["azp"] = clientID
+		}), true},
+		{"expired", claims(func(c map[string]interface{}) { c["exp"] = time.Now().Add(-2 * leeway).Unix() }), false},
+		{"expired within the leeway", claims(func(c map[string]interface{}) { c["exp"] = time.Now().Add(-leeway / 2).Unix() }), true},
+		{"another nonce", claims(func(c map[string]interface{}) { c["nonce"] = "another" }), false},
+		{"no nonce", claims(func(c map[string]interface{}) { delete(c, "nonce") }), false},
+		{"no subject", claims(func(c map[string]interface{}) { delete(c, "sub") }), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token, err := issuer.Sign(test.claims)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = p.verify(context.Background(), token, "nonce")
+
+			if test.valid && err != nil {
+				t.Errorf("refused a valid token: %v", err)
+			}
+
+			if !test.valid && !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("got %v, want ErrInvalidToken", err)
+			}
+		})
+	}
+}
+
+func TestVerifyEmailVerifiedString(t *testing.T) {
+	issuer, p := newIssuer(t)
+
+	token, err := issuer.Sign(map[string]interface{}{
+		"iss":            issuer.URL,
+		"sub":            "subject",
+		"aud":            clientID,
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"nonce":          "nonce",
+		"email":          "someone@example.com",
+		"email_verified": "true",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := p.verify(context.Background(), token, "nonce")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := claims.VerifiedEmail(); got != "someone@example.com" {
+		t.Errorf("verified email %q, want someone@example.com", got)
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	issuer, p := newIssuer(t)
+
+	token, err := issuer.Sign(map[string]interface{}{
+		"iss":   issuer.URL,
+		"sub":   "subject",
+		"aud":   clientID,
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": "nonce",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(token, ".")
+	encode := base64.RawURLEncoding.EncodeToString
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"alg none", encode([]byte(`{"alg":"none","typ":"JWT"}`)) + "." + parts[1] + "."},
+		{"alg HS256", encode([]byte(`{"alg":"HS256","typ":"JWT","kid":"mock"}`)) + "." + parts[1] + "." + parts[2]},
+		{"another subject", parts[0] + "." + encode([]byte(`{"sub":"someone else"}`)) + "." + parts[2]},
+		{"no signature", parts[0] + "." + parts[1] + "."},
+		{"unknown key", encode([]byte(`{"alg":"RS256","typ":"JWT","kid":"rotated"}`)) + "." + parts[1] + "." + parts[2]},
+		{"not a token", "not a token"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := p.verify(context.Background(), test.token, "nonce"); !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("got %v, want ErrInvalidToken", err)
+			}
+		})
+	}
+}
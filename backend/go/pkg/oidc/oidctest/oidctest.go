@@ -0,0 +1,289 @@
+// Package oidctest is an OpenID Connect issuer that signs in whoever asks, for cmd/mock-oidc and tests.
+//
+// It doesn't import the oidc package so the oidc package's own tests can use it.
+package oidctest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyID is the kid of the only signing key
+const KeyID = "mock"
+
+// Codes have to be swapped for tokens within this long
+const codeTTL = time.Minute
+
+// Issuer signs in any email posted to its sign in page, the subject is derived from it
+// so the same email is always the same person
+type Issuer struct {
+	URL      string
+	ClientID string
+	// Email is filled in on the sign in page
+	Email string
+
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]grant
+}
+
+// grant is an unused authorization code
+type grant struct {
+	redirectURI string
+	challenge   string
+	nonce       string
+	email       string
+	expiresAt   time.Time
+}
+
+var signInPage = template.Must(template.New("signin").Parse(`<!doctype html>
+<title>Mock identity provider</title>
+<form method="post">
+	<label>Email <input name="email" type="email" value="{{.Email}}" required></label>
+	<label><input name="unverified" type="checkbox"> Email isn't verified</label>
+	<button>Sign in</button>
+</form>`))
+
+// New makes a signing key, URL can be set afterwards when it isn't known until the server starts
+func New(url string, clientID string, email string) (*Issuer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Issuer{URL: url, ClientID: clientID, Email: email, key: key, codes: map[string]grant{}}, nil
+}
+
+func (i *Issuer) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/.well-known/openid-configuration", i.discovery)
+	mux.HandleFunc("/jwks", i.jwks)
+	mux.HandleFunc("/authorize", i.authorize)
+	mux.HandleFunc("/token", i.token)
+
+	return mux
+}
+
+func (i *Issuer) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                i.URL,
+		"authorization_endpoint":                i.URL + "/authorize",
+		"token_endpoint":                        i.URL + "/token",
+		"jwks_uri":                              i.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (i *Issuer) jwks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": KeyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(i.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(i.key.E)).Bytes()),
+		}},
+	})
+}
+
+// authorize shows the sign in page, then sends the browser back with a code
+func (i *Issuer) authorize(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case r.Form.Get("client_id") != i.ClientID:
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	case r.Form.Get("response_type") != "code":
+		http.Error(w, "only response_type code is supported", http.StatusBadRequest)
+		return
+	case r.Form.Get("code_challenge_method") != "S256" || r.Form.Get("code_challenge") == "":
+		http.Error(w, "a S256 code_challenge is required", http.StatusBadRequest)
+		return
+	}
+
+	redirectURI, err := url.Parse(r.Form.Get("redirect_uri"))
+
+	if err != nil || !redirectURI.IsAbs() {
+		http.Error(w, "redirect_uri must be absolute", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		// The form posts back to this URL, keeping the query
+		signInPage.Execute(w, map[string]string{"Email": i.Email})
+		return
+	}
+
+	code, err := randomString()
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	signedInAs := strings.ToLower(r.PostForm.Get("email"))
+
+	// Unverified addresses are left out, the same as a real issuer would mark them
+	if r.PostForm.Get("unverified") != "" {
+		signedInAs = "unverified:" + signedInAs
+	}
+
+	i.mu.Lock()
+	i.codes[code] = grant{
+		redirectURI: redirectURI.String(),
+		challenge:   r.Form.Get("code_challenge"),
+		nonce:       r.Form.Get("nonce"),
+		email:       signedInAs,
+		expiresAt:   time.Now().Add(codeTTL),
+	}
+	i.mu.Unlock()
+
+	query := redirectURI.Query()
+	query.Set("code", code)
+	query.Set("state", r.Form.Get("state"))
+	redirectURI.RawQuery = query.Encode()
+
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+// token swaps a code for an ID token once, checking it against the PKCE challenge
+func (i *Issuer) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ParseForm() != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	code := r.PostForm.Get("code")
+
+	i.mu.Lock()
+	g, ok := i.codes[code]
+	delete(i.codes, code)
+	i.mu.Unlock()
+
+	clientID := r.PostForm.Get("client_id")
+	if basicID, _, hasBasic := r.BasicAuth(); hasBasic {
+		clientID, _ = url.QueryUnescape(basicID)
+	}
+
+	switch {
+	case r.PostForm.Get("grant_type") != "authorization_code":
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	case clientID != i.ClientID:
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	case !ok || time.Now().After(g.expiresAt) || g.redirectURI != r.PostForm.Get("redirect_uri"),
+		challenge(r.PostForm.Get("code_verifier")) != g.challenge:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	email := strings.TrimPrefix(g.email, "unverified:")
+	now := time.Now()
+
+	idToken, err := i.Sign(map[string]interface{}{
+		"iss":            i.URL,
+		"sub":            Subject(email),
+		"aud":            i.ClientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+		"nonce":          g.nonce,
+		"email":          email,
+		"email_verified": email == g.email,
+	})
+
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": "mock",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+// Subject is who an email signs in as
+func Subject(email string) string {
+	sum := sha256.Sum256([]byte(email))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
+
+// Sign makes an RS256 ID token with any claims, tests use it for tokens the issuer wouldn't hand out
+func (i *Issuer) Sign(claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": KeyID})
+
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, i.key, crypto.SHA256, sum[:])
+
+	if err != nil {
+		return "", err
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// challenge is the S256 PKCE challenge for verifier
+func challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
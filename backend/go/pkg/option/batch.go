@@ -0,0 +1,246 @@
+package option
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	OpAdd            = "add"
+	OpDelete         = "delete"
+	OpEdit           = "edit"
+	OpClearSelection = "clearSelection"
+)
+
+const (
+	StatusOK = "ok"
+	// StatusFailed is an operation that failed on its own
+	StatusFailed = "failed"
+	// StatusRolledBack is an operation that would have worked but was in the same transaction as one that failed
+	StatusRolledBack = "rolledBack"
+)
+
+// transactionSize is how many operations are applied atomically. TransactWriteItems takes up to 100 items,
+// but one failed operation rolls back the rest of its transaction, so smaller groups lose less to a bad operation
+const transactionSize = 25
+
+type Operation struct {
+	Op       string               `json:"op" binding:"required,oneof=add delete edit clearSelection"`
+	OptionID string               `json:"optionID" binding:"required_unless=Op add"`
+	Option   *CreateOptionRequest `json:"option" binding:"required_if=Op add"`
+	Edit     *EditOptionRequest   `json:"edit" binding:"required_if=Op edit"`
+}
+
+type BatchRequest struct {
+	Operations []Operation `json:"operations" binding:"required,gt=0,lte=200,dive"`
+}
+
+type OperationResult struct {
+	Index    int     `json:"index"`
+	Op       string  `json:"op"`
+	OptionID string  `json:"optionID"`
+	Status   string  `json:"status"`
+	Error    string  `json:"error,omitempty"`
+	Option   *Option `json:"option,omitempty"`
+}
+
+type BatchResult struct {
+	Results   []OperationResult `json:"results"`
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+}
+
+// Adds counts the options a batch will create
+func (request BatchRequest) Adds() int {
+	adds := 0
+
+	for _, op := range request.Operations {
+		if op.Op == OpAdd {
+			adds++
+		}
+	}
+
+	return adds
+}
+
+// Batch applies the operations in transactions of transactionSize, nothing is retried so every operation gets a result
+func Batch(request BatchRequest, userID string, roomID string, nextPosition int, client *dynamodb.Client) BatchResult {
+	results := make([]OperationResult, len(request.Operations))
+	items := make([]*types.TransactWriteItem, len(request.Operations))
+	seen := map[string]bool{}
+
+	for i, op := range request.Operations {
+		results[i] = OperationResult{Index: i, Op: op.Op, OptionID: op.OptionID}
+
+		if op.Op == OpAdd {
+			if op.Option.Slots != nil {
+				results[i].Status = StatusFailed
+				results[i].Error = "slots can't be added in a batch"
+				continue
+			}
+
+			opt := NewOption(op.Option.Option, userID, roomID)
+			opt.Description = op.Option.Description
+			opt.Details = op.Option.Details
+			opt.Position = nextPosition
+			nextPosition++
+
+			results[i].OptionID = opt.ID
+			results[i].Option = &opt
+		} else if seen[op.OptionID] {
+			// A transaction can't touch the same item twice
+			results[i].Status = StatusFailed
+			results[i].Error = "option appears more than once"
+			continue
+		}
+
+		seen[results[i].OptionID] = true
+		items[i] = transactItem(op, results[i].Option, userID, roomID)
+	}
+
+	var pending []int
+	for i := range request.Operations {
+		if results[i].Status == "" {
+			pending = append(pending, i)
+		}
+	}
+
+	for start := 0; start < len(pending); start += transactionSize {
+		end := start + transactionSize
+
+		if end > len(pending) {
+			end = len(pending)
+		}
+
+		applyTransaction(pending[start:end], items, results, client)
+	}
+
+	batchResult := BatchResult{Results: results}
+
+	for _, res := range results {
+		if res.Status == StatusOK {
+			batchResult.Succeeded++
+		} else {
+			batchResult.Failed++
+		}
+	}
+
+	return batchResult
+}
+
+func applyTransaction(indexes []int, items []*types.TransactWriteItem, results []OperationResult, client *dynamodb.Client) {
+	transactItems := make([]types.TransactWriteItem, len(indexes))
+
+	for i, index := range indexes {
+		transactItems[i] = *items[index]
+	}
+
+	_, err := client.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{
+		TransactItems: transactItems,
+	})
+
+	if err == nil {
+		for _, index := range indexes {
+			results[index].Status = StatusOK
+
+			// marshal then unmarshal the option so it is initialised with non saved values (Available)
+			if opt := results[index].Option; opt != nil {
+				unmarshalled := Unmarshal(items[index].Put.Item)
+				results[index].Option = &unmarshalled
+			}
+		}
+
+		return
+	}
+
+	var cancelled *types.TransactionCanceledException
+	hasReasons := errors.As(err, &cancelled) && len(cancelled.CancellationReasons) == len(indexes)
+
+	for i, index := range indexes {
+		results[index].Option = nil
+		results[index].Status = StatusFailed
+		results[index].Error = err.Error()
+
+		if !hasReasons {
+			continue
+		}
+
+		reason := cancelled.CancellationReasons[i]
+
+		if reason.Code == nil || *reason.Code == "None" {
+			results[index].Status = StatusRolledBack
+			results[index].Error = ""
+			continue
+		}
+
+		results[index].Error = aws.ToString(reason.Code)
+
+		if *reason.Code == "ConditionalCheckFailed" {
+			results[index].Error = conditionMessage(results[index].Op)
+		}
+	}
+}
+
+func conditionMessage(op string) string {
+	switch op {
+	case OpAdd:
+		return "option already exists"
+	case OpEdit:
+		return ErrEditConflict.Error()
+	default:
+		return "option not found"
+	}
+}
+
+func transactItem(op Operation, added *Option, userID string, roomID string) *types.TransactWriteItem {
+	key := map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+		"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM_OPTION#%s", op.OptionID)},
+	}
+
+	switch op.Op {
+	case OpAdd:
+		item, err := attributevalue.MarshalMap(added)
+
+		if err != nil {
+			panic(err)
+		}
+
+		return &types.TransactWriteItem{
+			Put: &types.Put{
+				TableName:           aws.String(os.Getenv("table")),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_not_exists(PK) and attribute_not_exists(SK)"),
+			},
+		}
+	case OpDelete:
+		return &types.TransactWriteItem{
+			Update: deleteUpdate(op.OptionID, userID, roomID, time.Now()),
+		}
+	case OpEdit:
+		return &types.TransactWriteItem{
+			Update: editUpdate(op.OptionID, userID, roomID, *op.Edit),
+		}
+	default:
+		return &types.TransactWriteItem{
+			Update: &types.Update{
+				TableName:        aws.String(os.Getenv("table")),
+				Key:              key,
+				UpdateExpression: aws.String(clearUpdate),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":userID": &types.AttributeValueMemberS{Value: userID},
+					":null":   &types.AttributeValueMemberNULL{Value: true},
+				},
+				ConditionExpression: aws.String("ownedByID = :userID and attribute_exists(PK) and attribute_exists(SK)"),
+			},
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package option
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+type Price struct {
+	// Amount is in the currency's minor unit, e.g. cents
+	Amount   int64  `json:"amount" dynamodbav:"amount" binding:"min=0"`
+	Currency string `json:"currency" dynamodbav:"currency" binding:"required,len=3,alpha,uppercase"`
+}
+
+// Details are the optional structured fields on an option
+type Details struct {
+	Location string `json:"location,omitempty" dynamodbav:"location,omitempty" binding:"max=500"`
+	URL      string `json:"url,omitempty" dynamodbav:"url,omitempty" binding:"omitempty,url,startswith=http,max=2000"`
+	Image    string `json:"image,omitempty" dynamodbav:"image,omitempty" binding:"omitempty,url,startswith=http,max=2000"`
+	Price    *Price `json:"price,omitempty" dynamodbav:"price,omitempty"`
+	Notes    string `json:"notes,omitempty" dynamodbav:"notes,omitempty" binding:"max=1500"`
+}
+
+// detailsUpdate sets the fields that have a value and removes the rest
+func detailsUpdate(details Details, names map[string]string, values map[string]types.AttributeValue) ([]string, []string) {
+	var updates []string
+	var removes []string
+
+	// location and url are reserved words
+	names["#location"] = "location"
+	names["#url"] = "url"
+
+	fields := []struct {
+		name  string
+		value string
+	}{
+		{"#location", details.Location},
+		{"#url", details.URL},
+		{"image", details.Image},
+		{"notes", details.Notes},
+	}
+
+	for _, field := range fields {
+		if field.value == "" {
+			removes = append(removes, field.name)
+			continue
+		}
+
+		placeholder := fmt.Sprintf(":%s", strings.TrimPrefix(field.name, "#"))
+		updates = append(updates, fmt.Sprintf("%s = %s", field.name, placeholder))
+		values[placeholder] = &types.AttributeValueMemberS{Value: field.value}
+	}
+
+	if details.Price == nil {
+		removes = append(removes, "price")
+	} else {
+		price, err := attributevalue.Marshal(details.Price)
+
+		if err != nil {
+			panic(err)
+		}
+
+		updates = append(updates, "price = :price")
+		values[":price"] = price
+	}
+
+	return updates, removes
+}
+
+// Filter is bound from the query string, empty fields match everything
+type Filter struct {
+	Query    string `form:"q"`
+	Location string `form:"location"`
+	Currency string `form:"currency"`
+	MinPrice *int64 `form:"minPrice"`
+	MaxPrice *int64 `form:"maxPrice"`
+}
+
+func (filter Filter) matches(value string, details Details) bool {
+	if filter.Query != "" && !containsFold(value, filter.Query) && !containsFold(details.Notes, filter.Query) {
+		return false
+	}
+
+	if filter.Location != "" && !containsFold(details.Location, filter.Location) {
+		return false
+	}
+
+	if filter.Currency == "" && filter.MinPrice == nil && filter.MaxPrice == nil {
+		return true
+	}
+
+	if details.Price == nil {
+		return false
+	}
+
+	if filter.Currency != "" && !strings.EqualFold(details.Price.Currency, filter.Currency) {
+		return false
+	}
+
+	if filter.MinPrice != nil && details.Price.Amount < *filter.MinPrice {
+		return false
+	}
+
+	if filter.MaxPrice != nil && details.Price.Amount > *filter.MaxPrice {
+		return false
+	}
+
+	return true
+}
+
+func (filter Filter) Options(options []Option) []Option {
+	out := []Option{}
+
+	for _, opt := range options {
+		if filter.matches(opt.Value, opt.Details) {
+			out = append(out, opt)
+		}
+	}
+
+	return out
+}
+
+func (filter Filter) PublicOptions(options []PublicOption) []PublicOption {
+	out := []PublicOption{}
+
+	for _, opt := range options {
+		if filter.matches(opt.Value, opt.Details) {
+			out = append(out, opt)
+		}
+	}
+
+	return out
+}
+
+func containsFold(s string, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
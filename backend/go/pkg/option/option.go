@@ -2,10 +2,17 @@ package option
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"picker/backend/go/pkg/dynamodbTypes"
+	"picker/backend/go/pkg/grid"
+	"picker/backend/go/pkg/seatmap"
+	"picker/backend/go/pkg/slot"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
@@ -14,14 +21,53 @@ import (
 	"github.com/twinj/uuid"
 )
 
+// MaxPerRoom is the most options a room can have
+const MaxPerRoom = 199
+
+const maxBatchAttempts = 5
+
+// MaxMoves is the most options one reorder can move, they are all moved in one transaction and TransactWriteItems does a max of 100 items
+const MaxMoves = 100
+
+var ErrTooManyOptions = fmt.Errorf("a room can have at most %d options", MaxPerRoom)
+var ErrTooManyMoves = fmt.Errorf("a reorder can move at most %d options, move them in smaller steps", MaxMoves)
+
 type SelectOptionRequest struct {
 	Name string `json:"name" binding:"required,min=1,max=1500"`
 }
 
+type SelectOptionsRequest struct {
+	// TransactWriteItems does a max of 100 items, a matrix room adds a guard for each row
+	OptionIDs []string `json:"optionIDs" binding:"required,gt=0,lte=25,unique,dive,required"`
+	Name      string   `json:"name" binding:"required,min=1,max=1500"`
+}
+
 type CreateOptionRequest struct {
-	Option string `json:"option" binding:"required,min=1,max=1500"`
+	Option      string     `json:"option" binding:"required_without=Slots,omitempty,min=1,max=1500"`
+	Description string     `json:"description" binding:"max=5000"`
+	Slots       *slot.Spec `json:"slots"`
+	Details
+}
+
+// EditOptionRequest only changes the fields that are sent
+type EditOptionRequest struct {
+	// Version is the version the edit was made against, it fails if someone else has edited the option since
+	Version     *int    `json:"version" binding:"required,min=0"`
+	Value       *string `json:"value" binding:"omitempty,min=1,max=1500"`
+	Description *string `json:"description" binding:"omitempty,max=5000"`
+	// NotifySelector flags the change to whoever has picked the option
+	NotifySelector bool       `json:"notifySelector"`
+	Disabled       *bool      `json:"disabled"`
+	Hidden         *bool      `json:"hidden"`
+	RevealAt       *time.Time `json:"revealAt"`
+	// Details replaces all of the option's details
+	Details *Details `json:"details"`
 }
 
+var ErrEditConflict = errors.New("the option has been changed since it was loaded")
+var ErrNotFound = errors.New("option not found")
+var ErrNotOwner = errors.New("the option belongs to someone else")
+
 type Option struct {
 	// DynamoDB
 	PK   string `dynamodbav:"PK" json:"-"`
@@ -29,50 +75,135 @@ type Option struct {
 	Type string `dynamodbav:"type" json:"-"`
 
 	// Public
-	ID             string  `json:"id" dynamodbav:"id"`
-	RoomID         string  `json:"roomID" dynamodbav:"roomID"`
-	Value          string  `json:"value" dynamodbav:"value"`
-	Available      bool    `dynamodbav:"-" json:"available"`
-	SelectedByName *string `dynamodbav:"selectedByName,omitEmpty" json:"selectedByName,omitempty"`
+	ID             string     `json:"id" dynamodbav:"id"`
+	RoomID         string     `json:"roomID" dynamodbav:"roomID"`
+	Value          string     `json:"value" dynamodbav:"value"`
+	Description    string     `json:"description,omitempty" dynamodbav:"description,omitempty"`
+	Version        int        `json:"version" dynamodbav:"version"`
+	Position       int        `json:"position" dynamodbav:"position"`
+	Available      bool       `dynamodbav:"-" json:"available"`
+	SelectedByName *string    `dynamodbav:"selectedByName,omitEmpty" json:"selectedByName,omitempty"`
+	StartsAt       *time.Time `dynamodbav:"startsAt,omitempty" json:"startsAt,omitempty"`
+	EndsAt         *time.Time `dynamodbav:"endsAt,omitempty" json:"endsAt,omitempty"`
+	Row            *int       `dynamodbav:"row,omitempty" json:"row,omitempty"`
+	Column         *int       `dynamodbav:"column,omitempty" json:"column,omitempty"`
+	Details
 
 	// Private
-	SelectedByID *string `dynamodbav:"selectedByID,omitEmpty" json:"-"`
-	OwnedByID    string  `dynamodbav:"ownedByID" json:"-"`
+	SelectedByID         *string `dynamodbav:"selectedByID,omitEmpty" json:"-"`
+	SelectionGroup       *string `dynamodbav:"selectionGroup,omitempty" json:"-"`
+	OwnedByID            string  `dynamodbav:"ownedByID" json:"-"`
+	ChangedSinceSelected bool    `dynamodbav:"changedSinceSelected,omitempty" json:"-"`
+	// LabelDayStart is the first slot time of the day the slot's label was generated for, the label only shows the zone when the slot's offset differs from it
+	LabelDayStart *time.Time `dynamodbav:"labelDayStart,omitempty" json:"-"`
+
+	// Owner
+	Disabled bool `dynamodbav:"disabled,omitempty" json:"disabled,omitempty"`
+	Hidden   bool `dynamodbav:"hidden,omitempty" json:"hidden,omitempty"`
+	// RevealAt shows a hidden option from this time, it is stored to the second so it can be compared as a string
+	RevealAt *time.Time `dynamodbav:"revealAt,omitempty" json:"revealAt,omitempty"`
+	// DeletedAt is set while the option is tombstoned, it can be restored until ExpiresAt
+	DeletedAt *time.Time `dynamodbav:"deletedAt,omitempty" json:"deletedAt,omitempty"`
+	ExpiresAt int64      `dynamodbav:"expiresAt,omitempty" json:"-"`
 }
 
 type PublicOption struct {
 	ID             string  `json:"id"`
 	RoomID         string  `json:"roomID"`
 	Value          string  `json:"value"`
+	Description    string  `json:"description,omitempty"`
+	Position       int     `json:"position"`
 	Available      bool    `json:"available"`
 	SelectedByMeAs *string `json:"selectedByMeAs,omitempty"`
+	// ChangedSinceSelected is only shown to whoever picked the option
+	ChangedSinceSelected bool       `json:"changedSinceSelected,omitempty"`
+	StartsAt             *time.Time `json:"startsAt,omitempty"`
+	EndsAt               *time.Time `json:"endsAt,omitempty"`
+	Row                  *int       `json:"row,omitempty"`
+	Column               *int       `json:"column,omitempty"`
+	Disabled             bool       `json:"disabled,omitempty"`
+	Details
 }
 
 func (option Option) getPublic(userID string) PublicOption {
 	var selectedByMeAs *string
+	changedSinceSelected := false
 	if option.SelectedByID != nil && userID == *option.SelectedByID {
 		selectedByMeAs = option.SelectedByName
+		changedSinceSelected = option.ChangedSinceSelected
 	}
 
 	return PublicOption{
 		ID:             option.ID,
 		RoomID:         option.RoomID,
 		Value:          option.Value,
+		Description:    option.Description,
+		Position:       option.Position,
 		Available:      option.Available,
 		SelectedByMeAs: selectedByMeAs,
+
+		ChangedSinceSelected: changedSinceSelected,
+		StartsAt:             option.StartsAt,
+		EndsAt:               option.EndsAt,
+		Row:                  option.Row,
+		Column:               option.Column,
+		Disabled:             option.Disabled,
+		Details:              option.Details,
 	}
 }
 
-func MapToPublic(options []Option, userID string) []PublicOption {
-	out := make([]PublicOption, len(options))
+// Visible is false for hidden options until they are revealed
+func (option Option) Visible(now time.Time) bool {
+	return !option.Hidden || (option.RevealAt != nil && !now.Before(*option.RevealAt))
+}
+
+// MapToPublic leaves out deleted options, and hidden options unless canSeeHidden
+func MapToPublic(options []Option, userID string, canSeeHidden bool) []PublicOption {
+	now := time.Now()
+	out := make([]PublicOption, 0, len(options))
+
+	for _, opt := range options {
+		if opt.DeletedAt != nil {
+			continue
+		}
+
+		if !opt.Visible(now) && !canSeeHidden {
+			continue
+		}
 
-	for i, opt := range options {
-		out[i] = opt.getPublic(userID)
+		out = append(out, opt.getPublic(userID))
 	}
 
 	return out
 }
 
+// Selected options are listed under the selector in GSI1, so their picks can follow them to another user ID.
+// Options picked together share a selectionGroup so a seat map group can be released together.
+const (
+	selectUpdate      = "set selectedByID = :userID, selectedByName = :name, GSI1PK = :selector, GSI1SK = :selection remove changedSinceSelected, selectionGroup"
+	groupSelectUpdate = "set selectedByID = :userID, selectedByName = :name, GSI1PK = :selector, GSI1SK = :selection, selectionGroup = :group remove changedSinceSelected"
+	clearUpdate       = "set selectedByID = :null, selectedByName = :null remove changedSinceSelected, selectionGroup, GSI1PK, GSI1SK"
+)
+
+// selectCondition only lets an option be picked while it is free, enabled and visible
+const selectCondition = "(attribute_not_exists(selectedByID) or selectedByID = :null) and " +
+	"(attribute_not_exists(disabled) or disabled = :false) and " +
+	"(attribute_not_exists(hidden) or hidden = :false or revealAt <= :now) and " +
+	"attribute_not_exists(deletedAt) and attribute_exists(PK) and attribute_exists(SK)"
+
+func selectValues(userID string, name string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		":userID": &types.AttributeValueMemberS{Value: userID},
+		":name":   &types.AttributeValueMemberS{Value: name},
+		":null":   &types.AttributeValueMemberNULL{Value: true},
+		":false":  &types.AttributeValueMemberBOOL{Value: false},
+		":now":    &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
+		// GSI1 keys don't have to be unique, the time only orders a user's picks
+		":selector":  &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", userID)},
+		":selection": &types.AttributeValueMemberS{Value: fmt.Sprintf("SELECTION#%s", time.Now().UTC().Format(time.RFC3339))},
+	}
+}
+
 func SelectOption(optionID string, userID string, roomID string, selectOptionRequest SelectOptionRequest, client *dynamodb.Client) (*PublicOption, error) {
 	res, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
 		TableName: aws.String(os.Getenv("table")),
@@ -80,14 +211,10 @@ func SelectOption(optionID string, userID string, roomID string, selectOptionReq
 			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
 			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM_OPTION#%s", optionID)},
 		},
-		UpdateExpression: aws.String("set selectedByID = :userID, selectedByName = :name"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":userID": &types.AttributeValueMemberS{Value: userID},
-			":name":   &types.AttributeValueMemberS{Value: selectOptionRequest.Name},
-			":null":   &types.AttributeValueMemberNULL{Value: true},
-		},
-		ConditionExpression: aws.String("(attribute_not_exists(selectedByID) or selectedByID = :null) and attribute_exists(PK) and attribute_exists(SK)"),
-		ReturnValues:        types.ReturnValueAllNew,
+		UpdateExpression:          aws.String(selectUpdate),
+		ExpressionAttributeValues: selectValues(userID, selectOptionRequest.Name),
+		ConditionExpression:       aws.String(selectCondition),
+		ReturnValues:              types.ReturnValueAllNew,
 	})
 
 	if err != nil {
@@ -99,52 +226,463 @@ func SelectOption(optionID string, userID string, roomID string, selectOptionReq
 	return &updatedOption, nil
 }
 
+// SelectOptions picks every option or none of them, guards are written in the same transaction
+func SelectOptions(options []Option, userID string, request SelectOptionsRequest, guards []types.TransactWriteItem, client *dynamodb.Client) ([]PublicOption, error) {
+	items := guards
+	group := uuid.NewV4().String()
+
+	for _, opt := range options {
+		values := selectValues(userID, request.Name)
+		values[":group"] = &types.AttributeValueMemberS{Value: group}
+
+		items = append(items, types.TransactWriteItem{
+			Update: &types.Update{
+				TableName: aws.String(os.Getenv("table")),
+				Key: map[string]types.AttributeValue{
+					"PK": &types.AttributeValueMemberS{Value: opt.PK},
+					"SK": &types.AttributeValueMemberS{Value: opt.SK},
+				},
+				UpdateExpression:          aws.String(groupSelectUpdate),
+				ExpressionAttributeValues: values,
+				ConditionExpression:       aws.String(selectCondition),
+			},
+		})
+	}
+
+	_, err := client.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// TransactWriteItems doesn't return the new values
+	for i := range options {
+		options[i].SelectedByID = &userID
+		options[i].SelectedByName = &request.Name
+		options[i].SelectionGroup = &group
+		options[i].Available = false
+	}
+
+	// Only visible options can be picked
+	return MapToPublic(options, userID, true), nil
+}
+
+// UnselectOptions releases every option or none of them, for a group that was picked together
+func UnselectOptions(options []Option, userID string, client *dynamodb.Client) ([]PublicOption, error) {
+	if len(options) == 0 {
+		return []PublicOption{}, nil
+	}
+
+	items := []types.TransactWriteItem{roomNotDeleted(strings.TrimPrefix(options[0].PK, "ROOM#"))}
+
+	for _, opt := range options {
+		items = append(items, types.TransactWriteItem{
+			Update: &types.Update{
+				TableName: aws.String(os.Getenv("table")),
+				Key: map[string]types.AttributeValue{
+					"PK": &types.AttributeValueMemberS{Value: opt.PK},
+					"SK": &types.AttributeValueMemberS{Value: opt.SK},
+				},
+				UpdateExpression: aws.String(clearUpdate),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":userID": &types.AttributeValueMemberS{Value: userID},
+					":null":   &types.AttributeValueMemberNULL{Value: true},
+				},
+				ConditionExpression: aws.String("selectedByID = :userID and attribute_exists(PK) and attribute_exists(SK)"),
+			},
+		})
+	}
+
+	_, err := client.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range options {
+		options[i].SelectedByID = nil
+		options[i].SelectedByName = nil
+		options[i].SelectionGroup = nil
+		options[i].ChangedSinceSelected = false
+		options[i].Available = !options[i].Disabled
+	}
+
+	// They were the user's own picks, even if they have been hidden since
+	return MapToPublic(options, userID, true), nil
+}
+
 func UnselectOption(optionID string, userID string, roomID string, client *dynamodb.Client) (*PublicOption, error) {
+	_, err := client.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{roomNotDeleted(roomID), {
+			Update: &types.Update{
+				TableName:        aws.String(os.Getenv("table")),
+				Key:              optionKey(optionID, roomID),
+				UpdateExpression: aws.String(clearUpdate),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":userID": &types.AttributeValueMemberS{Value: userID},
+					":null":   &types.AttributeValueMemberNULL{Value: true},
+				},
+				ConditionExpression: aws.String("selectedByID = :userID and attribute_exists(PK) and attribute_exists(SK)"),
+			},
+		}},
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// TransactWriteItems doesn't return the new values
+	updated, err := get(optionID, roomID, client)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if updated == nil {
+		return nil, ErrNotFound
+	}
+
+	updatedOption := updated.getPublic(userID)
+
+	return &updatedOption, nil
+}
+
+// roomNotDeleted fails a transaction once the room has been deleted, its options only get its expiry
+func roomNotDeleted(roomID string) types.TransactWriteItem {
+	return types.TransactWriteItem{
+		ConditionCheck: &types.ConditionCheck{
+			TableName: aws.String(os.Getenv("table")),
+			Key: map[string]types.AttributeValue{
+				"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+				"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+			},
+			ConditionExpression: aws.String("attribute_exists(PK) and attribute_not_exists(deletedAt)"),
+		},
+	}
+}
+
+func optionKey(optionID string, roomID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+		"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM_OPTION#%s", optionID)},
+	}
+}
+
+// get reads one option as it is now
+func get(optionID string, roomID string, client *dynamodb.Client) (*Option, error) {
+	res, err := client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName:      aws.String(os.Getenv("table")),
+		ConsistentRead: aws.Bool(true),
+		Key:            optionKey(optionID, roomID),
+	})
+
+	if err != nil || res.Item == nil {
+		return nil, err
+	}
+
+	opt := Unmarshal(res.Item)
+
+	return &opt, nil
+}
+
+func Edit(optionID string, userID string, roomID string, request EditOptionRequest, client *dynamodb.Client) (*Option, error) {
+	update := editUpdate(optionID, userID, roomID, request)
+
 	res, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:                 update.TableName,
+		Key:                       update.Key,
+		UpdateExpression:          update.UpdateExpression,
+		ExpressionAttributeNames:  update.ExpressionAttributeNames,
+		ExpressionAttributeValues: update.ExpressionAttributeValues,
+		ConditionExpression:       update.ConditionExpression,
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return nil, editFailure(optionID, userID, roomID, client)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	updatedOption := Unmarshal(res.Attributes)
+
+	return &updatedOption, nil
+}
+
+// editFailure reads the option again to tell which part of an edit's condition failed
+func editFailure(optionID string, userID string, roomID string, client *dynamodb.Client) error {
+	opt, err := get(optionID, roomID, client)
+
+	if err != nil {
+		return err
+	}
+
+	if opt == nil {
+		return ErrNotFound
+	}
+
+	if opt.OwnedByID != userID {
+		return ErrNotOwner
+	}
+
+	return ErrEditConflict
+}
+
+// editUpdate builds the update for an edit so it can be used on its own or in a transaction
+func editUpdate(optionID string, userID string, roomID string, request EditOptionRequest) *types.Update {
+	version := *request.Version
+
+	updates := []string{"version = :nextVersion"}
+	values := map[string]types.AttributeValue{
+		":userID":      &types.AttributeValueMemberS{Value: userID},
+		":version":     &types.AttributeValueMemberN{Value: fmt.Sprint(version)},
+		":nextVersion": &types.AttributeValueMemberN{Value: fmt.Sprint(version + 1)},
+	}
+
+	// Only the names that are used can be sent
+	names := map[string]string{}
+
+	if request.Value != nil {
+		// value is a reserved word
+		names["#value"] = "value"
+		updates = append(updates, "#value = :value")
+		values[":value"] = &types.AttributeValueMemberS{Value: *request.Value}
+	}
+
+	if request.Description != nil {
+		updates = append(updates, "description = :description")
+		values[":description"] = &types.AttributeValueMemberS{Value: *request.Description}
+	}
+
+	if request.Disabled != nil {
+		updates = append(updates, "disabled = :disabled")
+		values[":disabled"] = &types.AttributeValueMemberBOOL{Value: *request.Disabled}
+	}
+
+	if request.Hidden != nil {
+		updates = append(updates, "hidden = :hidden")
+		values[":hidden"] = &types.AttributeValueMemberBOOL{Value: *request.Hidden}
+	}
+
+	if request.RevealAt != nil {
+		updates = append(updates, "revealAt = :revealAt")
+		values[":revealAt"] = &types.AttributeValueMemberS{Value: request.RevealAt.UTC().Format(time.RFC3339)}
+	}
+
+	var removes []string
+
+	if request.Details != nil {
+		detailUpdates, detailRemoves := detailsUpdate(*request.Details, names, values)
+		updates = append(updates, detailUpdates...)
+		removes = append(removes, detailRemoves...)
+	}
+
+	if request.NotifySelector {
+		updates = append(updates, "changedSinceSelected = :true")
+		values[":true"] = &types.AttributeValueMemberBOOL{Value: true}
+	}
+
+	if len(names) == 0 {
+		names = nil
+	}
+
+	// Options created before versioning don't have one
+	versionCondition := "version = :version"
+	if version == 0 {
+		versionCondition = "(attribute_not_exists(version) or version = :version)"
+	}
+
+	return &types.Update{
 		TableName: aws.String(os.Getenv("table")),
 		Key: map[string]types.AttributeValue{
 			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
 			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM_OPTION#%s", optionID)},
 		},
-		UpdateExpression: aws.String("set selectedByID = :null, selectedByName = :null"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":userID": &types.AttributeValueMemberS{Value: userID},
-			":null":   &types.AttributeValueMemberNULL{Value: true},
-		},
-		ConditionExpression: aws.String("selectedByID = :userID and attribute_exists(PK) and attribute_exists(SK)"),
-		ReturnValues:        types.ReturnValueAllNew,
+		UpdateExpression:          aws.String(updateExpression(updates, removes)),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		ConditionExpression:       aws.String(fmt.Sprintf("ownedByID = :userID and %s and attribute_exists(PK) and attribute_exists(SK)", versionCondition)),
+	}
+}
+
+func updateExpression(updates []string, removes []string) string {
+	expression := fmt.Sprintf("set %s", strings.Join(updates, ", "))
+
+	if len(removes) > 0 {
+		expression = fmt.Sprintf("%s remove %s", expression, strings.Join(removes, ", "))
+	}
+
+	return expression
+}
+
+// Delete tombstones the option, it keeps its selection and can be restored until it expires
+func Delete(optionID string, userID string, roomID string, client *dynamodb.Client) (*Option, error) {
+	update := deleteUpdate(optionID, userID, roomID, time.Now())
+
+	res, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:                 update.TableName,
+		Key:                       update.Key,
+		UpdateExpression:          update.UpdateExpression,
+		ExpressionAttributeValues: update.ExpressionAttributeValues,
+		ConditionExpression:       update.ConditionExpression,
+		ReturnValues:              types.ReturnValueAllNew,
 	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	updatedOption := Unmarshal(res.Attributes).getPublic(userID)
+	updatedOption := Unmarshal(res.Attributes)
 
 	return &updatedOption, nil
 }
 
-func Delete(optionID string, userID string, roomID string, client *dynamodb.Client) (*Option, error) {
-	res, err := client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+func deleteUpdate(optionID string, userID string, roomID string, now time.Time) *types.Update {
+	return &types.Update{
 		TableName: aws.String(os.Getenv("table")),
 		Key: map[string]types.AttributeValue{
 			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
 			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM_OPTION#%s", optionID)},
 		},
+		UpdateExpression: aws.String("set deletedAt = :now, expiresAt = :expiresAt"),
 		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":userID": &types.AttributeValueMemberS{Value: userID},
+			":userID":    &types.AttributeValueMemberS{Value: userID},
+			":now":       &types.AttributeValueMemberS{Value: now.UTC().Format(time.RFC3339)},
+			":expiresAt": &types.AttributeValueMemberN{Value: fmt.Sprint(dynamodbTypes.ExpiresAt(now))},
 		},
-		ConditionExpression: aws.String("ownedByID = :userID"),
-		ReturnValues:        types.ReturnValueAllOld,
+		ConditionExpression: aws.String("ownedByID = :userID and attribute_exists(PK) and attribute_exists(SK) and attribute_not_exists(deletedAt)"),
+	}
+}
+
+// Restore brings back a deleted option along with its selection
+//
+// It fails once the room has been deleted, the option would otherwise lose the room's expiry and outlive it
+func Restore(optionID string, userID string, roomID string, client *dynamodb.Client) (*Option, error) {
+	_, err := client.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{roomNotDeleted(roomID), {
+			Update: &types.Update{
+				TableName:        aws.String(os.Getenv("table")),
+				Key:              optionKey(optionID, roomID),
+				UpdateExpression: aws.String("remove deletedAt, expiresAt"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":userID": &types.AttributeValueMemberS{Value: userID},
+					":now":    &types.AttributeValueMemberN{Value: fmt.Sprint(time.Now().Unix())},
+				},
+				// The TTL doesn't remove items straight away
+				ConditionExpression: aws.String("ownedByID = :userID and attribute_exists(deletedAt) and expiresAt > :now"),
+			},
+		}},
 	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	updatedOption := Unmarshal(res.Attributes)
+	updatedOption, err := get(optionID, roomID, client)
 
-	return &updatedOption, nil
+	if err == nil && updatedOption == nil {
+		err = ErrNotFound
+	}
+
+	return updatedOption, err
+}
+
+// ReassignSelections moves fromID's picks over to toID, picks made before selections were listed in GSI1 stay behind
+func ReassignSelections(fromID string, toID string, client *dynamodb.Client) error {
+	paginator := dynamodb.NewQueryPaginator(client, &dynamodb.QueryInput{
+		TableName:              aws.String(os.Getenv("table")),
+		IndexName:              aws.String("GSI1"),
+		KeyConditionExpression: aws.String("GSI1PK = :GSI1PK and begins_with(GSI1SK, :selection)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":GSI1PK":    &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", fromID)},
+			":selection": &types.AttributeValueMemberS{Value: "SELECTION#"},
+		},
+	})
+
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(context.TODO())
+
+		if err != nil {
+			return err
+		}
+
+		for _, item := range out.Items {
+			_, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+				TableName: aws.String(os.Getenv("table")),
+				Key: map[string]types.AttributeValue{
+					"PK": item["PK"],
+					"SK": item["SK"],
+				},
+				UpdateExpression: aws.String("set selectedByID = :to, GSI1PK = :selector"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":from":     &types.AttributeValueMemberS{Value: fromID},
+					":to":       &types.AttributeValueMemberS{Value: toID},
+					":selector": &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", toID)},
+				},
+				ConditionExpression: aws.String("selectedByID = :from"),
+			})
+
+			// Unselected since the index was read
+			var conditionErr *types.ConditionalCheckFailedException
+			if err != nil && !errors.As(err, &conditionErr) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ClearSelections unselects every option in the room a page at a time, it is safe to retry
+func ClearSelections(roomID string, client *dynamodb.Client) (int, error) {
+	paginator := dynamodb.NewQueryPaginator(client, &dynamodb.QueryInput{
+		TableName:              aws.String(os.Getenv("table")),
+		KeyConditionExpression: aws.String("PK = :PK and begins_with(SK, :option)"),
+		FilterExpression:       aws.String("attribute_exists(selectedByID) and selectedByID <> :null"),
+		ProjectionExpression:   aws.String("PK, SK"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":PK":     &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+			":option": &types.AttributeValueMemberS{Value: "ROOM_OPTION#"},
+			":null":   &types.AttributeValueMemberNULL{Value: true},
+		},
+	})
+
+	cleared := 0
+
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(context.TODO())
+
+		if err != nil {
+			return cleared, err
+		}
+
+		for _, key := range out.Items {
+			_, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+				TableName:        aws.String(os.Getenv("table")),
+				Key:              key,
+				UpdateExpression: aws.String(clearUpdate),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":null": &types.AttributeValueMemberNULL{Value: true},
+				},
+				ConditionExpression: aws.String("attribute_exists(PK) and attribute_exists(SK)"),
+			})
+
+			if err != nil {
+				return cleared, err
+			}
+
+			cleared++
+		}
+	}
+
+	return cleared, nil
 }
 
 func NewOption(option string, userID string, roomID string) Option {
@@ -166,9 +704,148 @@ func NewOption(option string, userID string, roomID string) Option {
 	}
 }
 
-func batchWriteOptionChunk(chunk []*Option, client *dynamodb.Client, wg *sync.WaitGroup) {
-	defer wg.Done()
+// Copy makes a fresh, unselected option in roomID with the same content and settings as opt
+func Copy(opt Option, userID string, roomID string) Option {
+	copied := NewOption(opt.Value, userID, roomID)
+
+	copied.Description = opt.Description
+	copied.Position = opt.Position
+	copied.StartsAt = opt.StartsAt
+	copied.EndsAt = opt.EndsAt
+	copied.LabelDayStart = opt.LabelDayStart
+	copied.Row = opt.Row
+	copied.Column = opt.Column
+	copied.Details = opt.Details
+	copied.Disabled = opt.Disabled
+	copied.Hidden = opt.Hidden
+	copied.RevealAt = opt.RevealAt
+
+	return copied
+}
+
+// NewOptions creates the options for a request, expanding any slot spec
+func NewOptions(request CreateOptionRequest, userID string, roomID string) ([]*Option, error) {
+	if request.Slots == nil {
+		opt := NewOption(request.Option, userID, roomID)
+		opt.Description = request.Description
+		opt.Details = request.Details
+
+		return []*Option{&opt}, nil
+	}
+
+	if request.Option != "" || request.Description != "" {
+		return nil, errors.New("send either an option or slots, not both")
+	}
+
+	return NewSlotOptions(*request.Slots, userID, roomID)
+}
+
+func NewSlotOptions(spec slot.Spec, userID string, roomID string) ([]*Option, error) {
+	slots, err := spec.Generate()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var options []*Option
+	for _, s := range slots {
+		start, end, dayStart := s.Start, s.End, s.DayStart
+
+		opt := NewOption(s.Label, userID, roomID)
+		opt.StartsAt = &start
+		opt.EndsAt = &end
+		opt.LabelDayStart = &dayStart
+
+		options = append(options, &opt)
+	}
+
+	return options, nil
+}
+
+func NewGridOptions(cells []grid.Cell, userID string, roomID string) []*Option {
+	var options []*Option
+	for _, cell := range cells {
+		row, column := cell.Row, cell.Column
+
+		opt := NewOption(cell.Label, userID, roomID)
+		opt.Row = &row
+		opt.Column = &column
+
+		options = append(options, &opt)
+	}
+
+	return options
+}
+
+func NewSeatOptions(seats []seatmap.Cell, userID string, roomID string) []*Option {
+	var options []*Option
+	for _, seat := range seats {
+		row, column := seat.Row, seat.Column
+
+		opt := NewOption(seat.Label, userID, roomID)
+		opt.Row = &row
+		opt.Column = &column
+
+		options = append(options, &opt)
+	}
+
+	return options
+}
+
+// Sort by position, options created before ordering all have position 0 so fall back to their value
+func Sort(options []Option) {
+	sort.SliceStable(options, func(i, j int) bool {
+		a, b := options[i], options[j]
 
+		if a.Position != b.Position {
+			return a.Position < b.Position
+		}
+
+		if a.Value != b.Value {
+			return a.Value < b.Value
+		}
+
+		return a.ID < b.ID
+	})
+}
+
+// SetPositions moves every option or none of them, so a reorder can't be left half done
+func SetPositions(options []Option, client *dynamodb.Client) error {
+	if len(options) > MaxMoves {
+		return ErrTooManyMoves
+	}
+
+	var items []types.TransactWriteItem
+
+	for _, opt := range options {
+		items = append(items, types.TransactWriteItem{
+			Update: &types.Update{
+				TableName: aws.String(os.Getenv("table")),
+				Key: map[string]types.AttributeValue{
+					"PK": &types.AttributeValueMemberS{Value: opt.PK},
+					"SK": &types.AttributeValueMemberS{Value: opt.SK},
+				},
+				UpdateExpression: aws.String("set #position = :position"),
+				// position is a reserved word
+				ExpressionAttributeNames: map[string]string{
+					"#position": "position",
+				},
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":position": &types.AttributeValueMemberN{Value: fmt.Sprint(opt.Position)},
+				},
+				ConditionExpression: aws.String("attribute_exists(PK) and attribute_exists(SK)"),
+			},
+		})
+	}
+
+	_, err := client.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+
+	return err
+}
+
+func batchWriteOptionChunk(chunk []*Option, client *dynamodb.Client) error {
 	var items []types.WriteRequest
 
 	for _, option := range chunk {
@@ -191,10 +868,25 @@ func batchWriteOptionChunk(chunk []*Option, client *dynamodb.Client, wg *sync.Wa
 		},
 	}
 
-	_, err := client.BatchWriteItem(context.TODO(), request)
+	// Throttled items come back as unprocessed, retry them a few times with a backoff
+	for attempt := 0; ; attempt++ {
+		res, err := client.BatchWriteItem(context.TODO(), request)
 
-	if err != nil {
-		panic(err)
+		if err != nil {
+			return err
+		}
+
+		if len(res.UnprocessedItems) == 0 {
+			return nil
+		}
+
+		if attempt == maxBatchAttempts {
+			return fmt.Errorf("%d options could not be written", len(res.UnprocessedItems[os.Getenv("table")]))
+		}
+
+		time.Sleep(time.Duration(50<<attempt) * time.Millisecond)
+
+		request.RequestItems = res.UnprocessedItems
 	}
 }
 
@@ -203,16 +895,26 @@ func BatchWriteOptions(options []*Option, client *dynamodb.Client) error {
 	chunkedOptions := chunk(options, 25)
 
 	var wg sync.WaitGroup
+	errs := make([]error, len(chunkedOptions))
 
-	for _, chunk := range chunkedOptions {
+	for i, chunk := range chunkedOptions {
 		wg.Add(1)
 
 		// Process each chunk async
-		go batchWriteOptionChunk(chunk, client, &wg)
+		go func(i int, chunk []*Option) {
+			defer wg.Done()
+			errs[i] = batchWriteOptionChunk(chunk, client)
+		}(i, chunk)
 	}
 
 	wg.Wait()
 
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -240,7 +942,7 @@ func Unmarshal(item map[string]types.AttributeValue) Option {
 		panic(err)
 	}
 
-	option.Available = option.SelectedByID == nil
+	option.Available = option.SelectedByID == nil && !option.Disabled
 
 	return *option
 }
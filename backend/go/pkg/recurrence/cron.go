@@ -0,0 +1,167 @@
+package recurrence
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cron is a standard 5 field rule, "minute hour day-of-month month day-of-week"
+// each field supports *, lists (1,2), ranges (1-5) and steps (*/15, 1-30/5)
+type Cron struct {
+	minutes  map[int]bool
+	hours    map[int]bool
+	days     map[int]bool
+	months   map[int]bool
+	weekdays map[int]bool
+	// Like cron, when both day fields are restricted either one matching is enough
+	anyDay     bool
+	anyWeekday bool
+}
+
+var fieldRanges = [5][2]int{
+	{0, 59}, // minute
+	{0, 23}, // hour
+	{1, 31}, // day of month
+	{1, 12}, // month
+	{0, 6},  // day of week, Sunday is 0
+}
+
+func ParseCron(rule string) (*Cron, error) {
+	fields := strings.Fields(rule)
+
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron rule %q needs 5 fields", rule)
+	}
+
+	var sets [5]map[int]bool
+
+	for i, field := range fields {
+		set, err := parseField(field, fieldRanges[i][0], fieldRanges[i][1])
+
+		if err != nil {
+			return nil, fmt.Errorf("cron rule %q: %w", rule, err)
+		}
+
+		sets[i] = set
+	}
+
+	return &Cron{
+		minutes:    sets[0],
+		hours:      sets[1],
+		days:       sets[2],
+		months:     sets[3],
+		weekdays:   sets[4],
+		anyDay:     fields[2] == "*",
+		anyWeekday: fields[4] == "*",
+	}, nil
+}
+
+// Next is the first matching minute after t, in t's location
+func (cron Cron) Next(t time.Time) (time.Time, error) {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	// Searching minute by minute is simple, skipping whole days and hours keeps it quick
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if !cron.months[int(t.Month())] || !cron.dayMatches(t) {
+			t = advance(t, time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location()))
+			continue
+		}
+
+		if !cron.hours[t.Hour()] {
+			t = advance(t, time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location()))
+			continue
+		}
+
+		if !cron.minutes[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t, nil
+	}
+
+	return time.Time{}, fmt.Errorf("cron rule never matches")
+}
+
+// advance moves to the next wall clock boundary, a DST change can make that boundary land on or before t
+func advance(t time.Time, next time.Time) time.Time {
+	if !next.After(t) {
+		return t.Add(time.Minute)
+	}
+
+	return next
+}
+
+func (cron Cron) dayMatches(t time.Time) bool {
+	day := cron.days[t.Day()]
+	weekday := cron.weekdays[int(t.Weekday())]
+
+	switch {
+	case cron.anyDay && cron.anyWeekday:
+		return true
+	case cron.anyDay:
+		return weekday
+	case cron.anyWeekday:
+		return day
+	default:
+		return day || weekday
+	}
+}
+
+func parseField(field string, min int, max int) (map[int]bool, error) {
+	set := map[int]bool{}
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+
+		if i := strings.Index(part, "/"); i >= 0 {
+			parsed, err := strconv.Atoi(part[i+1:])
+
+			if err != nil || parsed < 1 {
+				return nil, fmt.Errorf("bad step in %q", part)
+			}
+
+			step = parsed
+			part = part[:i]
+		}
+
+		start, end := min, max
+
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+
+			parsed, err := strconv.Atoi(bounds[0])
+
+			if err != nil {
+				return nil, fmt.Errorf("bad value %q", part)
+			}
+
+			start, end = parsed, parsed
+
+			if len(bounds) == 2 {
+				end, err = strconv.Atoi(bounds[1])
+
+				if err != nil {
+					return nil, fmt.Errorf("bad range %q", part)
+				}
+			} else if step > 1 {
+				// 5/15 means from 5 to the end in steps of 15
+				end = max
+			}
+		}
+
+		if start < min || end > max || start > end {
+			return nil, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+
+		for v := start; v <= end; v += step {
+			set[v] = true
+		}
+	}
+
+	return set, nil
+}
@@ -0,0 +1,162 @@
+package recurrence
+
+import (
+	"errors"
+	"time"
+
+	// Lambda doesn't ship a zoneinfo database
+	_ "time/tzdata"
+)
+
+const (
+	FrequencyDaily  = "daily"
+	FrequencyWeekly = "weekly"
+	FrequencyCron   = "cron"
+)
+
+const (
+	// ModeReset clears the selections at the end of each cycle
+	ModeReset = "reset"
+	// ModeRegenerate also moves slot options forward to the next cycle
+	ModeRegenerate = "regenerate"
+)
+
+type Request struct {
+	Frequency string `json:"frequency" binding:"required,oneof=daily weekly cron"`
+	Cron      string `json:"cron" binding:"required_if=Frequency cron,max=100"`
+	Timezone  string `json:"timezone" binding:"required,timezone"`
+	// FirstRunAt is when the first cycle ends, daily and weekly rules repeat at the same wall clock time
+	FirstRunAt *time.Time `json:"firstRunAt" binding:"required_unless=Frequency cron"`
+	Mode       string     `json:"mode" binding:"required,oneof=reset regenerate"`
+	// Snapshot saves the results of each cycle before they are cleared
+	Snapshot bool `json:"snapshot"`
+}
+
+type Rule struct {
+	Frequency string    `json:"frequency" dynamodbav:"frequency"`
+	Cron      string    `json:"cron,omitempty" dynamodbav:"cron,omitempty"`
+	Timezone  string    `json:"timezone" dynamodbav:"timezone"`
+	Mode      string    `json:"mode" dynamodbav:"mode"`
+	Snapshot  bool      `json:"snapshot" dynamodbav:"snapshot"`
+	NextRunAt time.Time `json:"nextRunAt" dynamodbav:"nextRunAt"`
+}
+
+func (request Request) Rule(now time.Time) (*Rule, error) {
+	rule := &Rule{
+		Frequency: request.Frequency,
+		Cron:      request.Cron,
+		Timezone:  request.Timezone,
+		Mode:      request.Mode,
+		Snapshot:  request.Snapshot,
+	}
+
+	if rule.Frequency != FrequencyCron && request.FirstRunAt == nil {
+		return nil, errors.New("firstRunAt is needed for daily and weekly rules")
+	}
+
+	if rule.Frequency == FrequencyCron {
+		if _, err := ParseCron(rule.Cron); err != nil {
+			return nil, err
+		}
+	}
+
+	// A cron rule runs at its next match, the others are stepped on from the first run
+	from := now
+	if request.FirstRunAt != nil {
+		if request.FirstRunAt.After(now) {
+			rule.NextRunAt = request.FirstRunAt.UTC().Truncate(time.Second)
+
+			return rule, nil
+		}
+
+		from = *request.FirstRunAt
+	}
+
+	next, err := rule.after(from, now)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rule.NextRunAt = next
+
+	return rule, nil
+}
+
+// Following is the run after NextRunAt, cycles that were missed while nothing was running are skipped
+func (rule Rule) Following(now time.Time) (time.Time, error) {
+	return rule.after(rule.NextRunAt, now)
+}
+
+// Shift moves t forward by the same amount as from to to.
+//
+// When both runs are at the same wall clock time it moves by whole days in the rule's timezone,
+// so a 09:00 slot stays at 09:00 across a DST change.
+func (rule Rule) Shift(t time.Time, from time.Time, to time.Time) time.Time {
+	loc := rule.Location()
+	from, to = from.In(loc), to.In(loc)
+
+	if from.Hour() != to.Hour() || from.Minute() != to.Minute() || from.Second() != to.Second() {
+		return t.Add(to.Sub(from))
+	}
+
+	fromDay := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)
+	toDay := time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, time.UTC)
+	days := int(toDay.Sub(fromDay).Hours() / 24)
+
+	return t.In(loc).AddDate(0, 0, days).UTC()
+}
+
+// after steps on from from until it is past now
+func (rule Rule) after(from time.Time, now time.Time) (time.Time, error) {
+	loc := rule.Location()
+	next := from.In(loc)
+
+	var cron *Cron
+
+	if rule.Frequency == FrequencyCron {
+		parsed, err := ParseCron(rule.Cron)
+
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		cron = parsed
+	}
+
+	for !next.After(now) {
+		switch rule.Frequency {
+		case FrequencyDaily:
+			next = next.AddDate(0, 0, 1)
+		case FrequencyWeekly:
+			next = next.AddDate(0, 0, 7)
+		case FrequencyCron:
+			// Jump straight to now rather than stepping through every missed match
+			if next.Before(now) {
+				next = now.In(loc)
+			}
+
+			matched, err := cron.Next(next)
+
+			if err != nil {
+				return time.Time{}, err
+			}
+
+			next = matched
+		default:
+			return time.Time{}, errors.New("unknown frequency")
+		}
+	}
+
+	return next.UTC().Truncate(time.Second), nil
+}
+
+func (rule Rule) Location() *time.Location {
+	loc, err := time.LoadLocation(rule.Timezone)
+
+	if err != nil {
+		return time.UTC
+	}
+
+	return loc
+}
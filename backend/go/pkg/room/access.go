@@ -0,0 +1,276 @@
+package room
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"picker/backend/go/pkg/dynamodbTypes"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Failed unlocks are counted per user and per room in windows of this long
+const attemptWindow = 15 * time.Minute
+
+const (
+	maxUserAttempts = 5
+	// Anyone can get a new user ID by dropping the cookie, so the room has its own limit too
+	maxRoomAttempts = 50
+)
+
+// roomAttempts is the attempt counter shared by everyone trying the room
+const roomAttempts = "ROOM"
+
+var ErrWrongPasscode = errors.New("wrong passcode")
+var ErrTooManyAttempts = errors.New("too many attempts, try again later")
+
+type SetPasscodeRequest struct {
+	Passcode string `json:"passcode" binding:"required,min=4,max=72"`
+}
+
+type UnlockRequest struct {
+	Passcode string `json:"passcode" binding:"required,max=72"`
+}
+
+type SetAllowedDomainRequest struct {
+	Domain string `json:"domain" binding:"required,fqdn,max=253"`
+}
+
+// UnlockKey is what a session keeps once it has unlocked the room, changing the passcode changes the key
+func (room Room) UnlockKey() string {
+	return fmt.Sprintf("%s@%d", room.ID, room.AccessVersion)
+}
+
+// CanAccess is true for members, everyone else has to be signed in from the allowed domain
+// and have unlocked the passcode when the room has them. verifiedEmail comes from the session's identity provider sign in
+func (room Room) CanAccess(userID string, unlocked []string, verifiedEmail string) bool {
+	if room.RoleOf(userID) != "" {
+		return true
+	}
+
+	if room.AllowedDomain != "" && !InDomain(verifiedEmail, room.AllowedDomain) {
+		return false
+	}
+
+	if room.AccessHash == "" {
+		return true
+	}
+
+	for _, key := range unlocked {
+		if key == room.UnlockKey() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetPasscode protects the room, an empty passcode removes the protection
+func SetPasscode(roomID string, userID string, passcode string, client *dynamodb.Client) (*Room, error) {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(os.Getenv("table")),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+		},
+		UpdateExpression: aws.String("remove accessHash add accessVersion :one"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userID": &types.AttributeValueMemberS{Value: userID},
+			":one":    &types.AttributeValueMemberN{Value: "1"},
+		},
+		ConditionExpression: aws.String("ownerID = :userID and attribute_exists(PK) and attribute_exists(SK) and attribute_not_exists(deletedAt)"),
+		ReturnValues:        types.ReturnValueAllNew,
+	}
+
+	if passcode != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(passcode), bcrypt.DefaultCost)
+
+		if err != nil {
+			return nil, err
+		}
+
+		input.UpdateExpression = aws.String("set accessHash = :hash add accessVersion :one")
+		input.ExpressionAttributeValues[":hash"] = &types.AttributeValueMemberS{Value: string(hash)}
+	}
+
+	res, err := client.UpdateItem(context.TODO(), input)
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return nil, ErrRoomNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	updatedRoom := Unmarshal(res.Attributes)
+
+	return &updatedRoom, nil
+}
+
+// InDomain only matches the domain itself, not its subdomains
+func InDomain(email string, domain string) bool {
+	at := strings.LastIndex(email, "@")
+
+	return at > 0 && strings.EqualFold(email[at+1:], domain)
+}
+
+// SetAllowedDomain only lets people signed in with an address at domain into the room, an empty domain lets anyone in again
+func SetAllowedDomain(roomID string, userID string, domain string, client *dynamodb.Client) (*Room, error) {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(os.Getenv("table")),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+		},
+		UpdateExpression: aws.String("remove allowedDomain"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userID": &types.AttributeValueMemberS{Value: userID},
+		},
+		ConditionExpression: aws.String("ownerID = :userID and attribute_exists(PK) and attribute_exists(SK) and attribute_not_exists(deletedAt)"),
+		ReturnValues:        types.ReturnValueAllNew,
+	}
+
+	if domain != "" {
+		input.UpdateExpression = aws.String("set allowedDomain = :domain")
+		input.ExpressionAttributeValues[":domain"] = &types.AttributeValueMemberS{Value: strings.ToLower(domain)}
+	}
+
+	res, err := client.UpdateItem(context.TODO(), input)
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return nil, ErrRoomNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	updatedRoom := Unmarshal(res.Attributes)
+
+	return &updatedRoom, nil
+}
+
+// Unlock checks the passcode, the returned key is kept in the session.
+//
+// An attempt is taken before the passcode is compared so guesses sent at once can't all get past the limit,
+// it is given back when the passcode is right. The room's limit doesn't stop the right passcode,
+// otherwise anyone could lock everyone out by guessing from new user IDs.
+func (room Room) Unlock(passcode string, userID string, client *dynamodb.Client) (string, error) {
+	if room.AccessHash == "" {
+		return room.UnlockKey(), nil
+	}
+
+	userAllowed, err := takeAttempt(room.ID, userID, maxUserAttempts, client)
+
+	if err != nil {
+		return "", err
+	}
+
+	if !userAllowed {
+		return "", ErrTooManyAttempts
+	}
+
+	roomAllowed, err := takeAttempt(room.ID, roomAttempts, maxRoomAttempts, client)
+
+	if err != nil {
+		return "", err
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(room.AccessHash), []byte(passcode)) == nil {
+		keys := []string{userID}
+
+		if roomAllowed {
+			keys = append(keys, roomAttempts)
+		}
+
+		for _, key := range keys {
+			if err := giveBackAttempt(room.ID, key, client); err != nil {
+				return "", err
+			}
+		}
+
+		return room.UnlockKey(), nil
+	}
+
+	if !roomAllowed {
+		return "", ErrTooManyAttempts
+	}
+
+	return "", ErrWrongPasscode
+}
+
+func attemptKey(roomID string, key string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+		"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ATTEMPT#%s", key)},
+	}
+}
+
+// takeAttempt starts a new window if the last one is over, otherwise adds to it as long as it is under max
+func takeAttempt(roomID string, key string, max int, client *dynamodb.Client) (bool, error) {
+	now := time.Now()
+
+	_, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:        aws.String(os.Getenv("table")),
+		Key:              attemptKey(roomID, key),
+		UpdateExpression: aws.String("set attempts = :one, expiresAt = :expiresAt, #type = :type"),
+		// type is a reserved word
+		ExpressionAttributeNames: map[string]string{
+			"#type": "type",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":type":      &types.AttributeValueMemberS{Value: dynamodbTypes.Attempt},
+			":one":       &types.AttributeValueMemberN{Value: "1"},
+			":now":       &types.AttributeValueMemberN{Value: fmt.Sprint(now.Unix())},
+			":expiresAt": &types.AttributeValueMemberN{Value: fmt.Sprint(now.Add(attemptWindow).Unix())},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(expiresAt) or expiresAt <= :now"),
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if !errors.As(err, &conditionErr) {
+		return err == nil, err
+	}
+
+	_, err = client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:        aws.String(os.Getenv("table")),
+		Key:              attemptKey(roomID, key),
+		UpdateExpression: aws.String("add attempts :one"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+			":max": &types.AttributeValueMemberN{Value: fmt.Sprint(max)},
+			":now": &types.AttributeValueMemberN{Value: fmt.Sprint(now.Unix())},
+		},
+		// A window that ended in between counts as full, the next try starts a new one
+		ConditionExpression: aws.String("attempts < :max and expiresAt > :now"),
+	})
+
+	if errors.As(err, &conditionErr) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// giveBackAttempt undoes takeAttempt, the count never goes below zero
+func giveBackAttempt(roomID string, key string, client *dynamodb.Client) error {
+	return updateIgnoringCondition(
+		attemptKey(roomID, key),
+		"add attempts :minusOne",
+		"attempts > :zero",
+		map[string]types.AttributeValue{
+			":minusOne": &types.AttributeValueMemberN{Value: "-1"},
+			":zero":     &types.AttributeValueMemberN{Value: "0"},
+		},
+		client,
+	)
+}
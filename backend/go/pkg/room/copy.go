@@ -0,0 +1,127 @@
+package room
+
+import (
+	"picker/backend/go/pkg/option"
+	"picker/backend/go/pkg/recurrence"
+	"picker/backend/go/pkg/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+type CopyRoomRequest struct {
+	ID string `json:"id" binding:"required,roomid,max=100"`
+}
+
+// Duplicate copies the room's question, options, order and settings into a new room, nothing is selected in the copy
+func (room Room) Duplicate(id string, userID string, client *dynamodb.Client) (*Room, error) {
+	return create(id, userID, room.content(), client)
+}
+
+// SaveTemplate keeps the room's content under the user so new rooms can be made from it
+func (room Room) SaveTemplate(name string, userID string, client *dynamodb.Client) (*template.Template, error) {
+	saved := template.New(name, userID)
+	content := room.content()
+
+	saved.Question = content.Question
+	saved.Kind = content.Kind
+	saved.Grid = content.Grid
+	saved.SeatMap = content.SeatMap
+	saved.Recurrence = content.Recurrence
+	saved.Options = content.Options
+
+	err := saved.Save(client)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return saved, nil
+}
+
+func FromTemplate(saved template.Template, id string, userID string, client *dynamodb.Client) (*Room, error) {
+	return create(id, userID, template.Template{
+		Question:   saved.Question,
+		Kind:       saved.Kind,
+		Grid:       saved.Grid,
+		SeatMap:    saved.SeatMap,
+		Recurrence: saved.Recurrence,
+		Options:    saved.Options,
+	}, client)
+}
+
+// content is what is copied from a room, selections and deleted options are left behind
+func (room Room) content() template.Template {
+	options := []option.Option{}
+
+	for _, opt := range room.Options {
+		if opt.DeletedAt == nil {
+			options = append(options, option.Copy(opt, room.OwnerID, room.ID))
+		}
+	}
+
+	option.Sort(options)
+
+	return template.Template{
+		Question:   room.Question,
+		Kind:       room.Kind,
+		Grid:       room.Grid,
+		SeatMap:    room.SeatMap,
+		Recurrence: room.Recurrence,
+		Options:    options,
+	}
+}
+
+func create(id string, userID string, content template.Template, client *dynamodb.Client) (*Room, error) {
+	createdAt := time.Now().UTC()
+
+	room := newRoom(id, content.Question, userID, createdAt)
+
+	options := make([]*option.Option, len(content.Options))
+
+	for i, opt := range content.Options {
+		copied := option.Copy(opt, userID, room.ID)
+		// Positions are renumbered so gaps left by deleted options close up
+		copied.Position = i
+		options[i] = &copied
+	}
+
+	room.Kind = content.Kind
+	room.Grid = content.Grid
+	room.SeatMap = content.SeatMap
+
+	if content.Recurrence != nil {
+		rule, err := nextCycle(*content.Recurrence, createdAt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		room.setRecurrence(rule)
+	}
+
+	err := put(room, options, client)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return room, nil
+}
+
+// nextCycle keeps the rule's schedule but moves it on if the copied cycle has already ended
+func nextCycle(rule recurrence.Rule, now time.Time) (*recurrence.Rule, error) {
+	if rule.NextRunAt.After(now) {
+		return &rule, nil
+	}
+
+	next, err := rule.Following(now)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rule.NextRunAt = next
+
+	return &rule, nil
+}
@@ -0,0 +1,99 @@
+package room
+
+import (
+	"picker/backend/go/pkg/roomid"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// Suggestions offered when an ID isn't available
+const maxSuggestions = 3
+
+type Availability struct {
+	Available   bool     `json:"available"`
+	Reason      string   `json:"reason,omitempty"`
+	Suggestions []string `json:"suggestions,omitempty"`
+}
+
+// ResolveID finds the partition a requested ID is stored under.
+//
+// New rooms are stored lowercase, rooms made before that keep their casing and are only found by their exact ID.
+func ResolveID(id string, client *dynamodb.Client) (string, error) {
+	canonical := roomid.Canonical(id)
+
+	if canonical == id {
+		return id, nil
+	}
+
+	legacy, err := Exists(id, client)
+
+	if err != nil {
+		return "", err
+	}
+
+	if legacy {
+		return id, nil
+	}
+
+	return canonical, nil
+}
+
+// CheckAvailable says why id can't be used and suggests some that can
+func CheckAvailable(id string, checker *roomid.Checker, client *dynamodb.Client) (*Availability, error) {
+	reason := checker.Check(id)
+
+	if reason == "" {
+		taken, err := taken(id, client)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !taken {
+			return &Availability{Available: true}, nil
+		}
+
+		reason = roomid.ReasonTaken
+	}
+
+	availability := &Availability{Reason: reason, Suggestions: []string{}}
+
+	for _, candidate := range checker.Candidates(id) {
+		if len(availability.Suggestions) == maxSuggestions {
+			break
+		}
+
+		taken, err := taken(candidate, client)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !taken {
+			availability.Suggestions = append(availability.Suggestions, candidate)
+		}
+	}
+
+	return availability, nil
+}
+
+// taken checks the ID in any casing it could be stored under
+func taken(id string, client *dynamodb.Client) (bool, error) {
+	exists, err := Exists(roomid.Canonical(id), client)
+
+	if err != nil || exists || roomid.Canonical(id) == id {
+		return exists, err
+	}
+
+	return Exists(id, client)
+}
+
+// legacyTaken checks the casing rooms from before IDs were lowercased are stored under,
+// the condition on the canonical partition doesn't see them
+func legacyTaken(displayID string, client *dynamodb.Client) (bool, error) {
+	if roomid.Canonical(displayID) == displayID {
+		return false, nil
+	}
+
+	return Exists(displayID, client)
+}
@@ -0,0 +1,281 @@
+package room
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"picker/backend/go/pkg/dynamodbTypes"
+	"picker/backend/go/pkg/signing"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/twinj/uuid"
+)
+
+var ErrInviteNotFound = errors.New("invite not found")
+var ErrInviteUsed = errors.New("invite has already been used by someone else")
+
+type CreateInvitesRequest struct {
+	Names []string `json:"names" binding:"required,gt=0,lte=200,dive,required,min=1,max=1500"`
+}
+
+type AcceptInviteRequest struct {
+	Token string `json:"token" binding:"required,max=500"`
+}
+
+// Invite is stored in the room's partition with a ROOM_ prefix so it is loaded with the room
+type Invite struct {
+	// DynamoDB
+	PK   string `dynamodbav:"PK" json:"-"`
+	SK   string `dynamodbav:"SK" json:"-"`
+	Type string `dynamodbav:"type" json:"-"`
+
+	ID        string    `dynamodbav:"id" json:"id"`
+	RoomID    string    `dynamodbav:"roomID" json:"roomID"`
+	Name      string    `dynamodbav:"name" json:"name"`
+	CreatedAt time.Time `dynamodbav:"createdAt" json:"createdAt"`
+	// UserID is whoever opened the link first, only they can use it
+	UserID     string     `dynamodbav:"userID,omitempty" json:"-"`
+	AcceptedAt *time.Time `dynamodbav:"acceptedAt,omitempty" json:"acceptedAt,omitempty"`
+}
+
+type InviteStatus struct {
+	Invite
+	Token     string `json:"token,omitempty"`
+	Accepted  bool   `json:"accepted"`
+	Responded bool   `json:"responded"`
+}
+
+// InviteToken is the signed part of an invite link
+func InviteToken(secret string, roomID string, inviteID string) string {
+	return signing.Sign(secret, fmt.Sprintf("invite:%s:%s", roomID, inviteID))
+}
+
+func (room Room) Invite(id string) *Invite {
+	for _, invite := range room.Invites {
+		if invite.ID == id {
+			return &invite
+		}
+	}
+
+	return nil
+}
+
+// Invitee is userID's invite, if they have accepted one
+func (room Room) Invitee(userID string) *Invite {
+	for _, invite := range room.Invites {
+		if invite.UserID == userID {
+			return &invite
+		}
+	}
+
+	return nil
+}
+
+// CanSelect is false for people without an invite to an invite only room
+func (room Room) CanSelect(userID string) bool {
+	return !room.InviteOnly || room.RoleOf(userID) != "" || room.Invitee(userID) != nil
+}
+
+// InviteStatuses shows the owner who has opened their link and who has picked something
+func (room Room) InviteStatuses(secret string) []InviteStatus {
+	statuses := []InviteStatus{}
+
+	for _, invite := range room.Invites {
+		status := InviteStatus{
+			Invite:   invite,
+			Token:    InviteToken(secret, room.ID, invite.ID),
+			Accepted: invite.UserID != "",
+		}
+
+		for _, opt := range room.Options {
+			if status.Accepted && opt.DeletedAt == nil && opt.SelectedByID != nil && *opt.SelectedByID == invite.UserID {
+				status.Responded = true
+				break
+			}
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+}
+
+// CreateInvites adds an invite per name and makes the room invite only
+func (room Room) CreateInvites(names []string, secret string, client *dynamodb.Client) ([]InviteStatus, error) {
+	createdAt := time.Now().UTC()
+	statuses := []InviteStatus{}
+
+	var items []types.TransactWriteItem
+
+	for _, name := range names {
+		id := uuid.NewV4().String()
+
+		invite := Invite{
+			PK:        fmt.Sprintf("ROOM#%s", room.ID),
+			SK:        fmt.Sprintf("ROOM_INVITE#%s", id),
+			Type:      dynamodbTypes.Invite,
+			ID:        id,
+			RoomID:    room.ID,
+			Name:      strings.TrimSpace(name),
+			CreatedAt: createdAt,
+		}
+
+		item, err := attributevalue.MarshalMap(invite)
+
+		if err != nil {
+			panic(err)
+		}
+
+		items = append(items, types.TransactWriteItem{
+			Put: &types.Put{
+				TableName: aws.String(os.Getenv("table")),
+				Item:      item,
+			},
+		})
+
+		statuses = append(statuses, InviteStatus{Invite: invite, Token: InviteToken(secret, room.ID, id)})
+	}
+
+	// TransactWriteItems does a max of 100 items
+	for start := 0; start < len(items); start += 100 {
+		end := start + 100
+
+		if end > len(items) {
+			end = len(items)
+		}
+
+		_, err := client.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{
+			TransactItems: items[start:end],
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Only once every invite exists, stopping part way leaves the room as open as it was
+	_, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(os.Getenv("table")),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: room.PK},
+			"SK": &types.AttributeValueMemberS{Value: room.SK},
+		},
+		UpdateExpression: aws.String("set inviteOnly = :true"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":true": &types.AttributeValueMemberBOOL{Value: true},
+		},
+		ConditionExpression: aws.String("attribute_exists(PK) and attribute_exists(SK)"),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return statuses, nil
+}
+
+// AcceptInvite binds the invite in token to userID, opening it again as the same user is fine.
+//
+// The room is looked up through any renames, links sent before one name the room's old ID.
+func AcceptInvite(roomID string, token string, userID string, secret string, client *dynamodb.Client) (*Invite, error) {
+	payload, err := signing.Verify(secret, token)
+
+	if err != nil {
+		return nil, ErrInviteNotFound
+	}
+
+	parts := strings.Split(payload, ":")
+
+	if len(parts) != 3 || parts[0] != "invite" {
+		return nil, ErrInviteNotFound
+	}
+
+	current, err := GetRoom(roomID, client, userID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if current == nil || !current.KnownAs(parts[1]) {
+		return nil, ErrInviteNotFound
+	}
+
+	res, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(os.Getenv("table")),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: current.PK},
+			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM_INVITE#%s", parts[2])},
+		},
+		// Accepted invites are listed under the invitee in GSI1, so they can follow them to another user ID
+		UpdateExpression: aws.String("set userID = :userID, acceptedAt = if_not_exists(acceptedAt, :now), GSI1PK = :invitee, GSI1SK = if_not_exists(GSI1SK, :listing)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userID":  &types.AttributeValueMemberS{Value: userID},
+			":now":     &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
+			":invitee": &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", userID)},
+			":listing": &types.AttributeValueMemberS{Value: fmt.Sprintf("INVITE#%s", time.Now().UTC().Format(time.RFC3339))},
+		},
+		ConditionExpression: aws.String("attribute_exists(PK) and (attribute_not_exists(userID) or userID = :userID)"),
+		ReturnValues:        types.ReturnValueAllNew,
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		// Either revoked or someone else got there first
+		existing, getErr := client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+			TableName: aws.String(os.Getenv("table")),
+			Key: map[string]types.AttributeValue{
+				"PK": &types.AttributeValueMemberS{Value: current.PK},
+				"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM_INVITE#%s", parts[2])},
+			},
+		})
+
+		if getErr == nil && existing.Item != nil {
+			return nil, ErrInviteUsed
+		}
+
+		return nil, ErrInviteNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	invite := UnmarshalInvite(res.Attributes)
+
+	return &invite, nil
+}
+
+// RevokeInvite deletes the invite, anything its invitee already picked stays picked
+func (room Room) RevokeInvite(inviteID string, client *dynamodb.Client) error {
+	_, err := client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: aws.String(os.Getenv("table")),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: room.PK},
+			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM_INVITE#%s", inviteID)},
+		},
+		ConditionExpression: aws.String("attribute_exists(PK) and attribute_exists(SK)"),
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrInviteNotFound
+	}
+
+	return err
+}
+
+func UnmarshalInvite(item map[string]types.AttributeValue) Invite {
+	invite := &Invite{}
+
+	if err := attributevalue.UnmarshalMap(item, invite); err != nil {
+		panic(err)
+	}
+
+	return *invite
+}
@@ -0,0 +1,299 @@
+package room
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"picker/backend/go/pkg/dynamodbTypes"
+	"picker/backend/go/pkg/signing"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	// RoleOwner can do anything to the room, the room's OwnerID is always an owner
+	RoleOwner = "owner"
+	// RoleEditor manages the room's options
+	RoleEditor = "editor"
+	// RoleViewer sees the admin view, including who picked what
+	RoleViewer = "viewer"
+)
+
+var roleRanks = map[string]int{
+	RoleViewer: 1,
+	RoleEditor: 2,
+	RoleOwner:  3,
+}
+
+var ErrMemberNotFound = errors.New("member not found")
+var ErrInvalidLink = errors.New("link is invalid or has been replaced")
+
+type AdminLinkRequest struct {
+	Role string `json:"role" binding:"required,oneof=owner editor viewer"`
+}
+
+type AdminLink struct {
+	Role  string `json:"role"`
+	Token string `json:"token"`
+}
+
+type JoinRequest struct {
+	Token string `json:"token" binding:"required,max=500"`
+	Name  string `json:"name" binding:"max=1500"`
+}
+
+type UpdateMemberRequest struct {
+	Role string `json:"role" binding:"required,oneof=owner editor viewer"`
+}
+
+// Member is stored in the room's partition, its GSI1 keys list the room under the member like the owner's rooms
+type Member struct {
+	// DynamoDB
+	PK     string `dynamodbav:"PK" json:"-"`
+	SK     string `dynamodbav:"SK" json:"-"`
+	GSI1PK string `dynamodbav:"GSI1PK" json:"-"`
+	GSI1SK string `dynamodbav:"GSI1SK" json:"-"`
+	Type   string `dynamodbav:"type" json:"-"`
+
+	RoomID   string    `dynamodbav:"roomID" json:"roomID"`
+	UserID   string    `dynamodbav:"userID" json:"userID"`
+	Name     string    `dynamodbav:"name,omitempty" json:"name,omitempty"`
+	Role     string    `dynamodbav:"role" json:"role"`
+	JoinedAt time.Time `dynamodbav:"joinedAt" json:"joinedAt"`
+}
+
+// RoleOf is what userID can do in the room, "" for everyone who isn't a member
+func (room Room) RoleOf(userID string) string {
+	if room.OwnerID == userID {
+		return RoleOwner
+	}
+
+	for _, member := range room.Members {
+		if member.UserID == userID {
+			return member.Role
+		}
+	}
+
+	return ""
+}
+
+// Can is true if userID's role is at least role
+func (room Room) Can(userID string, role string) bool {
+	rank := roleRanks[room.RoleOf(userID)]
+
+	return rank > 0 && rank >= roleRanks[role]
+}
+
+// AdminLink makes a link that adds whoever opens it as a member, replacing the links with RevokeAdminLinks stops them working
+func (room Room) AdminLink(role string, secret string) AdminLink {
+	return AdminLink{
+		Role:  role,
+		Token: signing.Sign(secret, fmt.Sprintf("member:%s:%s:%d", room.ID, role, room.AdminLinkVersion)),
+	}
+}
+
+// Join adds userID as a member with the role in the link, links made before the room was renamed still work
+func (room Room) Join(token string, userID string, name string, secret string, client *dynamodb.Client) (*Member, error) {
+	payload, err := signing.Verify(secret, token)
+
+	if err != nil {
+		return nil, ErrInvalidLink
+	}
+
+	parts := strings.Split(payload, ":")
+
+	if len(parts) != 4 || parts[0] != "member" || !room.KnownAs(parts[1]) || roleRanks[parts[2]] == 0 || parts[3] != strconv.Itoa(room.AdminLinkVersion) {
+		return nil, ErrInvalidLink
+	}
+
+	// Opening a link for a lower role doesn't demote anyone
+	if room.Can(userID, parts[2]) {
+		for _, member := range room.Members {
+			if member.UserID == userID {
+				return &member, nil
+			}
+		}
+
+		return &Member{RoomID: room.ID, UserID: userID, Role: room.RoleOf(userID)}, nil
+	}
+
+	joinedAt := time.Now().UTC()
+
+	member := Member{
+		PK:       room.PK,
+		SK:       fmt.Sprintf("ROOM_MEMBER#%s", userID),
+		GSI1PK:   fmt.Sprintf("USER#%s", userID),
+		GSI1SK:   fmt.Sprintf("ROOM#%s#%s", joinedAt.Format(time.RFC3339), room.ID),
+		Type:     dynamodbTypes.Member,
+		RoomID:   room.ID,
+		UserID:   userID,
+		Name:     name,
+		Role:     parts[2],
+		JoinedAt: joinedAt,
+	}
+
+	item, err := attributevalue.MarshalMap(member)
+
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName: aws.String(os.Getenv("table")),
+		Item:      item,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &member, nil
+}
+
+// RevokeAdminLinks stops every admin link handed out so far, members who already joined stay
+func (room Room) RevokeAdminLinks(client *dynamodb.Client) (*Room, error) {
+	res, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(os.Getenv("table")),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: room.PK},
+			"SK": &types.AttributeValueMemberS{Value: room.SK},
+		},
+		UpdateExpression: aws.String("add adminLinkVersion :one"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+		},
+		ConditionExpression: aws.String("attribute_exists(PK) and attribute_exists(SK)"),
+		ReturnValues:        types.ReturnValueAllNew,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	updatedRoom := Unmarshal(res.Attributes)
+
+	return &updatedRoom, nil
+}
+
+func (room Room) UpdateMember(userID string, role string, client *dynamodb.Client) (*Member, error) {
+	res, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(os.Getenv("table")),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: room.PK},
+			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM_MEMBER#%s", userID)},
+		},
+		UpdateExpression: aws.String("set #role = :role"),
+		// role is a reserved word
+		ExpressionAttributeNames: map[string]string{
+			"#role": "role",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":role": &types.AttributeValueMemberS{Value: role},
+		},
+		ConditionExpression: aws.String("attribute_exists(PK) and attribute_exists(SK)"),
+		ReturnValues:        types.ReturnValueAllNew,
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return nil, ErrMemberNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	member := UnmarshalMember(res.Attributes)
+
+	return &member, nil
+}
+
+// RemoveMember takes away userID's role, the room's OwnerID can't be removed
+func (room Room) RemoveMember(userID string, client *dynamodb.Client) error {
+	_, err := client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: aws.String(os.Getenv("table")),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: room.PK},
+			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM_MEMBER#%s", userID)},
+		},
+		ConditionExpression: aws.String("attribute_exists(PK) and attribute_exists(SK)"),
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrMemberNotFound
+	}
+
+	return err
+}
+
+// sharedRooms loads the rooms that were only listed through a membership
+func sharedRooms(rooms []Room, client *dynamodb.Client) (map[string]Room, error) {
+	shared := map[string]Room{}
+
+	var keys []map[string]types.AttributeValue
+
+	for _, room := range rooms {
+		if room.PK != "" {
+			continue
+		}
+
+		key := fmt.Sprintf("ROOM#%s", room.ID)
+
+		keys = append(keys, map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: key},
+			"SK": &types.AttributeValueMemberS{Value: key},
+		})
+	}
+
+	// BatchGetItem does a max of 100 keys
+	for start := 0; start < len(keys); start += 100 {
+		end := start + 100
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		request := &dynamodb.BatchGetItemInput{
+			RequestItems: map[string]types.KeysAndAttributes{
+				os.Getenv("table"): {Keys: keys[start:end]},
+			},
+		}
+
+		for len(request.RequestItems) > 0 {
+			res, err := client.BatchGetItem(context.TODO(), request)
+
+			if err != nil {
+				return nil, err
+			}
+
+			for _, item := range res.Responses[os.Getenv("table")] {
+				room := Unmarshal(item)
+
+				if room.DeletedAt == nil {
+					shared[room.ID] = room
+				}
+			}
+
+			request.RequestItems = res.UnprocessedKeys
+		}
+	}
+
+	return shared, nil
+}
+
+func UnmarshalMember(item map[string]types.AttributeValue) Member {
+	member := &Member{}
+
+	if err := attributevalue.UnmarshalMap(item, member); err != nil {
+		panic(err)
+	}
+
+	return *member
+}
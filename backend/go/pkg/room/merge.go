@@ -0,0 +1,212 @@
+package room
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"picker/backend/go/pkg/dynamodbTypes"
+	"picker/backend/go/pkg/option"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// MergeUser moves the rooms fromID owns, their memberships, accepted invites and picks over to toID,
+// for when two user IDs turn out to be the same person. Everything is moved on its own,
+// calling it again carries on from wherever it stopped.
+func MergeUser(fromID string, toID string, client *dynamodb.Client) error {
+	if fromID == toID {
+		return nil
+	}
+
+	paginator := dynamodb.NewQueryPaginator(client, &dynamodb.QueryInput{
+		TableName:              aws.String(os.Getenv("table")),
+		IndexName:              aws.String("GSI1"),
+		KeyConditionExpression: aws.String("GSI1PK = :GSI1PK and begins_with(GSI1SK, :room)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":GSI1PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", fromID)},
+			":room":   &types.AttributeValueMemberS{Value: "ROOM#"},
+		},
+	})
+
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(context.TODO())
+
+		if err != nil {
+			return err
+		}
+
+		for _, item := range out.Items {
+			switch dynamodbTypes.GetType(item) {
+			case dynamodbTypes.Room:
+				err = mergeRoom(Unmarshal(item), toID, client)
+			case dynamodbTypes.Member:
+				err = mergeMember(UnmarshalMember(item), toID, client)
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Rooms handed over by an earlier call that stopped before their options moved
+	err := finishMergedRooms(fromID, toID, client)
+
+	if err != nil {
+		return err
+	}
+
+	err = mergeInvites(fromID, toID, client)
+
+	if err != nil {
+		return err
+	}
+
+	return option.ReassignSelections(fromID, toID, client)
+}
+
+// mergeRoom keeps the room's place in the owner's list, deleted rooms come along so they can still be restored
+func mergeRoom(owned Room, toID string, client *dynamodb.Client) error {
+	if owned.RenamingTo != "" || owned.RenamingFrom != "" {
+		return ErrRenameInProgress
+	}
+
+	_, err := client.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{
+		TransactItems: handOver(owned, toID, owned.GSI1SK, true),
+	})
+
+	// Changed hands since the index was read, finishMergedRooms picks it up if it went to toID
+	var cancelled *types.TransactionCanceledException
+	if errors.As(err, &cancelled) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return finishTransfer(owned.ID, owned.OwnerID, toID, client)
+}
+
+func finishMergedRooms(fromID string, toID string, client *dynamodb.Client) error {
+	paginator := dynamodb.NewQueryPaginator(client, &dynamodb.QueryInput{
+		TableName:              aws.String(os.Getenv("table")),
+		IndexName:              aws.String("GSI1"),
+		KeyConditionExpression: aws.String("GSI1PK = :GSI1PK and begins_with(GSI1SK, :room)"),
+		FilterExpression:       aws.String("transferringFrom = :from"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":GSI1PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", toID)},
+			":room":   &types.AttributeValueMemberS{Value: "ROOM#"},
+			":from":   &types.AttributeValueMemberS{Value: fromID},
+		},
+	})
+
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(context.TODO())
+
+		if err != nil {
+			return err
+		}
+
+		for _, item := range out.Items {
+			err := finishTransfer(Unmarshal(item).ID, fromID, toID, client)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// mergeMember keeps whichever of the two users' roles in the room is higher
+func mergeMember(member Member, toID string, client *dynamodb.Client) error {
+	shared, _, err := getRoom(member.RoomID, client)
+
+	if err != nil {
+		return err
+	}
+
+	deleteFrom := types.TransactWriteItem{
+		Delete: &types.Delete{
+			TableName: aws.String(os.Getenv("table")),
+			Key: map[string]types.AttributeValue{
+				"PK": &types.AttributeValueMemberS{Value: member.PK},
+				"SK": &types.AttributeValueMemberS{Value: member.SK},
+			},
+		},
+	}
+
+	transactItems := []types.TransactWriteItem{deleteFrom}
+
+	// Deleted rooms aren't loaded, the membership goes either way
+	if shared != nil && roleRanks[shared.RoleOf(toID)] < roleRanks[member.Role] {
+		merged := member
+		merged.SK = fmt.Sprintf("ROOM_MEMBER#%s", toID)
+		merged.GSI1PK = fmt.Sprintf("USER#%s", toID)
+		merged.UserID = toID
+
+		item, err := attributevalue.MarshalMap(merged)
+
+		if err != nil {
+			panic(err)
+		}
+
+		transactItems = append(transactItems, types.TransactWriteItem{
+			Put: &types.Put{
+				TableName: aws.String(os.Getenv("table")),
+				Item:      item,
+			},
+		})
+	}
+
+	_, err = client.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{
+		TransactItems: transactItems,
+	})
+
+	return err
+}
+
+func mergeInvites(fromID string, toID string, client *dynamodb.Client) error {
+	paginator := dynamodb.NewQueryPaginator(client, &dynamodb.QueryInput{
+		TableName:              aws.String(os.Getenv("table")),
+		IndexName:              aws.String("GSI1"),
+		KeyConditionExpression: aws.String("GSI1PK = :GSI1PK and begins_with(GSI1SK, :invite)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":GSI1PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", fromID)},
+			":invite": &types.AttributeValueMemberS{Value: "INVITE#"},
+		},
+	})
+
+	values := map[string]types.AttributeValue{
+		":from":    &types.AttributeValueMemberS{Value: fromID},
+		":to":      &types.AttributeValueMemberS{Value: toID},
+		":invitee": &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", toID)},
+	}
+
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(context.TODO())
+
+		if err != nil {
+			return err
+		}
+
+		for _, item := range out.Items {
+			err := updateIgnoringCondition(map[string]types.AttributeValue{
+				"PK": item["PK"],
+				"SK": item["SK"],
+			}, "set userID = :to, GSI1PK = :invitee", "userID = :from", values, client)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,299 @@
+package room
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"picker/backend/go/pkg/option"
+	"picker/backend/go/pkg/recurrence"
+	"picker/backend/go/pkg/slot"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Recurring rooms are in GSI2 under this partition, sorted by when their cycle ends
+const schedulePK = "SCHEDULE"
+
+type CycleResult struct {
+	RoomID    string       `json:"roomID"`
+	NextRunAt time.Time    `json:"nextRunAt"`
+	Reset     *ResetResult `json:"reset,omitempty"`
+	Shifted   int          `json:"shifted"`
+	Error     string       `json:"error,omitempty"`
+}
+
+func scheduleSK(nextRunAt time.Time, roomID string) string {
+	return fmt.Sprintf("%s#%s", nextRunAt.UTC().Format(time.RFC3339), roomID)
+}
+
+// SetRecurrence makes the room recurring, a nil request stops it
+func SetRecurrence(roomID string, userID string, request *recurrence.Request, client *dynamodb.Client) (*Room, error) {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(os.Getenv("table")),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+		},
+		UpdateExpression: aws.String("remove recurrence, GSI2PK, GSI2SK"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userID": &types.AttributeValueMemberS{Value: userID},
+		},
+		ConditionExpression: aws.String("ownerID = :userID and attribute_exists(PK) and attribute_exists(SK) and attribute_not_exists(deletedAt)"),
+		ReturnValues:        types.ReturnValueAllNew,
+	}
+
+	if request != nil {
+		rule, err := request.Rule(time.Now())
+
+		if err != nil {
+			return nil, err
+		}
+
+		marshalledRule, err := attributevalue.Marshal(rule)
+
+		if err != nil {
+			panic(err)
+		}
+
+		input.UpdateExpression = aws.String("set recurrence = :rule, GSI2PK = :GSI2PK, GSI2SK = :GSI2SK")
+		input.ExpressionAttributeValues[":rule"] = marshalledRule
+		input.ExpressionAttributeValues[":GSI2PK"] = &types.AttributeValueMemberS{Value: schedulePK}
+		input.ExpressionAttributeValues[":GSI2SK"] = &types.AttributeValueMemberS{Value: scheduleSK(rule.NextRunAt, roomID)}
+	}
+
+	res, err := client.UpdateItem(context.TODO(), input)
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return nil, ErrRoomNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	updatedRoom := Unmarshal(res.Attributes)
+
+	return &updatedRoom, nil
+}
+
+// RunDue ends the cycle of every recurring room that is due, one room failing doesn't stop the others
+func RunDue(now time.Time, client *dynamodb.Client) ([]CycleResult, error) {
+	paginator := dynamodb.NewQueryPaginator(client, &dynamodb.QueryInput{
+		TableName:              aws.String(os.Getenv("table")),
+		IndexName:              aws.String("GSI2"),
+		KeyConditionExpression: aws.String("GSI2PK = :GSI2PK and GSI2SK <= :until"),
+		FilterExpression:       aws.String("attribute_not_exists(deletedAt)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":GSI2PK": &types.AttributeValueMemberS{Value: schedulePK},
+			// ~ sorts after any room ID
+			":until": &types.AttributeValueMemberS{Value: scheduleSK(now, "~")},
+		},
+	})
+
+	results := []CycleResult{}
+
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(context.TODO())
+
+		if err != nil {
+			return results, err
+		}
+
+		for _, item := range out.Items {
+			due := Unmarshal(item)
+
+			result, err := RunCycle(due.ID, now, client)
+
+			if err != nil {
+				log.Default().Printf("Cycle for %s failed %s", due.ID, err)
+				result.Error = err.Error()
+			}
+
+			results = append(results, result)
+		}
+	}
+
+	return results, nil
+}
+
+// RunCycle archives and resets the room and moves its schedule on.
+//
+// Every step can be repeated, the snapshot is keyed by the cycle and the schedule only moves
+// from the cycle that was run, so a failed run is picked up again next time.
+func RunCycle(roomID string, now time.Time, client *dynamodb.Client) (CycleResult, error) {
+	result := CycleResult{RoomID: roomID}
+
+	room, err := GetRoom(roomID, client, "")
+
+	if err != nil {
+		return result, err
+	}
+
+	if room == nil || room.Recurrence == nil {
+		return result, ErrRoomNotFound
+	}
+
+	rule := *room.Recurrence
+	result.NextRunAt = rule.NextRunAt
+
+	if rule.NextRunAt.After(now) {
+		return result, nil
+	}
+
+	next, err := rule.Following(now)
+
+	if err != nil {
+		return result, err
+	}
+
+	reset, err := room.Reset(ResetRequest{
+		Snapshot: rule.Snapshot,
+		ResetID:  fmt.Sprintf("cycle-%s", rule.NextRunAt.Format("20060102T150405Z")),
+		Label:    fmt.Sprintf("Cycle ending %s", rule.NextRunAt.In(rule.Location()).Format("Mon 2 Jan 2006 15:04")),
+	}, client)
+
+	if err != nil {
+		return result, err
+	}
+
+	result.Reset = reset
+
+	if rule.Mode == recurrence.ModeRegenerate {
+		for _, opt := range room.Options {
+			if opt.StartsAt == nil || opt.EndsAt == nil || opt.DeletedAt != nil {
+				continue
+			}
+
+			err := shiftOption(opt, rule, next, client)
+
+			if err != nil {
+				return result, err
+			}
+
+			result.Shifted++
+		}
+	}
+
+	err = advanceSchedule(room.ID, rule.NextRunAt, next, client)
+
+	if err != nil {
+		return result, err
+	}
+
+	result.NextRunAt = next
+
+	return result, nil
+}
+
+// shiftOption moves a slot option into the next cycle, its label is only regenerated if the owner hasn't changed it
+func shiftOption(opt option.Option, rule recurrence.Rule, next time.Time, client *dynamodb.Client) error {
+	loc := rule.Location()
+
+	oldStart, oldEnd := opt.StartsAt.In(loc), opt.EndsAt.In(loc)
+	newStart := rule.Shift(oldStart, rule.NextRunAt, next).In(loc)
+	newEnd := rule.Shift(oldEnd, rule.NextRunAt, next).In(loc)
+
+	// The label is compared and rewritten against the same offset it was generated with
+	oldOffset, newOffset := slot.DayOffset(oldStart), slot.DayOffset(newStart)
+	times := map[string]time.Time{":oldStart": *opt.StartsAt, ":startsAt": newStart.UTC(), ":endsAt": newEnd.UTC()}
+	update := "set startsAt = :startsAt, endsAt = :endsAt, #value = :value, version = if_not_exists(version, :zero) + :one"
+
+	if opt.LabelDayStart != nil {
+		oldDayStart := opt.LabelDayStart.In(loc)
+		newDayStart := rule.Shift(oldDayStart, rule.NextRunAt, next).In(loc)
+
+		_, oldOffset = oldDayStart.Zone()
+		_, newOffset = newDayStart.Zone()
+
+		times[":labelDayStart"] = newDayStart.UTC()
+		update += ", labelDayStart = :labelDayStart"
+	}
+
+	value := opt.Value
+	if value == slot.Label(oldStart, oldEnd, oldOffset) {
+		value = slot.Label(newStart, newEnd, newOffset)
+	}
+
+	values := map[string]types.AttributeValue{
+		":value": &types.AttributeValueMemberS{Value: value},
+		":one":   &types.AttributeValueMemberN{Value: "1"},
+		":zero":  &types.AttributeValueMemberN{Value: "0"},
+	}
+
+	for name, t := range times {
+		marshalled, err := attributevalue.Marshal(t)
+
+		if err != nil {
+			panic(err)
+		}
+
+		values[name] = marshalled
+	}
+
+	_, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(os.Getenv("table")),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: opt.PK},
+			"SK": &types.AttributeValueMemberS{Value: opt.SK},
+		},
+		UpdateExpression: aws.String(update),
+		// value is a reserved word
+		ExpressionAttributeNames: map[string]string{
+			"#value": "value",
+		},
+		ExpressionAttributeValues: values,
+		// Already shifted by an earlier attempt
+		ConditionExpression: aws.String("startsAt = :oldStart"),
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return nil
+	}
+
+	return err
+}
+
+func advanceSchedule(roomID string, current time.Time, next time.Time, client *dynamodb.Client) error {
+	currentRunAt, err := attributevalue.Marshal(current)
+
+	if err != nil {
+		panic(err)
+	}
+
+	nextRunAt, err := attributevalue.Marshal(next)
+
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(os.Getenv("table")),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+		},
+		UpdateExpression: aws.String("set recurrence.nextRunAt = :next, GSI2SK = :GSI2SK"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":current": currentRunAt,
+			":next":    nextRunAt,
+			":GSI2SK":  &types.AttributeValueMemberS{Value: scheduleSK(next, roomID)},
+		},
+		// Another run has already moved it on
+		ConditionExpression: aws.String("recurrence.nextRunAt = :current"),
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return nil
+	}
+
+	return err
+}
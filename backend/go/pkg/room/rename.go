@@ -0,0 +1,436 @@
+package room
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"picker/backend/go/pkg/dynamodbTypes"
+	"picker/backend/go/pkg/roomid"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// A room renamed more than this many times stops resolving from its oldest IDs
+const maxRedirects = 5
+
+// Items that change while they are being moved are picked up again by the next pass
+const maxMovePasses = 10
+
+var ErrRoomIDTaken = errors.New("room ID is taken")
+var ErrRenameInProgress = errors.New("room is already being renamed")
+
+// movedItemGuards are the attributes a select, edit, reorder or delete changes, an item is only moved if they are unchanged
+var movedItemGuards = []string{"selectedByID", "version", "position", "deletedAt"}
+
+type RenameRoomRequest struct {
+	ID string `json:"id" binding:"required,roomid,max=100"`
+}
+
+// Redirect is left at a renamed room's old ID so old links still work
+type Redirect struct {
+	// DynamoDB
+	PK   string `dynamodbav:"PK"`
+	SK   string `dynamodbav:"SK"`
+	Type string `dynamodbav:"type"`
+
+	ID        string    `dynamodbav:"id"`
+	To        string    `dynamodbav:"to"`
+	OwnerID   string    `dynamodbav:"ownerID"`
+	CreatedAt time.Time `dynamodbav:"createdAt"`
+}
+
+// Rename moves the room and everything in its partition to newID.
+//
+// The new ID is claimed first and both rooms are marked, then items are moved one transaction at a time
+// and the old room is swapped for a redirect last. Calling it again with the same ID carries on from wherever it stopped.
+func Rename(roomID string, displayID string, userID string, client *dynamodb.Client) (*Room, error) {
+	newID := roomid.Canonical(displayID)
+
+	// Only the casing changes, nothing needs to move
+	if roomID == newID {
+		return setDisplayID(roomID, displayID, userID, client)
+	}
+
+	res, err := client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName:      aws.String(os.Getenv("table")),
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+		},
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Item == nil || dynamodbTypes.Expired(res.Item) {
+		return nil, ErrRoomNotFound
+	}
+
+	// Already renamed, only the new room's marker may be left
+	if dynamodbTypes.GetType(res.Item) == dynamodbTypes.Redirect {
+		redirect := UnmarshalRedirect(res.Item)
+
+		if redirect.OwnerID != userID || redirect.To != newID {
+			return nil, ErrRoomNotFound
+		}
+
+		return finishRename(roomID, newID, client)
+	}
+
+	old := Unmarshal(res.Item)
+
+	if old.OwnerID != userID || old.DeletedAt != nil {
+		return nil, ErrRoomNotFound
+	}
+
+	if old.TransferringFrom != "" {
+		return nil, ErrTransferInProgress
+	}
+
+	switch old.RenamingTo {
+	case "":
+		// A legacy room can move to its own lowercase ID
+		if displayID != roomID {
+			legacy, err := legacyTaken(displayID, client)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if legacy {
+				return nil, ErrRoomIDTaken
+			}
+		}
+
+		err = claim(old, displayID, client)
+
+		if err != nil {
+			return nil, err
+		}
+	case newID:
+	default:
+		return nil, ErrRenameInProgress
+	}
+
+	err = moveItems(roomID, newID, client)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = leaveRedirect(old, newID, client)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return finishRename(roomID, newID, client)
+}
+
+// claim marks the old room and creates the new one in a single transaction, so two renames can't both take an ID
+func claim(old Room, displayID string, client *dynamodb.Client) error {
+	newID := roomid.Canonical(displayID)
+
+	renamed := old
+	renamed.PK = fmt.Sprintf("ROOM#%s", newID)
+	renamed.SK = fmt.Sprintf("ROOM#%s", newID)
+	renamed.ID = newID
+	renamed.DisplayID = displayID
+	renamed.GSI1SK = fmt.Sprintf("ROOM#%s#%s", old.CreatedAt.Format(time.RFC3339), newID)
+	renamed.RenamingFrom = old.ID
+	renamed.RenamedFrom = append(append([]string{}, old.RenamedFrom...), old.ID)
+
+	// The oldest IDs stop resolving anyway
+	if len(renamed.RenamedFrom) > maxRedirects {
+		renamed.RenamedFrom = renamed.RenamedFrom[len(renamed.RenamedFrom)-maxRedirects:]
+	}
+	renamed.Options = nil
+	renamed.setRecurrence(old.Recurrence)
+
+	item, err := attributevalue.MarshalMap(renamed)
+
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = client.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				Update: &types.Update{
+					TableName: aws.String(os.Getenv("table")),
+					Key: map[string]types.AttributeValue{
+						"PK": &types.AttributeValueMemberS{Value: old.PK},
+						"SK": &types.AttributeValueMemberS{Value: old.SK},
+					},
+					UpdateExpression: aws.String("set renamingTo = :to"),
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":to":     &types.AttributeValueMemberS{Value: newID},
+						":userID": &types.AttributeValueMemberS{Value: old.OwnerID},
+					},
+					ConditionExpression: aws.String("ownerID = :userID and attribute_not_exists(renamingTo) and attribute_not_exists(transferringFrom) and attribute_not_exists(deletedAt)"),
+				},
+			},
+			{
+				Put: &types.Put{
+					TableName: aws.String(os.Getenv("table")),
+					Item:      item,
+					// The owner can rename back to an ID they renamed away from
+					ConditionExpression: aws.String("attribute_not_exists(PK) or (#type = :redirect and ownerID = :userID)"),
+					// type is a reserved word
+					ExpressionAttributeNames: map[string]string{
+						"#type": "type",
+					},
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":redirect": &types.AttributeValueMemberS{Value: dynamodbTypes.Redirect},
+						":userID":   &types.AttributeValueMemberS{Value: old.OwnerID},
+					},
+				},
+			},
+		},
+	})
+
+	var cancelled *types.TransactionCanceledException
+	if errors.As(err, &cancelled) && len(cancelled.CancellationReasons) == 2 {
+		if aws.ToString(cancelled.CancellationReasons[1].Code) == "ConditionalCheckFailed" {
+			return ErrRoomIDTaken
+		}
+
+		if aws.ToString(cancelled.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+			return ErrRenameInProgress
+		}
+	}
+
+	return err
+}
+
+// moveItems copies each item into the new partition and deletes the original in one transaction,
+// passes repeat until nothing is left so items that changed or were added mid move are caught
+func moveItems(roomID string, newID string, client *dynamodb.Client) error {
+	roomSK := fmt.Sprintf("ROOM#%s", roomID)
+
+	for pass := 0; pass < maxMovePasses; pass++ {
+		paginator := dynamodb.NewQueryPaginator(client, &dynamodb.QueryInput{
+			TableName:              aws.String(os.Getenv("table")),
+			ConsistentRead:         aws.Bool(true),
+			KeyConditionExpression: aws.String("PK = :PK"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+			},
+		})
+
+		remaining := 0
+
+		for paginator.HasMorePages() {
+			out, err := paginator.NextPage(context.TODO())
+
+			if err != nil {
+				return err
+			}
+
+			for _, item := range out.Items {
+				if sk, ok := item["SK"].(*types.AttributeValueMemberS); ok && sk.Value == roomSK {
+					continue
+				}
+
+				remaining++
+
+				err := moveItem(item, newID, client)
+
+				var cancelled *types.TransactionCanceledException
+				if errors.As(err, &cancelled) {
+					continue
+				}
+
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if remaining == 0 {
+			return nil
+		}
+	}
+
+	return errors.New("room is still changing, try the rename again")
+}
+
+func moveItem(item map[string]types.AttributeValue, newID string, client *dynamodb.Client) error {
+	moved := map[string]types.AttributeValue{}
+
+	for name, value := range item {
+		moved[name] = value
+	}
+
+	moved["PK"] = &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", newID)}
+
+	if roomID, ok := item["roomID"].(*types.AttributeValueMemberS); ok {
+		moved["roomID"] = &types.AttributeValueMemberS{Value: newID}
+
+		// Members list the room under themselves by its ID
+		if listing, ok := item["GSI1SK"].(*types.AttributeValueMemberS); ok && dynamodbTypes.GetType(item) == dynamodbTypes.Member {
+			moved["GSI1SK"] = &types.AttributeValueMemberS{Value: strings.TrimSuffix(listing.Value, roomID.Value) + newID}
+		}
+	}
+
+	conditions := "attribute_exists(PK)"
+	names := map[string]string{}
+	values := map[string]types.AttributeValue{}
+
+	for i, guard := range movedItemGuards {
+		name := fmt.Sprintf("#guard%d", i)
+		names[name] = guard
+
+		if value, ok := item[guard]; ok {
+			placeholder := fmt.Sprintf(":guard%d", i)
+			values[placeholder] = value
+			conditions += fmt.Sprintf(" and %s = %s", name, placeholder)
+		} else {
+			conditions += fmt.Sprintf(" and attribute_not_exists(%s)", name)
+		}
+	}
+
+	if len(values) == 0 {
+		values = nil
+	}
+
+	_, err := client.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				Put: &types.Put{
+					TableName:           aws.String(os.Getenv("table")),
+					Item:                moved,
+					ConditionExpression: aws.String("attribute_not_exists(PK)"),
+				},
+			},
+			{
+				Delete: &types.Delete{
+					TableName: aws.String(os.Getenv("table")),
+					Key: map[string]types.AttributeValue{
+						"PK": item["PK"],
+						"SK": item["SK"],
+					},
+					ConditionExpression:       aws.String(conditions),
+					ExpressionAttributeNames:  names,
+					ExpressionAttributeValues: values,
+				},
+			},
+		},
+	})
+
+	return err
+}
+
+// leaveRedirect swaps the old room for a redirect, a retry finds the redirect already there
+func leaveRedirect(old Room, newID string, client *dynamodb.Client) error {
+	redirect := Redirect{
+		PK:        old.PK,
+		SK:        old.SK,
+		Type:      dynamodbTypes.Redirect,
+		ID:        old.ID,
+		To:        newID,
+		OwnerID:   old.OwnerID,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	item, err := attributevalue.MarshalMap(redirect)
+
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName:           aws.String(os.Getenv("table")),
+		Item:                item,
+		ConditionExpression: aws.String("renamingTo = :to"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":to": &types.AttributeValueMemberS{Value: newID},
+		},
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return nil
+	}
+
+	return err
+}
+
+// KnownAs is true for the room's ID and the IDs it had before a rename
+func (room Room) KnownAs(id string) bool {
+	if id == room.ID || id == room.RedirectedFrom {
+		return true
+	}
+
+	for _, previous := range room.RenamedFrom {
+		if previous == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+func setDisplayID(roomID string, displayID string, userID string, client *dynamodb.Client) (*Room, error) {
+	res, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(os.Getenv("table")),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+		},
+		UpdateExpression: aws.String("set displayID = :displayID"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userID":    &types.AttributeValueMemberS{Value: userID},
+			":displayID": &types.AttributeValueMemberS{Value: displayID},
+		},
+		ConditionExpression: aws.String("ownerID = :userID and attribute_exists(PK) and attribute_exists(SK) and attribute_not_exists(deletedAt)"),
+		ReturnValues:        types.ReturnValueAllNew,
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return nil, ErrRoomNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	renamed := Unmarshal(res.Attributes)
+
+	return &renamed, nil
+}
+
+// finishRename unmarks the new room once the old one is a redirect
+func finishRename(roomID string, newID string, client *dynamodb.Client) (*Room, error) {
+	err := updateIgnoringCondition(map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", newID)},
+		"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", newID)},
+	}, "remove renamingFrom", "renamingFrom = :from", map[string]types.AttributeValue{
+		":from": &types.AttributeValueMemberS{Value: roomID},
+	}, client)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return GetRoom(newID, client, "")
+}
+
+func UnmarshalRedirect(item map[string]types.AttributeValue) Redirect {
+	redirect := &Redirect{}
+
+	if err := attributevalue.UnmarshalMap(item, redirect); err != nil {
+		panic(err)
+	}
+
+	return *redirect
+}
@@ -2,23 +2,67 @@ package room
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"picker/backend/go/pkg/dynamodbTypes"
+	"picker/backend/go/pkg/grid"
 	"picker/backend/go/pkg/option"
+	"picker/backend/go/pkg/recurrence"
+	"picker/backend/go/pkg/roomid"
+	"picker/backend/go/pkg/seatmap"
+	"picker/backend/go/pkg/slot"
+	"picker/backend/go/pkg/snapshot"
+	"sort"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/twinj/uuid"
 )
 
+// CreateRoomRequest without an ID gets a generated one
 type CreateRoomRequest struct {
-	ID       string   `json:"id" binding:"required,alphanum,min=1,max=100"`
-	Options  []string `json:"options" binding:"required,gt=0,lt=200,dive,required,min=1,max=1000"`
-	Question string   `json:"question" binding:"required,min=1,max=1500"`
+	ID       string        `json:"id" binding:"omitempty,roomid,max=100"`
+	Options  []string      `json:"options" binding:"required_without_all=Slots Matrix Seats,omitempty,lt=200,dive,required,min=1,max=1000"`
+	Slots    *slot.Spec    `json:"slots"`
+	Matrix   *grid.Spec    `json:"matrix"`
+	Seats    *seatmap.Spec `json:"seats"`
+	Question string        `json:"question" binding:"required,min=1,max=1500"`
+
+	// Recurrence resets the room at the end of each cycle
+	Recurrence *recurrence.Request `json:"recurrence"`
+}
+
+const (
+	KindList   = "list"
+	KindMatrix = "matrix"
+	KindSeats  = "seats"
+)
+
+var ErrOptionNotFound = errors.New("option not found")
+var ErrRoomNotFound = errors.New("room not found")
+var ErrRowLimit = errors.New("you have already picked the most options allowed in this row")
+
+// ReorderOptionsRequest can be a partial ordering, the listed options are reordered between the positions they already hold
+type ReorderOptionsRequest struct {
+	OptionIDs []string `json:"optionIDs" binding:"required,gt=0,lte=25,unique,dive,required"`
+}
+
+type ResetRequest struct {
+	// Snapshot saves the results before they are cleared
+	Snapshot bool `json:"snapshot"`
+	// ResetID makes a retried reset reuse the first snapshot, one is generated if it isn't sent
+	ResetID string `json:"resetID" binding:"omitempty,uuid"`
+	Label   string `json:"label" binding:"max=200"`
+}
+
+type ResetResult struct {
+	Cleared  int                `json:"cleared"`
+	Snapshot *snapshot.Snapshot `json:"snapshot,omitempty"`
 }
 
 type UpdateRoomRequest struct {
@@ -31,16 +75,59 @@ type Room struct {
 	SK     string `dynamodbav:"SK" json:"-"`
 	GSI1PK string `dynamodbav:"GSI1PK" json:"-"`
 	GSI1SK string `dynamodbav:"GSI1SK" json:"-"`
+	GSI2PK string `dynamodbav:"GSI2PK,omitempty" json:"-"`
+	GSI2SK string `dynamodbav:"GSI2SK,omitempty" json:"-"`
 	Type   string `dynamodbav:"type" json:"-"`
 
 	// Public
 	ID       string          `json:"id"`
 	Options  []option.Option `json:"options" dynamodbav:"options"`
 	Question string          `json:"question" dynamodbav:"question"`
+	Kind     string          `json:"kind" dynamodbav:"kind,omitempty"`
+	Grid     *grid.Grid      `json:"grid,omitempty" dynamodbav:"grid,omitempty"`
+	SeatMap  *seatmap.Layout `json:"seatMap,omitempty" dynamodbav:"seatMap,omitempty"`
+	// DeletedOptions are tombstoned, they are kept apart so they don't count towards any of the room's limits
+	DeletedOptions []option.Option `json:"deletedOptions,omitempty" dynamodbav:"-"`
+	// DisplayID keeps the casing the owner chose, ID is lowercase. Rooms from before that don't have one
+	DisplayID string `json:"displayID,omitempty" dynamodbav:"displayID,omitempty"`
+	// RedirectedFrom is the ID that was asked for when it has since been renamed
+	RedirectedFrom string `json:"redirectedFrom,omitempty" dynamodbav:"-"`
+	// RenamedFrom are the room's earlier IDs, oldest first, links signed before a rename still name them
+	RenamedFrom []string `json:"-" dynamodbav:"renamedFrom,omitempty"`
 
 	// Private
 	OwnerID   string    `dynamodbav:"ownerID" json:"-"`
 	CreatedAt time.Time `dynamodbav:"createdAt" json:"-"`
+	// A rename in progress is marked on both rooms until every item has moved
+	RenamingTo   string `dynamodbav:"renamingTo,omitempty" json:"-"`
+	RenamingFrom string `dynamodbav:"renamingFrom,omitempty" json:"-"`
+	// TransferringFrom is the previous owner until every option has been handed over
+	TransferringFrom string `dynamodbav:"transferringFrom,omitempty" json:"-"`
+	// AccessHash is the bcrypt hash of the room's passcode, AccessVersion goes up each time it changes
+	AccessHash    string `dynamodbav:"accessHash,omitempty" json:"-"`
+	AccessVersion int    `dynamodbav:"accessVersion,omitempty" json:"-"`
+	// AdminLinkVersion goes up each time the admin links are revoked
+	AdminLinkVersion int `dynamodbav:"adminLinkVersion,omitempty" json:"-"`
+	// PendingResetID is the snapshot of a reset that hasn't finished clearing, a retry without a ResetID reuses it
+	PendingResetID string `dynamodbav:"pendingResetID,omitempty" json:"-"`
+
+	// Invites are their own items, loaded with the room
+	Invites []Invite `dynamodbav:"-" json:"-"`
+	// Members are their own items too, the OwnerID isn't one of them
+	Members []Member `dynamodbav:"-" json:"-"`
+	// Role is the listing user's role, set by RoomsForUser
+	Role string `dynamodbav:"-" json:"role,omitempty"`
+
+	// Owner
+	Recurrence *recurrence.Rule `dynamodbav:"recurrence,omitempty" json:"recurrence,omitempty"`
+	Protected  bool             `dynamodbav:"-" json:"protected"`
+	// AllowedDomain rooms can only be opened by people signed in with an address there
+	AllowedDomain string `dynamodbav:"allowedDomain,omitempty" json:"allowedDomain,omitempty"`
+	// InviteOnly rooms can only be picked in by people with an invite link
+	InviteOnly bool `dynamodbav:"inviteOnly,omitempty" json:"inviteOnly"`
+	// DeletedAt is set while the room is tombstoned, it can be restored until ExpiresAt
+	DeletedAt *time.Time `dynamodbav:"deletedAt,omitempty" json:"deletedAt,omitempty"`
+	ExpiresAt int64      `dynamodbav:"expiresAt,omitempty" json:"-"`
 }
 
 type PublicRoom struct {
@@ -49,20 +136,188 @@ type PublicRoom struct {
 	Options   []option.PublicOption `json:"options"`
 	Question  string                `json:"question"`
 	OwnedByMe bool                  `json:"ownedByMe"`
+	Kind      string                `json:"kind"`
+	Grid      *grid.Grid            `json:"grid,omitempty"`
+	SeatMap   *seatmap.Layout       `json:"seatMap,omitempty"`
+	DisplayID string                `json:"displayID,omitempty"`
+	// RedirectedFrom lets old links update to the new ID
+	RedirectedFrom string `json:"redirectedFrom,omitempty"`
+	// Locked rooms need their passcode, or a sign in from AllowedDomain, before anything but the ID is shown
+	Locked        bool   `json:"locked,omitempty"`
+	AllowedDomain string `json:"allowedDomain,omitempty"`
+
+	InviteOnly bool `json:"inviteOnly,omitempty"`
+	// InvitedAs is the name on the user's invite, to fill in when they pick
+	InvitedAs string `json:"invitedAs,omitempty"`
+	// Role is the user's role in the room, if they have one
+	Role string `json:"role,omitempty"`
 }
 
 func (room Room) getPublic(userID string) PublicRoom {
-	publicOptions := option.MapToPublic(room.Options, userID)
+	// Members already see hidden options in the admin view
+	publicOptions := option.MapToPublic(room.Options, userID, room.Can(userID, RoleViewer))
+
+	invitedAs := ""
+	if invite := room.Invitee(userID); invite != nil {
+		invitedAs = invite.Name
+	}
 
 	return PublicRoom{
 		ID:        room.ID,
 		Options:   publicOptions,
 		Question:  room.Question,
-		OwnedByMe: room.OwnerID == userID,
+		OwnedByMe: room.RoleOf(userID) == RoleOwner,
+		Kind:      room.Kind,
+		Grid:      room.Grid,
+		SeatMap:   room.SeatMap,
+		DisplayID: room.DisplayID,
+
+		RedirectedFrom: room.RedirectedFrom,
+		InviteOnly:     room.InviteOnly,
+		InvitedAs:      invitedAs,
+		Role:           room.RoleOf(userID),
+		AllowedDomain:  room.AllowedDomain,
+	}
+}
+
+// CheckSelection enforces the room's selection rules before userID picks optionIDs.
+//
+// In a matrix room it returns writes to make in the same transaction as the picks, so two picks in a full row at once can't both get in
+func (room Room) CheckSelection(optionIDs []string, userID string, client *dynamodb.Client) ([]types.TransactWriteItem, error) {
+	for _, id := range optionIDs {
+		if room.Option(id) == nil {
+			return nil, ErrOptionNotFound
+		}
+	}
+
+	if room.SeatMap != nil {
+		return nil, room.checkSeats(optionIDs)
+	}
+
+	if room.Grid == nil {
+		return nil, nil
+	}
+
+	requested := map[string]bool{}
+	rows := map[int]bool{}
+	for _, id := range optionIDs {
+		requested[id] = true
+
+		if row := room.Option(id).Row; row != nil && room.Grid.MaxSelections(*row) > 0 {
+			rows[*row] = true
+		}
+	}
+
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	return room.checkRows(rows, requested, userID, client)
+}
+
+func (room Room) checkSeats(optionIDs []string) error {
+	var seats []seatmap.Cell
+
+	for _, id := range optionIDs {
+		opt := room.Option(id)
+
+		if opt.Row == nil || opt.Column == nil {
+			return ErrOptionNotFound
+		}
+
+		seats = append(seats, seatmap.Cell{Row: *opt.Row, Column: *opt.Column})
+	}
+
+	return room.SeatMap.CheckGroup(seats)
+}
+
+// Option finds one of the room's options by ID
+func (room Room) Option(optionID string) *option.Option {
+	for i := range room.Options {
+		if room.Options[i].ID == optionID {
+			return &room.Options[i]
+		}
+	}
+
+	return nil
+}
+
+// Group is the options userID picked together with optionID in a seat map, so they are released together
+func (room Room) Group(optionID string, userID string) []option.Option {
+	opt := room.Option(optionID)
+
+	if room.SeatMap == nil || opt == nil || opt.SelectionGroup == nil || opt.SelectedByID == nil || *opt.SelectedByID != userID {
+		return nil
 	}
+
+	var group []option.Option
+	for _, other := range room.Options {
+		if other.SelectionGroup != nil && *other.SelectionGroup == *opt.SelectionGroup && other.SelectedByID != nil && *other.SelectedByID == userID {
+			group = append(group, other)
+		}
+	}
+
+	return group
+}
+
+// NextPosition is the position for an option added to the end of the room
+func (room Room) NextPosition() int {
+	next := 0
+
+	for _, opt := range room.Options {
+		if opt.Position >= next {
+			next = opt.Position + 1
+		}
+	}
+
+	return next
 }
 
-func GetPublicRoom(id string, client *dynamodb.Client, userID string) (*PublicRoom, error) {
+// Reorder returns the options whose position has changed
+func (room Room) Reorder(optionIDs []string) ([]option.Option, error) {
+	options := make([]option.Option, len(room.Options))
+	copy(options, room.Options)
+	option.Sort(options)
+
+	index := map[string]int{}
+	for i, opt := range options {
+		index[opt.ID] = i
+	}
+
+	// Positions may not be unique yet (options created before ordering), so work off the sorted order
+	var slots []int
+	for _, id := range optionIDs {
+		i, ok := index[id]
+
+		if !ok {
+			return nil, ErrOptionNotFound
+		}
+
+		slots = append(slots, i)
+	}
+
+	sort.Ints(slots)
+
+	ordered := make([]option.Option, len(options))
+	copy(ordered, options)
+
+	for i, id := range optionIDs {
+		ordered[slots[i]] = options[index[id]]
+	}
+
+	var changed []option.Option
+	for i, opt := range ordered {
+		if opt.Position != i {
+			opt.Position = i
+			changed = append(changed, opt)
+		}
+	}
+
+	return changed, nil
+}
+
+// GetPublicRoom only shows a protected room to sessions that have unlocked it
+func GetPublicRoom(id string, client *dynamodb.Client, userID string, unlocked []string, verifiedEmail string) (*PublicRoom, error) {
 	room, err := GetRoom(id, client, userID)
 
 	if err != nil {
@@ -72,6 +327,19 @@ func GetPublicRoom(id string, client *dynamodb.Client, userID string) (*PublicRo
 	if room == nil {
 		return nil, nil
 	}
+
+	if !room.CanAccess(userID, unlocked, verifiedEmail) {
+		return &PublicRoom{
+			ID:             room.ID,
+			DisplayID:      room.DisplayID,
+			Options:        []option.PublicOption{},
+			Kind:           room.Kind,
+			RedirectedFrom: room.RedirectedFrom,
+			Locked:         true,
+			AllowedDomain:  room.AllowedDomain,
+		}, nil
+	}
+
 	publicRoom := room.getPublic(userID)
 
 	return &publicRoom, nil
@@ -84,22 +352,177 @@ func Unmarshal(item map[string]types.AttributeValue) Room {
 		panic(err)
 	}
 
+	room.Protected = room.AccessHash != ""
+
 	return *room
 }
 
+// Generated IDs rarely collide, this only stops a full word list looping forever
+const maxGenerateAttempts = 10
+
+// NewRoomWithGeneratedID tries generated IDs until one isn't taken
+func NewRoomWithGeneratedID(request *CreateRoomRequest, generate func() (string, error), userID string, client *dynamodb.Client) (*Room, error) {
+	for attempt := 0; attempt < maxGenerateAttempts; attempt++ {
+		id, err := generate()
+
+		if err != nil {
+			return nil, err
+		}
+
+		request.ID = id
+
+		room, err := NewRoom(request, userID, client)
+
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			continue
+		}
+
+		return room, err
+	}
+
+	return nil, ErrRoomIDTaken
+}
+
 func NewRoom(request *CreateRoomRequest, userID string, client *dynamodb.Client) (*Room, error) {
+	id := roomid.Canonical(request.ID)
+
+	var options []*option.Option
+	for _, opt := range request.Options {
+		newOpt := option.NewOption(opt, userID, id)
+		options = append(options, &newOpt)
+	}
+
+	kind := KindList
+	var matrix *grid.Grid
+
+	var seats *seatmap.Layout
+
+	if request.Matrix != nil && request.Seats != nil {
+		return nil, errors.New("a room can't be both a matrix and a seat map")
+	}
+
+	if request.Seats != nil {
+		if len(request.Options) > 0 || request.Slots != nil {
+			return nil, errors.New("a seat map room can't have other options")
+		}
+
+		layout, err := request.Seats.Layout()
+
+		if err != nil {
+			return nil, err
+		}
+
+		kind = KindSeats
+		seats = layout
+		options = option.NewSeatOptions(layout.Seats(), userID, id)
+	}
+
+	if request.Matrix != nil {
+		if len(request.Options) > 0 || request.Slots != nil {
+			return nil, errors.New("a matrix room can't have other options")
+		}
+
+		g, err := request.Matrix.Grid()
+
+		if err != nil {
+			return nil, err
+		}
+
+		kind = KindMatrix
+		matrix = g
+		options = option.NewGridOptions(g.Cells(), userID, id)
+	}
+
+	if request.Slots != nil {
+		slotOptions, err := option.NewSlotOptions(*request.Slots, userID, id)
+
+		if err != nil {
+			return nil, err
+		}
+
+		options = append(options, slotOptions...)
+	}
+
+	if len(options) == 0 {
+		return nil, errors.New("a room needs at least one option")
+	}
+
+	if len(options) > option.MaxPerRoom {
+		return nil, option.ErrTooManyOptions
+	}
+
+	for i, opt := range options {
+		opt.Position = i
+	}
+
 	createdAt := time.Now().UTC()
 
-	room := &Room{
-		PK:        fmt.Sprintf("ROOM#%s", request.ID),
-		SK:        fmt.Sprintf("ROOM#%s", request.ID),
+	var rule *recurrence.Rule
+
+	if request.Recurrence != nil {
+		r, err := request.Recurrence.Rule(createdAt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		rule = r
+	}
+
+	room := newRoom(request.ID, request.Question, userID, createdAt)
+	room.Kind = kind
+	room.Grid = matrix
+	room.SeatMap = seats
+	room.setRecurrence(rule)
+
+	err := put(room, options, client)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return room, nil
+}
+
+// newRoom keys the room by the canonical form of displayID
+func newRoom(displayID string, question string, userID string, createdAt time.Time) *Room {
+	id := roomid.Canonical(displayID)
+
+	return &Room{
+		PK:        fmt.Sprintf("ROOM#%s", id),
+		SK:        fmt.Sprintf("ROOM#%s", id),
 		Type:      dynamodbTypes.Room,
-		ID:        request.ID,
-		Question:  request.Question,
+		ID:        id,
+		DisplayID: displayID,
+		Question:  question,
 		OwnerID:   userID,
 		CreatedAt: createdAt,
 		GSI1PK:    fmt.Sprintf("USER#%s", userID),
-		GSI1SK:    fmt.Sprintf("ROOM#%s#%s", createdAt.Format(time.RFC3339), request.ID),
+		GSI1SK:    fmt.Sprintf("ROOM#%s#%s", createdAt.Format(time.RFC3339), id),
+	}
+}
+
+func (room *Room) setRecurrence(rule *recurrence.Rule) {
+	if rule == nil {
+		return
+	}
+
+	room.Recurrence = rule
+	room.GSI2PK = schedulePK
+	room.GSI2SK = scheduleSK(rule.NextRunAt, room.ID)
+}
+
+// put saves a new room and its options, failing if the ID is taken
+func put(room *Room, options []*option.Option, client *dynamodb.Client) error {
+	legacy, err := legacyTaken(room.DisplayID, client)
+
+	if err != nil {
+		return err
+	}
+
+	if legacy {
+		return ErrRoomIDTaken
 	}
 
 	marshalledRoom, marshallErr := attributevalue.MarshalMap(room)
@@ -108,32 +531,45 @@ func NewRoom(request *CreateRoomRequest, userID string, client *dynamodb.Client)
 		panic(marshallErr)
 	}
 
-	_, err := client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+	_, err = client.PutItem(context.TODO(), &dynamodb.PutItemInput{
 		TableName:           aws.String(os.Getenv("table")),
 		Item:                marshalledRoom,
 		ConditionExpression: aws.String("attribute_not_exists(PK) and attribute_not_exists(SK)"),
 	})
 
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var options []*option.Option
-	for _, opt := range request.Options {
-		newOpt := option.NewOption(opt, userID, request.ID)
-		options = append(options, &newOpt)
-	}
+	return option.BatchWriteOptions(options, client)
+}
 
-	err = option.BatchWriteOptions(options, client)
+// GetRoom follows the redirects left by renames, setting RedirectedFrom
+func GetRoom(id string, client *dynamodb.Client, userID string) (*Room, error) {
+	requested := id
 
-	if err != nil {
-		return nil, err
+	for hops := 0; hops <= maxRedirects; hops++ {
+		room, redirect, err := getRoom(id, client)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if redirect == nil {
+			if room != nil && id != requested {
+				room.RedirectedFrom = requested
+			}
+
+			return room, nil
+		}
+
+		id = redirect.To
 	}
 
-	return room, nil
+	return nil, nil
 }
 
-func GetRoom(id string, client *dynamodb.Client, userID string) (*Room, error) {
+func getRoom(id string, client *dynamodb.Client) (*Room, *Redirect, error) {
 	paginator := dynamodb.NewQueryPaginator(client, &dynamodb.QueryInput{
 		TableName:              aws.String(os.Getenv("table")),
 		KeyConditionExpression: aws.String("PK = :PK and begins_with(SK, :roomPrefix)"),
@@ -144,7 +580,10 @@ func GetRoom(id string, client *dynamodb.Client, userID string) (*Room, error) {
 	})
 
 	var room *Room
+	var redirect *Redirect
 	var options []option.Option = []option.Option{}
+	var invites []Invite = []Invite{}
+	var members []Member = []Member{}
 
 	for paginator.HasMorePages() {
 		out, err := paginator.NextPage(context.TODO())
@@ -154,6 +593,10 @@ func GetRoom(id string, client *dynamodb.Client, userID string) (*Room, error) {
 		}
 
 		for _, item := range out.Items {
+			if dynamodbTypes.Expired(item) {
+				continue
+			}
+
 			itemType := dynamodbTypes.GetType(item)
 
 			switch itemType {
@@ -162,32 +605,76 @@ func GetRoom(id string, client *dynamodb.Client, userID string) (*Room, error) {
 				room = &res
 			case dynamodbTypes.Option:
 				options = append(options, option.Unmarshal(item))
+			case dynamodbTypes.Invite:
+				invites = append(invites, UnmarshalInvite(item))
+			case dynamodbTypes.Member:
+				members = append(members, UnmarshalMember(item))
+			case dynamodbTypes.Redirect:
+				res := UnmarshalRedirect(item)
+				redirect = &res
 			default:
 				log.Default().Printf("%s missing", itemType)
 			}
 		}
 	}
 
-	if room == nil {
-		return nil, nil
+	if redirect != nil {
+		return nil, redirect, nil
+	}
+
+	// Deleted rooms can only be restored
+	if room == nil || room.DeletedAt != nil {
+		return nil, nil, nil
 	}
 
-	room.Options = options
+	if room.Kind == "" {
+		room.Kind = KindList
+	}
 
-	return room, nil
+	option.Sort(options)
+
+	for _, opt := range options {
+		if opt.DeletedAt == nil {
+			room.Options = append(room.Options, opt)
+		} else {
+			room.DeletedOptions = append(room.DeletedOptions, opt)
+		}
+	}
+
+	if room.Options == nil {
+		room.Options = []option.Option{}
+	}
+
+	room.Invites = invites
+	room.Members = members
+
+	return room, nil, nil
 }
 
-func RoomsForUser(userID string, client *dynamodb.Client) (*[]Room, error) {
+// RoomsForUser lists either the user's rooms or the rooms they have deleted
+func RoomsForUser(userID string, deleted bool, client *dynamodb.Client) (*[]Room, error) {
+	filter := "attribute_not_exists(deletedAt)"
+	if deleted {
+		filter = "attribute_exists(deletedAt) and expiresAt > :now"
+	}
+
+	values := map[string]types.AttributeValue{
+		":GSI1PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", userID)},
+		":room":   &types.AttributeValueMemberS{Value: "ROOM#"},
+	}
+
+	if deleted {
+		values[":now"] = &types.AttributeValueMemberN{Value: fmt.Sprint(time.Now().Unix())}
+	}
+
 	paginator := dynamodb.NewQueryPaginator(client, &dynamodb.QueryInput{
 		TableName: aws.String(os.Getenv("table")),
 		IndexName: aws.String("GSI1"),
 		// Get the most recent first
-		ScanIndexForward:       aws.Bool(false),
-		KeyConditionExpression: aws.String("GSI1PK = :GSI1PK and begins_with(GSI1SK, :room)"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":GSI1PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", userID)},
-			":room":   &types.AttributeValueMemberS{Value: "ROOM#"},
-		},
+		ScanIndexForward:          aws.Bool(false),
+		KeyConditionExpression:    aws.String("GSI1PK = :GSI1PK and begins_with(GSI1SK, :room)"),
+		FilterExpression:          aws.String(filter),
+		ExpressionAttributeValues: values,
 	})
 
 	var rooms []Room = []Room{}
@@ -200,11 +687,41 @@ func RoomsForUser(userID string, client *dynamodb.Client) (*[]Room, error) {
 		}
 
 		for _, item := range out.Items {
-			rooms = append(rooms, Unmarshal(item))
+			// Rooms shared with the user are listed through their membership
+			if dynamodbTypes.GetType(item) == dynamodbTypes.Member {
+				member := UnmarshalMember(item)
+				rooms = append(rooms, Room{ID: member.RoomID, Role: member.Role})
+				continue
+			}
+
+			room := Unmarshal(item)
+			room.Role = RoleOwner
+			rooms = append(rooms, room)
 		}
 	}
 
-	return &rooms, nil
+	shared, err := sharedRooms(rooms, client)
+
+	if err != nil {
+		return nil, err
+	}
+
+	listed := []Room{}
+
+	for _, room := range rooms {
+		if room.PK != "" {
+			listed = append(listed, room)
+			continue
+		}
+
+		// Shared rooms that have been deleted are left out
+		if sharedRoom, ok := shared[room.ID]; ok {
+			sharedRoom.Role = room.Role
+			listed = append(listed, sharedRoom)
+		}
+	}
+
+	return &listed, nil
 }
 
 func Update(userID string, roomID string, request UpdateRoomRequest, client *dynamodb.Client) (*Room, error) {
@@ -231,3 +748,263 @@ func Update(userID string, roomID string, request UpdateRoomRequest, client *dyn
 
 	return &updatedRoom, nil
 }
+
+// Exists is true for any room item, including deleted rooms which still hold their ID
+func Exists(id string, client *dynamodb.Client) (bool, error) {
+	res, err := client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(os.Getenv("table")),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", id)},
+			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", id)},
+		},
+	})
+
+	if err != nil {
+		return false, err
+	}
+
+	return res.Item != nil, nil
+}
+
+// Delete tombstones the room then everything in its partition, it is safe to retry
+func Delete(roomID string, userID string, client *dynamodb.Client) (*Room, error) {
+	now := time.Now()
+
+	res, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(os.Getenv("table")),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+		},
+		// A retry keeps the original expiry so the items in the partition all match
+		UpdateExpression: aws.String("set deletedAt = if_not_exists(deletedAt, :now), expiresAt = if_not_exists(expiresAt, :expiresAt)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userID":    &types.AttributeValueMemberS{Value: userID},
+			":now":       &types.AttributeValueMemberS{Value: now.UTC().Format(time.RFC3339)},
+			":expiresAt": &types.AttributeValueMemberN{Value: fmt.Sprint(dynamodbTypes.ExpiresAt(now))},
+		},
+		ConditionExpression: aws.String("ownerID = :userID and attribute_exists(PK) and attribute_exists(SK)"),
+		ReturnValues:        types.ReturnValueAllNew,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	deletedRoom := Unmarshal(res.Attributes)
+
+	// Items that already expire (deleted options) keep their own expiry
+	err = forEachInPartition(roomID, client, func(key map[string]types.AttributeValue) error {
+		return updateIgnoringCondition(key, "set expiresAt = :expiresAt", "attribute_not_exists(expiresAt)", map[string]types.AttributeValue{
+			":expiresAt": &types.AttributeValueMemberN{Value: fmt.Sprint(deletedRoom.ExpiresAt)},
+		}, client)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &deletedRoom, nil
+}
+
+// Restore brings back the partition then the room, so a retry can still find the room's expiry
+func Restore(roomID string, userID string, client *dynamodb.Client) (*Room, error) {
+	res, err := client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(os.Getenv("table")),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+		},
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Item == nil || dynamodbTypes.Expired(res.Item) {
+		return nil, ErrRoomNotFound
+	}
+
+	deletedRoom := Unmarshal(res.Item)
+
+	if deletedRoom.OwnerID != userID || deletedRoom.DeletedAt == nil {
+		return nil, ErrRoomNotFound
+	}
+
+	// Only items that expire with the room, options deleted on their own stay deleted
+	err = forEachInPartition(roomID, client, func(key map[string]types.AttributeValue) error {
+		return updateIgnoringCondition(key, "remove expiresAt", "expiresAt = :expiresAt and attribute_not_exists(deletedAt)", map[string]types.AttributeValue{
+			":expiresAt": &types.AttributeValueMemberN{Value: fmt.Sprint(deletedRoom.ExpiresAt)},
+		}, client)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	updated, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(os.Getenv("table")),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+		},
+		UpdateExpression: aws.String("remove deletedAt, expiresAt"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userID": &types.AttributeValueMemberS{Value: userID},
+		},
+		ConditionExpression: aws.String("ownerID = :userID and attribute_exists(PK) and attribute_exists(SK)"),
+		ReturnValues:        types.ReturnValueAllNew,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	restoredRoom := Unmarshal(updated.Attributes)
+
+	return &restoredRoom, nil
+}
+
+// forEachInPartition calls fn with the key of every item in the room's partition except the room itself
+func forEachInPartition(roomID string, client *dynamodb.Client, fn func(key map[string]types.AttributeValue) error) error {
+	paginator := dynamodb.NewQueryPaginator(client, &dynamodb.QueryInput{
+		TableName:              aws.String(os.Getenv("table")),
+		KeyConditionExpression: aws.String("PK = :PK"),
+		ProjectionExpression:   aws.String("PK, SK"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+		},
+	})
+
+	roomSK := fmt.Sprintf("ROOM#%s", roomID)
+
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(context.TODO())
+
+		if err != nil {
+			return err
+		}
+
+		for _, item := range out.Items {
+			if sk, ok := item["SK"].(*types.AttributeValueMemberS); ok && sk.Value == roomSK {
+				continue
+			}
+
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// updateIgnoringCondition treats a failed condition as already done
+func updateIgnoringCondition(key map[string]types.AttributeValue, update string, condition string, values map[string]types.AttributeValue, client *dynamodb.Client) error {
+	_, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(os.Getenv("table")),
+		Key:                       key,
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeValues: values,
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return nil
+	}
+
+	return err
+}
+
+// Reset clears every selection in the room, optionally saving the results first
+func (room Room) Reset(request ResetRequest, client *dynamodb.Client) (*ResetResult, error) {
+	result := &ResetResult{}
+
+	if request.Snapshot {
+		resetID := request.ResetID
+		if resetID == "" {
+			pending, err := room.pendingReset(client)
+
+			if err != nil {
+				return nil, err
+			}
+
+			resetID = pending
+		}
+
+		var options []option.Option
+		for _, opt := range room.Options {
+			if opt.DeletedAt == nil {
+				options = append(options, opt)
+			}
+		}
+
+		saved, err := snapshot.New(resetID, room.ID, room.Question, request.Label, options, client)
+
+		if err != nil {
+			return nil, err
+		}
+
+		result.Snapshot = saved
+	}
+
+	cleared, err := option.ClearSelections(room.ID, client)
+	result.Cleared = cleared
+
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Snapshot != nil && request.ResetID == "" {
+		err = updateIgnoringCondition(
+			map[string]types.AttributeValue{
+				"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", room.ID)},
+				"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", room.ID)},
+			},
+			"remove pendingResetID",
+			"pendingResetID = :resetID",
+			map[string]types.AttributeValue{
+				":resetID": &types.AttributeValueMemberS{Value: result.Snapshot.ID},
+			},
+			client,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// pendingReset marks the room with a new reset ID unless an earlier reset didn't finish, then its ID is kept
+func (room Room) pendingReset(client *dynamodb.Client) (string, error) {
+	res, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(os.Getenv("table")),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", room.ID)},
+			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", room.ID)},
+		},
+		UpdateExpression: aws.String("set pendingResetID = if_not_exists(pendingResetID, :resetID)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":resetID": &types.AttributeValueMemberS{Value: uuid.NewV4().String()},
+		},
+		ConditionExpression: aws.String("attribute_exists(PK) and attribute_exists(SK)"),
+		ReturnValues:        types.ReturnValueUpdatedNew,
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	pending := struct {
+		PendingResetID string `dynamodbav:"pendingResetID"`
+	}{}
+
+	if err := attributevalue.UnmarshalMap(res.Attributes, &pending); err != nil {
+		panic(err)
+	}
+
+	return pending.PendingResetID, nil
+}
@@ -0,0 +1,165 @@
+package room
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"picker/backend/go/pkg/dynamodbTypes"
+	"picker/backend/go/pkg/option"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Guards only have to outlast the requests that read them, the TTL tidies them up after that
+const rowGuardTTL = 24 * time.Hour
+
+// rowGuard is bumped in the same transaction as every pick a user makes in a row with a limit.
+//
+// The limit is counted from the options, the guard makes the pick fail if another of the user's picks in the row
+// was written after it was counted.
+type rowGuard struct {
+	PK        string `dynamodbav:"PK"`
+	SK        string `dynamodbav:"SK"`
+	Type      string `dynamodbav:"type"`
+	Version   int    `dynamodbav:"version"`
+	ExpiresAt int64  `dynamodbav:"expiresAt"`
+}
+
+func rowGuardKey(roomID string, row int, userID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+		"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROWGUARD#%d#%s", row, userID)},
+	}
+}
+
+// checkRows counts userID's picks in each row again from a consistent read, with the guards read before it
+func (room Room) checkRows(rows map[int]bool, requested map[string]bool, userID string, client *dynamodb.Client) ([]types.TransactWriteItem, error) {
+	var guards []types.TransactWriteItem
+
+	// The guards have to be read first, a pick written after this is either in the options below or fails the guard
+	for row := range rows {
+		guard, err := bumpRowGuard(room.ID, row, userID, client)
+
+		if err != nil {
+			return nil, err
+		}
+
+		guards = append(guards, *guard)
+	}
+
+	options, err := consistentOptions(room.ID, client)
+
+	if err != nil {
+		return nil, err
+	}
+
+	picked := map[int]int{}
+	for _, opt := range options {
+		if opt.Row == nil || !rows[*opt.Row] {
+			continue
+		}
+
+		mine := opt.SelectedByID != nil && *opt.SelectedByID == userID
+
+		if mine || requested[opt.ID] {
+			picked[*opt.Row]++
+		}
+	}
+
+	for row, count := range picked {
+		if count > room.Grid.MaxSelections(row) {
+			return nil, ErrRowLimit
+		}
+	}
+
+	return guards, nil
+}
+
+// bumpRowGuard reads the guard and returns the write that moves it on, conditional on it not having moved since
+func bumpRowGuard(roomID string, row int, userID string, client *dynamodb.Client) (*types.TransactWriteItem, error) {
+	key := rowGuardKey(roomID, row, userID)
+
+	res, err := client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName:      aws.String(os.Getenv("table")),
+		ConsistentRead: aws.Bool(true),
+		Key:            key,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	guard := rowGuard{}
+	condition := "attribute_not_exists(PK)"
+	values := map[string]types.AttributeValue{}
+
+	if res.Item != nil {
+		if err := attributevalue.UnmarshalMap(res.Item, &guard); err != nil {
+			panic(err)
+		}
+
+		condition = "version = :version"
+		values[":version"] = &types.AttributeValueMemberN{Value: fmt.Sprint(guard.Version)}
+	}
+
+	guard.PK = key["PK"].(*types.AttributeValueMemberS).Value
+	guard.SK = key["SK"].(*types.AttributeValueMemberS).Value
+	guard.Type = dynamodbTypes.RowGuard
+	guard.Version++
+	guard.ExpiresAt = time.Now().Add(rowGuardTTL).Unix()
+
+	item, err := attributevalue.MarshalMap(guard)
+
+	if err != nil {
+		panic(err)
+	}
+
+	put := &types.Put{
+		TableName:           aws.String(os.Getenv("table")),
+		Item:                item,
+		ConditionExpression: aws.String(condition),
+	}
+
+	if len(values) > 0 {
+		put.ExpressionAttributeValues = values
+	}
+
+	return &types.TransactWriteItem{Put: put}, nil
+}
+
+// consistentOptions is the room's options as they are now, getRoom's read can be behind
+func consistentOptions(roomID string, client *dynamodb.Client) ([]option.Option, error) {
+	options := []option.Option{}
+
+	paginator := dynamodb.NewQueryPaginator(client, &dynamodb.QueryInput{
+		TableName:              aws.String(os.Getenv("table")),
+		ConsistentRead:         aws.Bool(true),
+		KeyConditionExpression: aws.String("PK = :PK and begins_with(SK, :option)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":PK":     &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+			":option": &types.AttributeValueMemberS{Value: "ROOM_OPTION#"},
+		},
+	})
+
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(context.TODO())
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range out.Items {
+			opt := option.Unmarshal(item)
+
+			if opt.DeletedAt == nil {
+				options = append(options, opt)
+			}
+		}
+	}
+
+	return options, nil
+}
@@ -0,0 +1,300 @@
+package room
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"picker/backend/go/pkg/dynamodbTypes"
+	"picker/backend/go/pkg/signing"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/twinj/uuid"
+)
+
+// Transfer links stop working after this long, the table's TTL removes them
+const transferTTL = 24 * time.Hour
+
+var ErrTransferNotFound = errors.New("transfer link is invalid, used or expired")
+var ErrTransferInProgress = errors.New("room is already being transferred")
+var ErrTransferToSelf = errors.New("room is already owned by this user")
+
+type RedeemTransferRequest struct {
+	Token string `json:"token" binding:"required,max=500"`
+}
+
+// Transfer is kept outside the ROOM_ prefix so it isn't loaded with the room
+type Transfer struct {
+	// DynamoDB
+	PK        string `dynamodbav:"PK"`
+	SK        string `dynamodbav:"SK"`
+	Type      string `dynamodbav:"type"`
+	ExpiresAt int64  `dynamodbav:"expiresAt"`
+
+	ID        string    `dynamodbav:"id"`
+	RoomID    string    `dynamodbav:"roomID"`
+	FromID    string    `dynamodbav:"fromID"`
+	CreatedAt time.Time `dynamodbav:"createdAt"`
+}
+
+type TransferLink struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// CreateTransfer makes a single use link that hands the room to whoever redeems it
+func (room Room) CreateTransfer(secret string, client *dynamodb.Client) (*TransferLink, error) {
+	createdAt := time.Now().UTC()
+	expiresAt := createdAt.Add(transferTTL)
+	id := uuid.NewV4().String()
+
+	transfer := Transfer{
+		PK:        room.PK,
+		SK:        fmt.Sprintf("TRANSFER#%s", id),
+		Type:      dynamodbTypes.Transfer,
+		ExpiresAt: expiresAt.Unix(),
+		ID:        id,
+		RoomID:    room.ID,
+		FromID:    room.OwnerID,
+		CreatedAt: createdAt,
+	}
+
+	item, err := attributevalue.MarshalMap(transfer)
+
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName: aws.String(os.Getenv("table")),
+		Item:      item,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &TransferLink{
+		Token:     signing.Sign(secret, fmt.Sprintf("transfer:%s:%s", room.ID, id)),
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+// RedeemTransfer makes userID the room's owner.
+//
+// The room changes hands and the link is used up in a single transaction, then each option is moved over.
+// Redeeming the same link again carries on from wherever it stopped.
+func RedeemTransfer(roomID string, token string, userID string, secret string, client *dynamodb.Client) (*Room, error) {
+	payload, err := signing.Verify(secret, token)
+
+	if err != nil {
+		return nil, ErrTransferNotFound
+	}
+
+	parts := strings.Split(payload, ":")
+
+	if len(parts) != 3 || parts[0] != "transfer" {
+		return nil, ErrTransferNotFound
+	}
+
+	// Links made before a rename name the room's old ID, the transfer moved with the room
+	resolved, err := GetRoom(roomID, client, userID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resolved == nil {
+		return nil, ErrRoomNotFound
+	}
+
+	if !resolved.KnownAs(parts[1]) {
+		return nil, ErrTransferNotFound
+	}
+
+	roomID = resolved.ID
+
+	res, err := client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName:      aws.String(os.Getenv("table")),
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+		},
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Item == nil || dynamodbTypes.Expired(res.Item) || dynamodbTypes.GetType(res.Item) != dynamodbTypes.Room {
+		return nil, ErrRoomNotFound
+	}
+
+	current := Unmarshal(res.Item)
+
+	if current.DeletedAt != nil {
+		return nil, ErrRoomNotFound
+	}
+
+	if current.TransferringFrom != "" {
+		if current.OwnerID != userID {
+			return nil, ErrTransferInProgress
+		}
+
+		err = finishTransfer(roomID, current.TransferringFrom, userID, client)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return GetRoom(roomID, client, userID)
+	}
+
+	if current.OwnerID == userID {
+		return nil, ErrTransferToSelf
+	}
+
+	if current.RenamingTo != "" || current.RenamingFrom != "" {
+		return nil, ErrRenameInProgress
+	}
+
+	err = claimTransfer(current, parts[2], userID, client)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = finishTransfer(roomID, current.OwnerID, userID, client)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return GetRoom(roomID, client, userID)
+}
+
+// claimTransfer uses up the link and gives the room to userID, listing it under them as their newest room
+func claimTransfer(current Room, transferID string, userID string, client *dynamodb.Client) error {
+	now := time.Now().UTC()
+
+	listing := fmt.Sprintf("ROOM#%s#%s", now.Format(time.RFC3339), current.ID)
+
+	_, err := client.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{
+		TransactItems: append([]types.TransactWriteItem{
+			{
+				Delete: &types.Delete{
+					TableName: aws.String(os.Getenv("table")),
+					Key: map[string]types.AttributeValue{
+						"PK": &types.AttributeValueMemberS{Value: current.PK},
+						"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("TRANSFER#%s", transferID)},
+					},
+					ConditionExpression: aws.String("fromID = :from and expiresAt > :now"),
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":from": &types.AttributeValueMemberS{Value: current.OwnerID},
+						":now":  &types.AttributeValueMemberN{Value: fmt.Sprint(now.Unix())},
+					},
+				},
+			},
+		}, handOver(current, userID, listing, false)...),
+	})
+
+	var cancelled *types.TransactionCanceledException
+	if errors.As(err, &cancelled) {
+		return ErrTransferNotFound
+	}
+
+	return err
+}
+
+// handOver gives the room to userID and marks it until finishTransfer has moved the options,
+// only merging a user's rooms hands over deleted ones.
+//
+// The previous owner isn't kept as a member, a transfer link is the owner giving the room away
+// and the new owner can add them back with an admin link.
+func handOver(current Room, userID string, listing string, includeDeleted bool) []types.TransactWriteItem {
+	condition := "ownerID = :from and attribute_not_exists(renamingTo) and attribute_not_exists(renamingFrom)"
+
+	if !includeDeleted {
+		condition += " and attribute_not_exists(deletedAt)"
+	}
+
+	return []types.TransactWriteItem{
+		{
+			Update: &types.Update{
+				TableName: aws.String(os.Getenv("table")),
+				Key: map[string]types.AttributeValue{
+					"PK": &types.AttributeValueMemberS{Value: current.PK},
+					"SK": &types.AttributeValueMemberS{Value: current.SK},
+				},
+				UpdateExpression: aws.String("set ownerID = :to, GSI1PK = :GSI1PK, GSI1SK = :GSI1SK, transferringFrom = :from"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":to":     &types.AttributeValueMemberS{Value: userID},
+					":from":   &types.AttributeValueMemberS{Value: current.OwnerID},
+					":GSI1PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", userID)},
+					":GSI1SK": &types.AttributeValueMemberS{Value: listing},
+				},
+				ConditionExpression: aws.String(condition),
+			},
+		},
+		{
+			// The new owner doesn't need their old membership
+			Delete: &types.Delete{
+				TableName: aws.String(os.Getenv("table")),
+				Key: map[string]types.AttributeValue{
+					"PK": &types.AttributeValueMemberS{Value: current.PK},
+					"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM_MEMBER#%s", userID)},
+				},
+			},
+		},
+	}
+}
+
+// finishTransfer moves the options still owned by the old owner, then unmarks the room
+func finishTransfer(roomID string, fromID string, toID string, client *dynamodb.Client) error {
+	paginator := dynamodb.NewQueryPaginator(client, &dynamodb.QueryInput{
+		TableName:              aws.String(os.Getenv("table")),
+		ConsistentRead:         aws.Bool(true),
+		KeyConditionExpression: aws.String("PK = :PK and begins_with(SK, :optionPrefix)"),
+		FilterExpression:       aws.String("ownedByID = :from"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":PK":           &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+			":optionPrefix": &types.AttributeValueMemberS{Value: "ROOM_OPTION#"},
+			":from":         &types.AttributeValueMemberS{Value: fromID},
+		},
+	})
+
+	values := map[string]types.AttributeValue{
+		":from": &types.AttributeValueMemberS{Value: fromID},
+		":to":   &types.AttributeValueMemberS{Value: toID},
+	}
+
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(context.TODO())
+
+		if err != nil {
+			return err
+		}
+
+		for _, item := range out.Items {
+			err := updateIgnoringCondition(map[string]types.AttributeValue{
+				"PK": item["PK"],
+				"SK": item["SK"],
+			}, "set ownedByID = :to", "ownedByID = :from", values, client)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return updateIgnoringCondition(map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+		"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+	}, "remove transferringFrom", "transferringFrom = :from and ownerID = :to", values, client)
+}
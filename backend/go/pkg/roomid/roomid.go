@@ -0,0 +1,102 @@
+package roomid
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	ReasonTaken    = "taken"
+	ReasonReserved = "reserved"
+	ReasonBlocked  = "blocked"
+)
+
+// Names used by the site's own routes, or that would look official
+var defaultReserved = []string{
+	"admin", "administrator", "api", "app", "about", "assets", "auth", "help", "login", "logout",
+	"new", "null", "official", "pair", "publicroom", "room", "rooms", "sessions", "settings", "signin", "signup",
+	"static", "support", "system", "template", "templates", "tokens", "undefined", "www",
+}
+
+var defaultBlocked = []string{
+	"fuck", "shit", "cunt", "bitch", "wank", "twat", "bollock", "arsehole", "asshole", "dickhead",
+}
+
+// Checker knows which room IDs can't be used, on top of the ones already taken
+type Checker struct {
+	reserved map[string]bool
+	blocked  []string
+}
+
+// New adds the comma separated reserved names and blocked words to the defaults
+func New(reserved string, blocked string) *Checker {
+	checker := &Checker{reserved: map[string]bool{}}
+
+	for _, name := range append(defaultReserved, split(reserved)...) {
+		checker.reserved[Canonical(name)] = true
+	}
+
+	for _, word := range append(defaultBlocked, split(blocked)...) {
+		checker.blocked = append(checker.blocked, Canonical(word))
+	}
+
+	return checker
+}
+
+// Valid IDs are letters and numbers, optionally split up by single hyphens like brave-otter-42
+var valid = regexp.MustCompile(`^[a-zA-Z0-9]+(-[a-zA-Z0-9]+)*$`)
+
+func Valid(id string) bool {
+	return valid.MatchString(id)
+}
+
+// Canonical is how a room ID is stored, IDs differing only by case are the same room
+func Canonical(id string) string {
+	return strings.ToLower(id)
+}
+
+// Check gives the reason id can't be used, or "" if it can
+func (checker *Checker) Check(id string) string {
+	canonical := Canonical(id)
+
+	if checker.reserved[canonical] {
+		return ReasonReserved
+	}
+
+	// Blocked words are matched anywhere in the ID since there are no spaces to split on
+	for _, word := range checker.blocked {
+		if strings.Contains(canonical, word) {
+			return ReasonBlocked
+		}
+	}
+
+	return ""
+}
+
+// Candidates are alternatives to id to try, in the order they should be offered
+func (checker *Checker) Candidates(id string) []string {
+	var candidates []string
+
+	for _, suffix := range []string{"2", "3", "4", "5", "team", "group", "room"} {
+		candidate := fmt.Sprintf("%s%s", id, suffix)
+
+		if checker.Check(candidate) == "" {
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	return candidates
+}
+
+func split(list string) []string {
+	var values []string
+
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
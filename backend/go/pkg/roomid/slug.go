@@ -0,0 +1,100 @@
+package roomid
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Digits that can't be mistaken for letters, 0 and 1 look like o and l
+const slugDigits = "23456789"
+
+// Word lists where nearly every slug is blocked give up instead of looping forever
+const maxSlugAttempts = 100
+
+var ErrNoSlug = errors.New("no allowed room ID could be generated")
+
+var defaultAdjectives = []string{
+	"brave", "calm", "clever", "cosy", "eager", "fancy", "fuzzy", "gentle", "giant", "happy",
+	"humble", "jolly", "keen", "lucky", "mellow", "merry", "mighty", "nimble", "noble", "patient",
+	"proud", "quick", "quiet", "rapid", "ready", "shiny", "sunny", "swift", "tidy", "tiny",
+	"vivid", "warm", "wise", "witty", "zesty", "bold", "bright", "cheery", "dapper", "snappy",
+}
+
+var defaultNouns = []string{
+	"otter", "panda", "badger", "beaver", "bison", "camel", "cheetah", "dingo", "eagle", "falcon",
+	"ferret", "gecko", "heron", "koala", "lemur", "magpie", "marmot", "moose", "narwhal", "owl",
+	"parrot", "penguin", "puffin", "quokka", "rabbit", "raven", "salmon", "seal", "sparrow", "tiger",
+	"turtle", "walrus", "wombat", "yak", "zebra", "kiwi", "hawk", "fox", "emu", "wren",
+}
+
+// Generator makes readable room IDs like brave-otter-42
+type Generator struct {
+	adjectives []string
+	nouns      []string
+	checker    *Checker
+}
+
+// NewGenerator uses the comma separated word lists, or the built in ones when a list is empty
+func NewGenerator(adjectives string, nouns string, checker *Checker) *Generator {
+	generator := &Generator{
+		adjectives: words(adjectives, defaultAdjectives, checker),
+		nouns:      words(nouns, defaultNouns, checker),
+		checker:    checker,
+	}
+
+	return generator
+}
+
+// Generate picks a slug, it isn't checked against existing rooms
+func (generator *Generator) Generate() (string, error) {
+	for attempt := 0; attempt < maxSlugAttempts; attempt++ {
+		slug := fmt.Sprintf("%s-%s-%c%c",
+			pick(generator.adjectives),
+			pick(generator.nouns),
+			slugDigits[randomInt(len(slugDigits))],
+			slugDigits[randomInt(len(slugDigits))],
+		)
+
+		if generator.checker.Check(slug) == "" {
+			return slug, nil
+		}
+	}
+
+	return "", ErrNoSlug
+}
+
+// words keeps the lowercase letter only words that aren't blocked, falling back to the defaults if none are left
+func words(list string, defaults []string, checker *Checker) []string {
+	var kept []string
+
+	for _, word := range split(list) {
+		word = Canonical(word)
+
+		if strings.Trim(word, "abcdefghijklmnopqrstuvwxyz") == "" && checker.Check(word) == "" {
+			kept = append(kept, word)
+		}
+	}
+
+	if len(kept) == 0 {
+		return defaults
+	}
+
+	return kept
+}
+
+func pick(words []string) string {
+	return words[randomInt(len(words))]
+}
+
+func randomInt(n int) int {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+
+	if err != nil {
+		panic(err)
+	}
+
+	return int(i.Int64())
+}
@@ -0,0 +1,196 @@
+package seatmap
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const maxSize = 100
+
+var ErrGroupSize = errors.New("the wrong number of seats were picked")
+var ErrNotAdjacent = errors.New("seats must be next to each other in the same row")
+
+// GridCell is a cell in the JSON layout format, a null cell is a gap
+type GridCell struct {
+	Label   string `json:"label" binding:"max=20"`
+	Blocked bool   `json:"blocked"`
+}
+
+// Spec imports a layout from either a text grid or a JSON grid.
+//
+// The text grid has one line per row, "o" is a seat, "x" is a blocked seat and "." or " " is a gap, e.g.
+//
+//	ooo.ooo
+//	oxo.ooo
+//
+// Seats without labels are named by row letter and seat number, A1, A2...
+type Spec struct {
+	Text      string        `json:"text" binding:"required_without=Grid,omitempty,max=20000"`
+	Grid      [][]*GridCell `json:"grid" binding:"omitempty,lt=100,dive,lt=100,dive"`
+	GroupSize int           `json:"groupSize" binding:"min=0,max=25"`
+	Adjacent  bool          `json:"adjacent"`
+}
+
+type Cell struct {
+	Row     int    `json:"row" dynamodbav:"row"`
+	Column  int    `json:"column" dynamodbav:"column"`
+	Label   string `json:"label" dynamodbav:"label"`
+	Blocked bool   `json:"blocked,omitempty" dynamodbav:"blocked,omitempty"`
+}
+
+type Layout struct {
+	Rows    int `json:"rows" dynamodbav:"rows"`
+	Columns int `json:"columns" dynamodbav:"columns"`
+	// Gaps are left out, so clients draw anything missing as empty space
+	Cells []Cell `json:"cells" dynamodbav:"cells"`
+	// GroupSize is how many seats must be picked together, 0 is any number
+	GroupSize int `json:"groupSize,omitempty" dynamodbav:"groupSize,omitempty"`
+	// Adjacent seats picked together must be next to each other in one row
+	Adjacent bool `json:"adjacent,omitempty" dynamodbav:"adjacent,omitempty"`
+}
+
+func (spec Spec) Layout() (*Layout, error) {
+	grid := spec.Grid
+
+	if spec.Text != "" {
+		parsed, err := parseText(spec.Text)
+
+		if err != nil {
+			return nil, err
+		}
+
+		grid = parsed
+	}
+
+	if len(grid) > maxSize {
+		return nil, fmt.Errorf("a layout can have at most %d rows", maxSize)
+	}
+
+	layout := &Layout{
+		Rows:      len(grid),
+		GroupSize: spec.GroupSize,
+		Adjacent:  spec.Adjacent,
+	}
+
+	for r, row := range grid {
+		if len(row) > maxSize {
+			return nil, fmt.Errorf("a layout can have at most %d columns", maxSize)
+		}
+
+		if len(row) > layout.Columns {
+			layout.Columns = len(row)
+		}
+
+		seat := 0
+
+		for c, cell := range row {
+			if cell == nil {
+				continue
+			}
+
+			seat++
+
+			label := cell.Label
+			if label == "" {
+				label = fmt.Sprintf("%s%d", rowName(r), seat)
+			}
+
+			layout.Cells = append(layout.Cells, Cell{
+				Row:     r,
+				Column:  c,
+				Label:   label,
+				Blocked: cell.Blocked,
+			})
+		}
+	}
+
+	if len(layout.Seats()) == 0 {
+		return nil, errors.New("a layout needs at least one seat")
+	}
+
+	return layout, nil
+}
+
+// Seats are the cells that can be picked
+func (layout Layout) Seats() []Cell {
+	var seats []Cell
+
+	for _, cell := range layout.Cells {
+		if !cell.Blocked {
+			seats = append(seats, cell)
+		}
+	}
+
+	return seats
+}
+
+// CheckGroup enforces the layout's group rules on seats picked together
+func (layout Layout) CheckGroup(seats []Cell) error {
+	if layout.GroupSize > 0 && len(seats) != layout.GroupSize {
+		return ErrGroupSize
+	}
+
+	if !layout.Adjacent || len(seats) < 2 {
+		return nil
+	}
+
+	columns := make([]int, len(seats))
+
+	for i, seat := range seats {
+		if seat.Row != seats[0].Row {
+			return ErrNotAdjacent
+		}
+
+		columns[i] = seat.Column
+	}
+
+	sort.Ints(columns)
+
+	// Gaps and blocked seats aren't options, so consecutive columns means nothing is in between
+	for i := 1; i < len(columns); i++ {
+		if columns[i] != columns[i-1]+1 {
+			return ErrNotAdjacent
+		}
+	}
+
+	return nil
+}
+
+func parseText(text string) ([][]*GridCell, error) {
+	var grid [][]*GridCell
+
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		var row []*GridCell
+
+		for _, char := range strings.TrimRight(line, "\r") {
+			switch char {
+			case 'o', 'O':
+				row = append(row, &GridCell{})
+			case 'x', 'X':
+				row = append(row, &GridCell{Blocked: true})
+			case '.', ' ':
+				row = append(row, nil)
+			default:
+				return nil, fmt.Errorf("unknown seat %q, use o for a seat, x for a blocked seat or . for a gap", char)
+			}
+		}
+
+		grid = append(grid, row)
+	}
+
+	return grid, nil
+}
+
+// rowName is A-Z then AA, AB...
+func rowName(row int) string {
+	name := ""
+
+	for row >= 0 {
+		name = string(rune('A'+row%26)) + name
+		row = row/26 - 1
+	}
+
+	return name
+}
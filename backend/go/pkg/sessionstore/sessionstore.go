@@ -0,0 +1,670 @@
+package sessionstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"picker/backend/go/pkg/dynamodbTypes"
+	"picker/backend/go/pkg/signing"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/gin-contrib/sessions"
+	"github.com/gorilla/securecookie"
+	gsessions "github.com/gorilla/sessions"
+	"github.com/twinj/uuid"
+)
+
+const (
+	// IdleTTL signs a session out when it hasn't been used for this long
+	IdleTTL = 30 * 24 * time.Hour
+	// AbsoluteTTL signs a session out this long after it started however much it is used
+	AbsoluteTTL = 365 * 24 * time.Hour
+	// lastSeenAt is only written again once it is this old, so using a session doesn't mean a write every time
+	lastSeenResolution = time.Hour
+	maxUserAgent       = 200
+	// legacyMaxAge is how long a cookie from the old store is accepted after it was last written
+	legacyMaxAge = 30 * 24 * time.Hour
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// ErrRevoked is returned when saving a session that was signed out during the request
+var ErrRevoked = errors.New("session has been signed out")
+
+// ErrUnavailable is returned when saving a session that couldn't be loaded, so the cookie isn't swapped for an empty session
+var ErrUnavailable = errors.New("session could not be loaded")
+
+// Session is a signed in device, only the sha256 of the secret in the cookie is stored and it is the key it is looked up by
+type Session struct {
+	// DynamoDB
+	PK     string `dynamodbav:"PK" json:"-"`
+	SK     string `dynamodbav:"SK" json:"-"`
+	GSI1PK string `dynamodbav:"GSI1PK,omitempty" json:"-"`
+	GSI1SK string `dynamodbav:"GSI1SK,omitempty" json:"-"`
+	Type   string `dynamodbav:"type" json:"-"`
+	// ExpiresAt is the table's TTL attribute, the earlier of the idle and absolute expiry
+	ExpiresAt int64 `dynamodbav:"expiresAt" json:"-"`
+
+	ID         string    `dynamodbav:"id" json:"id"`
+	UserID     string    `dynamodbav:"userID,omitempty" json:"-"`
+	Values     []byte    `dynamodbav:"values" json:"-"`
+	UserAgent  string    `dynamodbav:"userAgent,omitempty" json:"userAgent,omitempty"`
+	CreatedAt  time.Time `dynamodbav:"createdAt" json:"createdAt"`
+	LastSeenAt time.Time `dynamodbav:"lastSeenAt" json:"lastSeenAt"`
+
+	// Current is set by the handler for the session making the request
+	Current bool `dynamodbav:"-" json:"current"`
+}
+
+// legacyCookie refuses a cookie from the old store, one that was moved into the table or signed out,
+// or every one of a user's after they signed out everywhere
+type legacyCookie struct {
+	PK        string `dynamodbav:"PK"`
+	SK        string `dynamodbav:"SK"`
+	Type      string `dynamodbav:"type"`
+	ExpiresAt int64  `dynamodbav:"expiresAt"`
+
+	SessionID string `dynamodbav:"sessionID,omitempty"`
+}
+
+// loaded is kept in the session's values to remember what is stored, it is never written to the table
+type loaded struct {
+	secret string
+	stored *Session
+	values map[interface{}]interface{}
+	failed bool
+	// legacy is the key of the old store's cookie the values came from
+	legacy map[string]types.AttributeValue
+}
+
+type loadedKey struct{}
+
+type renewKey struct{}
+
+// Store keeps sessions in the table with only a signed random secret in the cookie.
+//
+// Cookies from the old cookie store are still read with the same secret, they are moved into the table the first time they are saved.
+// Each one only works until then, or until it is signed out, and none of a user's work after they sign out everywhere.
+type Store struct {
+	secret  string
+	legacy  []securecookie.Codec
+	options *gsessions.Options
+	client  *dynamodb.Client
+}
+
+func New(secret string, client *dynamodb.Client) *Store {
+	legacy := securecookie.CodecsFromPairs([]byte(secret))
+
+	for _, codec := range legacy {
+		codec.(*securecookie.SecureCookie).MaxAge(int(legacyMaxAge.Seconds()))
+	}
+
+	return &Store{
+		secret:  secret,
+		legacy:  legacy,
+		options: &gsessions.Options{Path: "/"},
+		client:  client,
+	}
+}
+
+func (s *Store) Options(options sessions.Options) {
+	s.options = options.ToGorillaOptions()
+}
+
+// Get is the request's session, loaded once per request
+func (s *Store) Get(r *http.Request, name string) (*gsessions.Session, error) {
+	return gsessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session for the request's cookie, or starts one if there isn't a usable one
+func (s *Store) New(r *http.Request, name string) (*gsessions.Session, error) {
+	session := gsessions.NewSession(s, name)
+	options := *s.options
+	session.Options = &options
+	session.IsNew = true
+	session.Values[loadedKey{}] = &loaded{}
+
+	cookie, err := r.Cookie(name)
+
+	if err != nil {
+		return session, nil
+	}
+
+	if payload, err := signing.Verify(s.secret, cookie.Value); err == nil && strings.HasPrefix(payload, "session:") {
+		secret := strings.TrimPrefix(payload, "session:")
+		stored, err := s.load(secret)
+
+		if err != nil {
+			session.Values[loadedKey{}] = &loaded{failed: true}
+			return session, err
+		}
+
+		if stored == nil {
+			return session, nil
+		}
+
+		values, err := decode(stored.Values)
+
+		if err != nil {
+			return session, err
+		}
+
+		for key, value := range values {
+			session.Values[key] = value
+		}
+
+		session.ID = stored.ID
+		session.IsNew = false
+		session.Values[loadedKey{}] = &loaded{secret: secret, stored: stored, values: values}
+
+		return session, nil
+	}
+
+	// A session from before they were kept in the table, it becomes a new session with the same values when it's saved
+	legacy := map[interface{}]interface{}{}
+
+	if err := securecookie.DecodeMulti(name, cookie.Value, &legacy, s.legacy...); err != nil {
+		return session, nil
+	}
+
+	legacyKey := legacyCookieKey(cookie.Value)
+	userID, _ := legacy["user_id"].(string)
+	refused, err := s.legacyRefused(legacyKey, userID)
+
+	if err != nil {
+		session.Values[loadedKey{}] = &loaded{failed: true}
+		return session, err
+	}
+
+	if refused {
+		return session, nil
+	}
+
+	for key, value := range legacy {
+		session.Values[key] = value
+	}
+
+	session.Values[loadedKey{}] = &loaded{legacy: legacyKey}
+
+	log.Default().Printf("Moving cookie session of %v into the table", userID)
+
+	return session, nil
+}
+
+// legacyRefused is whether the old store's cookie was already moved or signed out, or its user signed out everywhere
+func (s *Store) legacyRefused(key map[string]types.AttributeValue, userID string) (bool, error) {
+	keys := []map[string]types.AttributeValue{key}
+
+	if userID != "" {
+		keys = append(keys, legacyUserKey(userID))
+	}
+
+	for _, key := range keys {
+		res, err := s.client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+			TableName:      aws.String(os.Getenv("table")),
+			ConsistentRead: aws.Bool(true),
+			Key:            key,
+		})
+
+		if err != nil {
+			return false, err
+		}
+
+		if res.Item != nil && !dynamodbTypes.Expired(res.Item) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (s *Store) load(secret string) (*Session, error) {
+	// Consistent so a signed out session stops working straight away
+	res, err := s.client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName:      aws.String(os.Getenv("table")),
+		ConsistentRead: aws.Bool(true),
+		Key:            sessionKey(secret),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Item == nil || dynamodbTypes.GetType(res.Item) != dynamodbTypes.Session || dynamodbTypes.Expired(res.Item) {
+		return nil, nil
+	}
+
+	stored := UnmarshalSession(res.Item)
+
+	// The TTL is the earlier of both, checked again in case the absolute expiry is shorter than the TTL left
+	if time.Now().After(stored.CreatedAt.Add(AbsoluteTTL)) {
+		return nil, nil
+	}
+
+	return &stored, nil
+}
+
+// Save writes the session when its values change or lastSeenAt needs refreshing, and always sends the cookie back
+func (s *Store) Save(r *http.Request, w http.ResponseWriter, session *gsessions.Session) error {
+	state, ok := session.Values[loadedKey{}].(*loaded)
+
+	if !ok {
+		state = &loaded{}
+		session.Values[loadedKey{}] = state
+	}
+
+	if state.failed {
+		return ErrUnavailable
+	}
+
+	_, renew := session.Values[renewKey{}]
+	delete(session.Values, renewKey{})
+
+	if session.Options.MaxAge < 0 {
+		if state.stored != nil {
+			if err := s.delete(state.stored); err != nil {
+				return err
+			}
+		}
+
+		// Signing out of a cookie that was never moved, a copy of it mustn't still work
+		if state.legacy != nil {
+			if err := putLegacyCookie(state.legacy, s.client); err != nil {
+				return err
+			}
+		}
+
+		session.Values[loadedKey{}] = &loaded{}
+		http.SetCookie(w, gsessions.NewCookie(session.Name(), "", session.Options))
+
+		return nil
+	}
+
+	values := handlerValues(session.Values)
+	now := time.Now().UTC()
+
+	if renew && state.stored != nil {
+		// A new secret for the same values, the old cookie stops working
+		if err := s.delete(state.stored); err != nil {
+			return err
+		}
+
+		state = &loaded{}
+	}
+
+	stored := state.stored
+
+	if stored != nil && reflect.DeepEqual(values, state.values) && now.Sub(stored.LastSeenAt) < lastSeenResolution {
+		http.SetCookie(w, gsessions.NewCookie(session.Name(), s.cookieValue(state.secret), session.Options))
+		return nil
+	}
+
+	secret := state.secret
+	condition := "attribute_exists(PK)"
+
+	if stored == nil {
+		var err error
+
+		if secret, err = randomSecret(); err != nil {
+			return err
+		}
+
+		stored = &Session{
+			ID:        uuid.NewV4().String(),
+			UserAgent: truncate(r.UserAgent(), maxUserAgent),
+			CreatedAt: now,
+		}
+
+		condition = "attribute_not_exists(PK)"
+	}
+
+	encoded, err := encode(values)
+
+	if err != nil {
+		return err
+	}
+
+	next := *stored
+	next.LastSeenAt = now
+	next.Values = encoded
+	next.UserID, _ = session.Values["user_id"].(string)
+
+	if err := s.put(secret, &next, condition, state.legacy); err != nil {
+		return err
+	}
+
+	session.ID = next.ID
+	session.IsNew = false
+	session.Values[loadedKey{}] = &loaded{secret: secret, stored: &next, values: values}
+
+	http.SetCookie(w, gsessions.NewCookie(session.Name(), s.cookieValue(secret), session.Options))
+
+	return nil
+}
+
+// put writes the session, marking the old store's cookie it replaces as moved in the same transaction
+func (s *Store) put(secret string, session *Session, condition string, legacy map[string]types.AttributeValue) error {
+	key := sessionKey(secret)
+	session.PK = key["PK"].(*types.AttributeValueMemberS).Value
+	session.SK = session.PK
+	session.Type = dynamodbTypes.Session
+	session.ExpiresAt = expiresAt(session)
+	session.GSI1PK = ""
+	session.GSI1SK = ""
+
+	if session.UserID != "" {
+		session.GSI1PK = fmt.Sprintf("USER#%s", session.UserID)
+		session.GSI1SK = fmt.Sprintf("SESSION#%s#%s", session.CreatedAt.Format(time.RFC3339), session.ID)
+	}
+
+	item, err := attributevalue.MarshalMap(session)
+
+	if err != nil {
+		panic(err)
+	}
+
+	if legacy == nil {
+		_, err = s.client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+			TableName:           aws.String(os.Getenv("table")),
+			Item:                item,
+			ConditionExpression: aws.String(condition),
+		})
+
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return ErrRevoked
+		}
+
+		return err
+	}
+
+	_, err = s.client.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				Put: &types.Put{
+					TableName:           aws.String(os.Getenv("table")),
+					Item:                item,
+					ConditionExpression: aws.String(condition),
+				},
+			},
+			{
+				// Another request moved the same cookie first, or it was signed out
+				Put: &types.Put{
+					TableName:           aws.String(os.Getenv("table")),
+					Item:                legacyCookieItem(legacy, session.ID),
+					ConditionExpression: aws.String("attribute_not_exists(PK)"),
+				},
+			},
+		},
+	})
+
+	var cancelled *types.TransactionCanceledException
+	if errors.As(err, &cancelled) {
+		return ErrRevoked
+	}
+
+	return err
+}
+
+func (s *Store) delete(session *Session) error {
+	_, err := s.client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: aws.String(os.Getenv("table")),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: session.PK},
+			"SK": &types.AttributeValueMemberS{Value: session.SK},
+		},
+	})
+
+	return err
+}
+
+func (s *Store) cookieValue(secret string) string {
+	return signing.Sign(s.secret, "session:"+secret)
+}
+
+// Renew gives the session a new secret when it is next saved, the cookie it had stops working
+func Renew(session sessions.Session) {
+	session.Set(renewKey{}, true)
+}
+
+// List is userID's sessions, oldest first since GSI1SK starts with when they were made
+func List(userID string, client *dynamodb.Client) ([]Session, error) {
+	list := []Session{}
+	now := time.Now()
+
+	paginator := dynamodb.NewQueryPaginator(client, &dynamodb.QueryInput{
+		TableName:              aws.String(os.Getenv("table")),
+		IndexName:              aws.String("GSI1"),
+		KeyConditionExpression: aws.String("GSI1PK = :GSI1PK and begins_with(GSI1SK, :session)"),
+		FilterExpression:       aws.String("expiresAt > :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":GSI1PK":  &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", userID)},
+			":session": &types.AttributeValueMemberS{Value: "SESSION#"},
+			":now":     &types.AttributeValueMemberN{Value: fmt.Sprint(now.Unix())},
+		},
+	})
+
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(context.TODO())
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range out.Items {
+			session := UnmarshalSession(item)
+
+			if now.Before(session.CreatedAt.Add(AbsoluteTTL)) {
+				list = append(list, session)
+			}
+		}
+	}
+
+	return list, nil
+}
+
+// Revoke signs out one of userID's sessions
+func Revoke(sessionID string, userID string, client *dynamodb.Client) error {
+	list, err := List(userID, client)
+
+	if err != nil {
+		return err
+	}
+
+	for _, session := range list {
+		if session.ID != sessionID {
+			continue
+		}
+
+		return revoke(session, client)
+	}
+
+	return ErrSessionNotFound
+}
+
+// RevokeAll signs out every one of userID's sessions, including cookies from the old store that haven't been moved yet
+func RevokeAll(userID string, client *dynamodb.Client) error {
+	if err := putLegacyCookie(legacyUserKey(userID), client); err != nil {
+		return err
+	}
+
+	list, err := List(userID, client)
+
+	if err != nil {
+		return err
+	}
+
+	for _, session := range list {
+		if err := revoke(session, client); err != nil && !errors.Is(err, ErrSessionNotFound) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func revoke(session Session, client *dynamodb.Client) error {
+	_, err := client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: aws.String(os.Getenv("table")),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: session.PK},
+			"SK": &types.AttributeValueMemberS{Value: session.SK},
+		},
+		ConditionExpression: aws.String("userID = :userID"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userID": &types.AttributeValueMemberS{Value: session.UserID},
+		},
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrSessionNotFound
+	}
+
+	return err
+}
+
+func sessionKey(secret string) map[string]types.AttributeValue {
+	sum := sha256.Sum256([]byte(secret))
+	id := fmt.Sprintf("SESSION#%s", hex.EncodeToString(sum[:]))
+
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: id},
+		"SK": &types.AttributeValueMemberS{Value: id},
+	}
+}
+
+// legacyCookieKey is one cookie from the old store, by the sha256 of its value
+func legacyCookieKey(value string) map[string]types.AttributeValue {
+	sum := sha256.Sum256([]byte(value))
+	id := fmt.Sprintf("LEGACY#%s", hex.EncodeToString(sum[:]))
+
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: id},
+		"SK": &types.AttributeValueMemberS{Value: id},
+	}
+}
+
+// legacyUserKey is every cookie from the old store with userID in it
+func legacyUserKey(userID string) map[string]types.AttributeValue {
+	id := fmt.Sprintf("LEGACY#USER#%s", userID)
+
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: id},
+		"SK": &types.AttributeValueMemberS{Value: id},
+	}
+}
+
+// legacyCookieItem is kept until any cookie it refuses has expired anyway
+func legacyCookieItem(key map[string]types.AttributeValue, sessionID string) map[string]types.AttributeValue {
+	item, err := attributevalue.MarshalMap(legacyCookie{
+		Type:      dynamodbTypes.LegacyCookie,
+		ExpiresAt: time.Now().Add(legacyMaxAge).Unix(),
+		SessionID: sessionID,
+	})
+
+	if err != nil {
+		panic(err)
+	}
+
+	for k, v := range key {
+		item[k] = v
+	}
+
+	return item
+}
+
+func putLegacyCookie(key map[string]types.AttributeValue, client *dynamodb.Client) error {
+	_, err := client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName: aws.String(os.Getenv("table")),
+		Item:      legacyCookieItem(key, ""),
+	})
+
+	return err
+}
+
+// expiresAt is the earlier of the idle and absolute expiry
+func expiresAt(session *Session) int64 {
+	idle := session.LastSeenAt.Add(IdleTTL)
+	absolute := session.CreatedAt.Add(AbsoluteTTL)
+
+	if absolute.Before(idle) {
+		return absolute.Unix()
+	}
+
+	return idle.Unix()
+}
+
+func randomSecret() (string, error) {
+	b := make([]byte, 32)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// handlerValues leaves out the store's own keys, everything else is what handlers set
+func handlerValues(values map[interface{}]interface{}) map[interface{}]interface{} {
+	set := map[interface{}]interface{}{}
+
+	for key, value := range values {
+		if _, ok := key.(string); ok {
+			set[key] = value
+		}
+	}
+
+	return set
+}
+
+func encode(values map[interface{}]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	if err := gob.NewEncoder(&buf).Encode(values); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decode(encoded []byte) (map[interface{}]interface{}, error) {
+	values := map[interface{}]interface{}{}
+
+	err := gob.NewDecoder(bytes.NewReader(encoded)).Decode(&values)
+
+	return values, err
+}
+
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+
+	return s[:max]
+}
+
+func UnmarshalSession(item map[string]types.AttributeValue) Session {
+	session := &Session{}
+
+	if err := attributevalue.UnmarshalMap(item, session); err != nil {
+		panic(err)
+	}
+
+	return *session
+}
@@ -0,0 +1,43 @@
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// Sign appends an HMAC of payload so it can be handed out and trusted when it comes back.
+// The payload isn't encrypted, it can be read by anyone holding the token.
+func Sign(secret string, payload string) string {
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(payload))
+
+	return encoded + "." + mac(secret, encoded)
+}
+
+// Verify returns the payload of a token made by Sign with the same secret
+func Verify(secret string, token string) (string, error) {
+	parts := strings.Split(token, ".")
+
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(mac(secret, parts[0]))) {
+		return "", ErrInvalidSignature
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+
+	if err != nil {
+		return "", ErrInvalidSignature
+	}
+
+	return string(payload), nil
+}
+
+func mac(secret string, encoded string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(encoded))
+
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,178 @@
+package slot
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	// Lambda doesn't ship a zoneinfo database
+	_ "time/tzdata"
+)
+
+const (
+	dateLayout  = "2006-01-02"
+	clockLayout = "15:04"
+
+	// Stops a bad spec from looping for a long time before the option limit is checked
+	maxSlots = 1000
+)
+
+type Range struct {
+	Start string `json:"start" binding:"required,datetime=15:04"`
+	End   string `json:"end" binding:"required,datetime=15:04"`
+}
+
+// Spec describes a set of slots, e.g. every 15 minutes from 09:00 to 17:00 on these dates skipping 12:00-13:00
+type Spec struct {
+	Dates    []string `json:"dates" binding:"required,gt=0,lt=200,dive,datetime=2006-01-02"`
+	Start    string   `json:"start" binding:"required,datetime=15:04"`
+	End      string   `json:"end" binding:"required,datetime=15:04"`
+	Interval int      `json:"interval" binding:"required,min=5,max=1440"` // minutes
+	Timezone string   `json:"timezone" binding:"required,timezone"`
+	Skip     []Range  `json:"skip" binding:"omitempty,lt=50,dive"`
+}
+
+type Slot struct {
+	Label string
+	Start time.Time
+	End   time.Time
+	// DayStart is the spec's start on the slot's day, the label is written against its offset
+	DayStart time.Time
+}
+
+// Generate expands the spec into slots.
+//
+// Slots are stepped in elapsed time rather than wall clock time so every slot is exactly Interval long.
+// Nothing starts in a DST gap, the slot that runs into one ends on the other side of it, and both sides
+// of a DST overlap are generated. A start or end that falls in a gap is moved by time.Date.
+func (spec Spec) Generate() ([]Slot, error) {
+	loc, err := time.LoadLocation(spec.Timezone)
+
+	if err != nil {
+		return nil, err
+	}
+
+	interval := time.Duration(spec.Interval) * time.Minute
+
+	var slots []Slot
+
+	for _, date := range spec.Dates {
+		day, err := time.ParseInLocation(dateLayout, date, loc)
+
+		if err != nil {
+			return nil, err
+		}
+
+		start, err := onDay(day, spec.Start, loc)
+
+		if err != nil {
+			return nil, err
+		}
+
+		end, err := onDay(day, spec.End, loc)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !end.After(start) {
+			return nil, fmt.Errorf("end %s must be after start %s", spec.End, spec.Start)
+		}
+
+		skips, err := skipsOnDay(day, spec.Skip, loc)
+
+		if err != nil {
+			return nil, err
+		}
+
+		_, startOffset := start.Zone()
+
+		for t := start; !t.Add(interval).After(end); t = t.Add(interval) {
+			slotEnd := t.Add(interval)
+
+			if overlapsAny(t, slotEnd, skips) {
+				continue
+			}
+
+			if len(slots) == maxSlots {
+				return nil, errors.New("too many slots")
+			}
+
+			slots = append(slots, Slot{
+				Label:    Label(t, slotEnd, startOffset),
+				Start:    t.UTC(),
+				End:      slotEnd.UTC(),
+				DayStart: start.UTC(),
+			})
+		}
+	}
+
+	return slots, nil
+}
+
+// Label formats a slot as e.g. "Mon 2 Jan 09:00–09:15"
+//
+// The zone abbreviation is added when the slot isn't in the same offset as the start of the day,
+// otherwise the repeated hour on a DST change would produce two identical labels.
+func Label(start time.Time, end time.Time, dayOffset int) string {
+	label := fmt.Sprintf("%s–%s", start.Format("Mon 2 Jan 15:04"), end.Format(clockLayout))
+
+	if _, offset := start.Zone(); offset != dayOffset {
+		label = fmt.Sprintf("%s %s", label, start.Format("MST"))
+	}
+
+	return label
+}
+
+// DayOffset is the zone offset at the start of t's day, for Label on slots generated before their day's start was kept
+func DayOffset(t time.Time) int {
+	_, offset := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()).Zone()
+
+	return offset
+}
+
+func onDay(day time.Time, clock string, loc *time.Location) (time.Time, error) {
+	parsed, err := time.Parse(clockLayout, clock)
+
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Date(day.Year(), day.Month(), day.Day(), parsed.Hour(), parsed.Minute(), 0, 0, loc), nil
+}
+
+func skipsOnDay(day time.Time, skip []Range, loc *time.Location) ([][2]time.Time, error) {
+	var skips [][2]time.Time
+
+	for _, r := range skip {
+		start, err := onDay(day, r.Start, loc)
+
+		if err != nil {
+			return nil, err
+		}
+
+		end, err := onDay(day, r.End, loc)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !end.After(start) {
+			return nil, fmt.Errorf("skip end %s must be after its start %s", r.End, r.Start)
+		}
+
+		skips = append(skips, [2]time.Time{start, end})
+	}
+
+	return skips, nil
+}
+
+func overlapsAny(start time.Time, end time.Time, skips [][2]time.Time) bool {
+	for _, skip := range skips {
+		if start.Before(skip[1]) && end.After(skip[0]) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,97 @@
+package sms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var ErrNotConfigured = errors.New("sms provider is not configured")
+
+// Sender sends a text message to a phone number in E.164 format
+type Sender interface {
+	Send(ctx context.Context, to string, message string) error
+}
+
+// New picks the provider by name, "log" writes messages to the log instead of sending them
+func New(provider string, accountID string, authToken string, from string) Sender {
+	switch provider {
+	case "twilio":
+		return &Twilio{AccountSID: accountID, AuthToken: authToken, From: from}
+	case "log":
+		return &Log{}
+	default:
+		return disabled{}
+	}
+}
+
+// Log is for running locally, nothing leaves the machine
+type Log struct {
+	// Sent keeps every message so tests can read the codes back
+	Sent []Message
+}
+
+type Message struct {
+	To   string
+	Body string
+}
+
+func (l *Log) Send(ctx context.Context, to string, message string) error {
+	l.Sent = append(l.Sent, Message{To: to, Body: message})
+
+	log.Default().Printf("SMS to %s: %s", to, message)
+
+	return nil
+}
+
+// Twilio sends through the Messages REST API
+type Twilio struct {
+	AccountSID string
+	AuthToken  string
+	From       string
+}
+
+var twilioClient = &http.Client{Timeout: 10 * time.Second}
+
+func (t *Twilio) Send(ctx context.Context, to string, message string) error {
+	form := url.Values{}
+	form.Set("To", to)
+	form.Set("From", t.From)
+	form.Set("Body", message)
+
+	endpoint := fmt.Sprintf("https://api.twilio.com/2010-04-01/Accounts/%s/Messages.json", url.PathEscape(t.AccountSID))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+
+	if err != nil {
+		return err
+	}
+
+	req.SetBasicAuth(t.AccountSID, t.AuthToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := twilioClient.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("twilio responded with %s", res.Status)
+	}
+
+	return nil
+}
+
+type disabled struct{}
+
+func (disabled) Send(ctx context.Context, to string, message string) error {
+	return ErrNotConfigured
+}
@@ -0,0 +1,262 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"picker/backend/go/pkg/dynamodbTypes"
+	"picker/backend/go/pkg/option"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const maxBatchAttempts = 5
+
+type Snapshot struct {
+	// DynamoDB
+	PK   string `dynamodbav:"PK" json:"-"`
+	SK   string `dynamodbav:"SK" json:"-"`
+	Type string `dynamodbav:"type" json:"-"`
+
+	ID        string    `json:"id" dynamodbav:"id"`
+	RoomID    string    `json:"roomID" dynamodbav:"roomID"`
+	Question  string    `json:"question" dynamodbav:"question"`
+	Label     string    `json:"label,omitempty" dynamodbav:"label,omitempty"`
+	CreatedAt time.Time `json:"createdAt" dynamodbav:"createdAt"`
+	// Options are kept as their own items, snapshots from before then have them inline
+	Options []option.Option `json:"options,omitempty" dynamodbav:"options,omitempty"`
+}
+
+// savedOption is one option of a snapshot, a whole room in one item could be over DynamoDB's 400KB limit
+type savedOption struct {
+	PK     string        `dynamodbav:"PK"`
+	SK     string        `dynamodbav:"SK"`
+	Type   string        `dynamodbav:"type"`
+	Option option.Option `dynamodbav:"option"`
+}
+
+func key(roomID string, id string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+		"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("SNAPSHOT#%s", id)},
+	}
+}
+
+// New saves the room's current results.
+//
+// The ID is chosen by the caller so a retried reset doesn't take a second snapshot after some selections are already cleared,
+// if a snapshot with the ID already exists it is returned instead.
+// The options are written before the snapshot itself, a snapshot only shows up once all of them are saved.
+func New(id string, roomID string, question string, label string, options []option.Option, client *dynamodb.Client) (*Snapshot, error) {
+	existing, err := Get(roomID, id, client)
+
+	if err != nil || existing != nil {
+		return existing, err
+	}
+
+	snapshot := &Snapshot{
+		PK:        fmt.Sprintf("ROOM#%s", roomID),
+		SK:        fmt.Sprintf("SNAPSHOT#%s", id),
+		Type:      dynamodbTypes.Snapshot,
+		ID:        id,
+		RoomID:    roomID,
+		Question:  question,
+		Label:     label,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	var requests []types.WriteRequest
+
+	// Padded so the options come back in order
+	for i, opt := range options {
+		item, err := attributevalue.MarshalMap(savedOption{
+			PK:     snapshot.PK,
+			SK:     fmt.Sprintf("%s#OPTION#%04d", snapshot.SK, i),
+			Type:   dynamodbTypes.SnapshotOption,
+			Option: opt,
+		})
+
+		if err != nil {
+			panic(err)
+		}
+
+		requests = append(requests, types.WriteRequest{PutRequest: &types.PutRequest{Item: item}})
+	}
+
+	if err := batchWrite(requests, client); err != nil {
+		return nil, err
+	}
+
+	item, err := attributevalue.MarshalMap(snapshot)
+
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName:           aws.String(os.Getenv("table")),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(PK) and attribute_not_exists(SK)"),
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return Get(roomID, id, client)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot.Options = options
+
+	return snapshot, nil
+}
+
+// batchWrite writes 25 items at a time, throttled items come back as unprocessed and are retried with a backoff
+func batchWrite(requests []types.WriteRequest, client *dynamodb.Client) error {
+	for start := 0; start < len(requests); start += 25 {
+		end := start + 25
+
+		if end > len(requests) {
+			end = len(requests)
+		}
+
+		input := &dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]types.WriteRequest{
+				os.Getenv("table"): requests[start:end],
+			},
+		}
+
+		for attempt := 0; ; attempt++ {
+			res, err := client.BatchWriteItem(context.TODO(), input)
+
+			if err != nil {
+				return err
+			}
+
+			if len(res.UnprocessedItems) == 0 {
+				break
+			}
+
+			if attempt == maxBatchAttempts {
+				return fmt.Errorf("%d snapshot options could not be written", len(res.UnprocessedItems[os.Getenv("table")]))
+			}
+
+			time.Sleep(time.Duration(50<<attempt) * time.Millisecond)
+
+			input.RequestItems = res.UnprocessedItems
+		}
+	}
+
+	return nil
+}
+
+func Get(roomID string, id string, client *dynamodb.Client) (*Snapshot, error) {
+	res, err := client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName:      aws.String(os.Getenv("table")),
+		ConsistentRead: aws.Bool(true),
+		Key:            key(roomID, id),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Item == nil {
+		return nil, nil
+	}
+
+	snapshot := Unmarshal(res.Item)
+
+	if snapshot.Options != nil {
+		return &snapshot, nil
+	}
+
+	snapshot.Options = []option.Option{}
+
+	paginator := dynamodb.NewQueryPaginator(client, &dynamodb.QueryInput{
+		TableName:              aws.String(os.Getenv("table")),
+		ConsistentRead:         aws.Bool(true),
+		KeyConditionExpression: aws.String("PK = :PK and begins_with(SK, :options)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":PK":      &types.AttributeValueMemberS{Value: snapshot.PK},
+			":options": &types.AttributeValueMemberS{Value: fmt.Sprintf("%s#OPTION#", snapshot.SK)},
+		},
+	})
+
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(context.TODO())
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range out.Items {
+			saved := savedOption{}
+
+			if err := attributevalue.UnmarshalMap(item, &saved); err != nil {
+				panic(err)
+			}
+
+			snapshot.Options = append(snapshot.Options, saved.Option)
+		}
+	}
+
+	return &snapshot, nil
+}
+
+// List returns the room's snapshots newest first, without their options
+func List(roomID string, client *dynamodb.Client) ([]Snapshot, error) {
+	paginator := dynamodb.NewQueryPaginator(client, &dynamodb.QueryInput{
+		TableName:              aws.String(os.Getenv("table")),
+		KeyConditionExpression: aws.String("PK = :PK and begins_with(SK, :snapshot)"),
+		// The snapshots' options share the prefix
+		FilterExpression:     aws.String("#type = :type"),
+		ProjectionExpression: aws.String("id, roomID, question, label, createdAt"),
+		ExpressionAttributeNames: map[string]string{
+			"#type": "type",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":PK":       &types.AttributeValueMemberS{Value: fmt.Sprintf("ROOM#%s", roomID)},
+			":snapshot": &types.AttributeValueMemberS{Value: "SNAPSHOT#"},
+			":type":     &types.AttributeValueMemberS{Value: dynamodbTypes.Snapshot},
+		},
+	})
+
+	snapshots := []Snapshot{}
+
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(context.TODO())
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range out.Items {
+			snapshots = append(snapshots, Unmarshal(item))
+		}
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].CreatedAt.After(snapshots[j].CreatedAt)
+	})
+
+	return snapshots, nil
+}
+
+func Unmarshal(item map[string]types.AttributeValue) Snapshot {
+	snapshot := &Snapshot{}
+
+	if err := attributevalue.UnmarshalMap(item, snapshot); err != nil {
+		panic(err)
+	}
+
+	return *snapshot
+}
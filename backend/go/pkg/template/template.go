@@ -0,0 +1,357 @@
+package template
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"picker/backend/go/pkg/dynamodbTypes"
+	"picker/backend/go/pkg/grid"
+	"picker/backend/go/pkg/option"
+	"picker/backend/go/pkg/recurrence"
+	"picker/backend/go/pkg/seatmap"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/twinj/uuid"
+)
+
+var ErrTemplateNotFound = errors.New("template not found")
+
+const maxBatchAttempts = 5
+
+type SaveTemplateRequest struct {
+	Name string `json:"name" binding:"required,min=1,max=200"`
+}
+
+// Template is a room's question, options and settings saved without any selections so it can be made into new rooms
+type Template struct {
+	// DynamoDB
+	PK     string `dynamodbav:"PK" json:"-"`
+	SK     string `dynamodbav:"SK" json:"-"`
+	GSI1PK string `dynamodbav:"GSI1PK" json:"-"`
+	GSI1SK string `dynamodbav:"GSI1SK" json:"-"`
+	Type   string `dynamodbav:"type" json:"-"`
+
+	ID         string           `json:"id" dynamodbav:"id"`
+	Name       string           `json:"name" dynamodbav:"name"`
+	Question   string           `json:"question" dynamodbav:"question"`
+	Kind       string           `json:"kind" dynamodbav:"kind,omitempty"`
+	Grid       *grid.Grid       `json:"grid,omitempty" dynamodbav:"grid,omitempty"`
+	SeatMap    *seatmap.Layout  `json:"seatMap,omitempty" dynamodbav:"seatMap,omitempty"`
+	Recurrence *recurrence.Rule `json:"recurrence,omitempty" dynamodbav:"recurrence,omitempty"`
+	// Options are kept as their own items, templates from before then have them inline
+	Options   []option.Option `json:"options,omitempty" dynamodbav:"options,omitempty"`
+	CreatedAt time.Time       `json:"createdAt" dynamodbav:"createdAt"`
+
+	// Private
+	OwnerID string `json:"-" dynamodbav:"ownerID"`
+}
+
+// savedOption is one option of a template, a whole room in one item could be over DynamoDB's 400KB limit
+type savedOption struct {
+	PK     string        `dynamodbav:"PK"`
+	SK     string        `dynamodbav:"SK"`
+	Type   string        `dynamodbav:"type"`
+	Option option.Option `dynamodbav:"option"`
+}
+
+// New gives the template its keys, the caller fills in the room's content
+func New(name string, userID string) *Template {
+	id := uuid.NewV4().String()
+	createdAt := time.Now().UTC()
+
+	return &Template{
+		PK:        fmt.Sprintf("TEMPLATE#%s", id),
+		SK:        fmt.Sprintf("TEMPLATE#%s", id),
+		GSI1PK:    fmt.Sprintf("USER#%s", userID),
+		GSI1SK:    fmt.Sprintf("TEMPLATE#%s#%s", createdAt.Format(time.RFC3339), id),
+		Type:      dynamodbTypes.Template,
+		ID:        id,
+		Name:      name,
+		CreatedAt: createdAt,
+		OwnerID:   userID,
+	}
+}
+
+// Save writes the options before the template itself, so a template only shows up once all of them are saved
+func (template *Template) Save(client *dynamodb.Client) error {
+	var requests []types.WriteRequest
+
+	// Padded so the options come back in order
+	for i, opt := range template.Options {
+		item, err := attributevalue.MarshalMap(savedOption{
+			PK:     template.PK,
+			SK:     fmt.Sprintf("%s#OPTION#%04d", template.SK, i),
+			Type:   dynamodbTypes.TemplateOption,
+			Option: opt,
+		})
+
+		if err != nil {
+			panic(err)
+		}
+
+		requests = append(requests, types.WriteRequest{PutRequest: &types.PutRequest{Item: item}})
+	}
+
+	if err := batchWrite(requests, client); err != nil {
+		return err
+	}
+
+	header := *template
+	header.Options = nil
+
+	item, err := attributevalue.MarshalMap(header)
+
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName:           aws.String(os.Getenv("table")),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(PK) and attribute_not_exists(SK)"),
+	})
+
+	return err
+}
+
+// batchWrite writes 25 items at a time, throttled items come back as unprocessed and are retried with a backoff
+func batchWrite(requests []types.WriteRequest, client *dynamodb.Client) error {
+	for start := 0; start < len(requests); start += 25 {
+		end := start + 25
+
+		if end > len(requests) {
+			end = len(requests)
+		}
+
+		input := &dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]types.WriteRequest{
+				os.Getenv("table"): requests[start:end],
+			},
+		}
+
+		for attempt := 0; ; attempt++ {
+			res, err := client.BatchWriteItem(context.TODO(), input)
+
+			if err != nil {
+				return err
+			}
+
+			if len(res.UnprocessedItems) == 0 {
+				break
+			}
+
+			if attempt == maxBatchAttempts {
+				return fmt.Errorf("%d template options could not be written", len(res.UnprocessedItems[os.Getenv("table")]))
+			}
+
+			time.Sleep(time.Duration(50<<attempt) * time.Millisecond)
+
+			input.RequestItems = res.UnprocessedItems
+		}
+	}
+
+	return nil
+}
+
+// Get only returns the template to its owner.
+//
+// The template sorts before its options so they all come back from one query.
+func Get(id string, userID string, client *dynamodb.Client) (*Template, error) {
+	paginator := dynamodb.NewQueryPaginator(client, &dynamodb.QueryInput{
+		TableName:              aws.String(os.Getenv("table")),
+		KeyConditionExpression: aws.String("PK = :PK"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("TEMPLATE#%s", id)},
+		},
+	})
+
+	var template *Template
+	var options []option.Option
+
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(context.TODO())
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range out.Items {
+			simple := dynamodbTypes.Simple{}
+
+			if err := attributevalue.UnmarshalMap(item, &simple); err != nil {
+				panic(err)
+			}
+
+			switch simple.Type {
+			case dynamodbTypes.Template:
+				header := Unmarshal(item)
+				template = &header
+			case dynamodbTypes.TemplateOption:
+				saved := savedOption{}
+
+				if err := attributevalue.UnmarshalMap(item, &saved); err != nil {
+					panic(err)
+				}
+
+				options = append(options, saved.Option)
+			}
+		}
+	}
+
+	if template == nil || template.OwnerID != userID {
+		return nil, ErrTemplateNotFound
+	}
+
+	if template.Options == nil {
+		template.Options = options
+	}
+
+	return template, nil
+}
+
+// List returns the user's templates newest first, without their options
+func List(userID string, client *dynamodb.Client) ([]Template, error) {
+	paginator := dynamodb.NewQueryPaginator(client, &dynamodb.QueryInput{
+		TableName:              aws.String(os.Getenv("table")),
+		IndexName:              aws.String("GSI1"),
+		ScanIndexForward:       aws.Bool(false),
+		KeyConditionExpression: aws.String("GSI1PK = :GSI1PK and begins_with(GSI1SK, :template)"),
+		ProjectionExpression:   aws.String("id, #name, question, kind, createdAt"),
+		// name is a reserved word
+		ExpressionAttributeNames: map[string]string{
+			"#name": "name",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":GSI1PK":   &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", userID)},
+			":template": &types.AttributeValueMemberS{Value: "TEMPLATE#"},
+		},
+	})
+
+	templates := []Template{}
+
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(context.TODO())
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range out.Items {
+			templates = append(templates, Unmarshal(item))
+		}
+	}
+
+	return templates, nil
+}
+
+func Delete(id string, userID string, client *dynamodb.Client) error {
+	_, err := client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: aws.String(os.Getenv("table")),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("TEMPLATE#%s", id)},
+			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("TEMPLATE#%s", id)},
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userID": &types.AttributeValueMemberS{Value: userID},
+		},
+		ConditionExpression: aws.String("ownerID = :userID"),
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrTemplateNotFound
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return deleteOptions(id, client)
+}
+
+// deleteOptions runs after the template is gone, options left behind by a failure are never read
+func deleteOptions(id string, client *dynamodb.Client) error {
+	paginator := dynamodb.NewQueryPaginator(client, &dynamodb.QueryInput{
+		TableName:              aws.String(os.Getenv("table")),
+		KeyConditionExpression: aws.String("PK = :PK and begins_with(SK, :options)"),
+		ProjectionExpression:   aws.String("PK, SK"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":PK":      &types.AttributeValueMemberS{Value: fmt.Sprintf("TEMPLATE#%s", id)},
+			":options": &types.AttributeValueMemberS{Value: fmt.Sprintf("TEMPLATE#%s#OPTION#", id)},
+		},
+	})
+
+	var requests []types.WriteRequest
+
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(context.TODO())
+
+		if err != nil {
+			return err
+		}
+
+		for _, key := range out.Items {
+			requests = append(requests, types.WriteRequest{DeleteRequest: &types.DeleteRequest{Key: key}})
+		}
+	}
+
+	return batchWrite(requests, client)
+}
+
+// Reassign moves fromID's templates over to toID, keeping their order
+func Reassign(fromID string, toID string, client *dynamodb.Client) error {
+	paginator := dynamodb.NewQueryPaginator(client, &dynamodb.QueryInput{
+		TableName:              aws.String(os.Getenv("table")),
+		IndexName:              aws.String("GSI1"),
+		KeyConditionExpression: aws.String("GSI1PK = :GSI1PK and begins_with(GSI1SK, :template)"),
+		ProjectionExpression:   aws.String("PK, SK"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":GSI1PK":   &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", fromID)},
+			":template": &types.AttributeValueMemberS{Value: "TEMPLATE#"},
+		},
+	})
+
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(context.TODO())
+
+		if err != nil {
+			return err
+		}
+
+		for _, key := range out.Items {
+			_, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+				TableName:        aws.String(os.Getenv("table")),
+				Key:              key,
+				UpdateExpression: aws.String("set ownerID = :to, GSI1PK = :GSI1PK"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":from":   &types.AttributeValueMemberS{Value: fromID},
+					":to":     &types.AttributeValueMemberS{Value: toID},
+					":GSI1PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", toID)},
+				},
+				ConditionExpression: aws.String("ownerID = :from"),
+			})
+
+			var conditionErr *types.ConditionalCheckFailedException
+			if err != nil && !errors.As(err, &conditionErr) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func Unmarshal(item map[string]types.AttributeValue) Template {
+	template := &Template{}
+
+	if err := attributevalue.UnmarshalMap(item, template); err != nil {
+		panic(err)
+	}
+
+	return *template
+}
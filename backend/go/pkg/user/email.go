@@ -0,0 +1,419 @@
+package user
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"picker/backend/go/pkg/dynamodbTypes"
+	"picker/backend/go/pkg/email"
+	"picker/backend/go/pkg/room"
+	"picker/backend/go/pkg/signing"
+	"picker/backend/go/pkg/template"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/twinj/uuid"
+)
+
+// Sign in links stop working after this long, the table's TTL removes them
+const signInTTL = 15 * time.Minute
+
+var ErrInvalidLink = errors.New("sign in link is invalid, used or expired")
+var ErrEmailTaken = errors.New("email is linked to someone else")
+var ErrConfirmMerge = errors.New("signing in moves everything on this device into the account, confirm it first")
+
+type SignInRequest struct {
+	Email string `json:"email" binding:"required,email,max=254"`
+}
+
+type VerifySignInRequest struct {
+	Token string `json:"token" binding:"required,max=1000"`
+	// ConfirmMerge is the address of the account the user agreed to move this device's rooms into
+	ConfirmMerge string `json:"confirmMerge" binding:"omitempty,max=254"`
+}
+
+// signIn is the latest link sent to an address, sending another replaces it
+type signIn struct {
+	// DynamoDB
+	PK        string `dynamodbav:"PK"`
+	SK        string `dynamodbav:"SK"`
+	Type      string `dynamodbav:"type"`
+	ExpiresAt int64  `dynamodbav:"expiresAt"`
+
+	Nonce  string `dynamodbav:"nonce"`
+	SentAt int64  `dynamodbav:"sentAt"`
+}
+
+// emailAddress looks up which account a verified address belongs to
+type emailAddress struct {
+	// DynamoDB
+	PK   string `dynamodbav:"PK"`
+	SK   string `dynamodbav:"SK"`
+	Type string `dynamodbav:"type"`
+
+	UserID string `dynamodbav:"userID"`
+}
+
+func emailKey(address string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("EMAIL#%s", address)},
+		"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("EMAIL#%s", address)},
+	}
+}
+
+func signInKey(address string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("EMAIL#%s", address)},
+		"SK": &types.AttributeValueMemberS{Value: "SIGNIN"},
+	}
+}
+
+// RequestSignIn emails a single use link to siteURL's sign in page. The returned nonce is kept in the asking session
+// so SignIn can tell whether the link came back to it
+func RequestSignIn(address string, secret string, siteURL string, sender email.Sender, client *dynamodb.Client) (string, error) {
+	address = strings.ToLower(strings.TrimSpace(address))
+
+	now := time.Now()
+	nonce := uuid.NewV4().String()
+	sessionNonce := uuid.NewV4().String()
+
+	item, err := attributevalue.MarshalMap(signIn{
+		PK:        fmt.Sprintf("EMAIL#%s", address),
+		SK:        "SIGNIN",
+		Type:      dynamodbTypes.SignIn,
+		ExpiresAt: now.Add(signInTTL).Unix(),
+		Nonce:     nonce,
+		SentAt:    now.Unix(),
+	})
+
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName:           aws.String(os.Getenv("table")),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(PK) or sentAt <= :resendAfter"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":resendAfter": &types.AttributeValueMemberN{Value: fmt.Sprint(now.Add(-resendAfter).Unix())},
+		},
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return "", ErrTooSoon
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	// The address goes last, it is the only part that can contain a colon
+	token := signing.Sign(secret, fmt.Sprintf("signin:%s:%s:%s", nonce, sessionNonce, address))
+	link := fmt.Sprintf("%s/signin?token=%s", strings.TrimRight(siteURL, "/"), url.QueryEscape(token))
+
+	body := fmt.Sprintf("Open this link to sign in to picknow, it works once in the next %d minutes.\n\n%s\n\n"+
+		"If you didn't ask to sign in you can ignore this email.", int(signInTTL.Minutes()), link)
+
+	return sessionNonce, sender.Send(context.TODO(), address, "Sign in to picknow", body)
+}
+
+// SignIn uses up the link and returns the account for its address, the caller should switch the session over to it.
+//
+// Only the session that asked for the link can bring anything with it. There the first user ID to sign in with an
+// address becomes its account, and any other user ID has its rooms, memberships, invites, picks and templates merged
+// into the account once confirmMerge names the address. Until then ErrConfirmMerge is returned and the link still works.
+// A link opened anywhere else, such as one that was forwarded, only signs in, making a new account for an unused address.
+// Merging carries on with the next link if it stops part way.
+func SignIn(token string, userID string, sessionNonce string, confirmMerge string, secret string, client *dynamodb.Client) (*User, error) {
+	nonce, linkSessionNonce, address, err := parseSignIn(token, secret)
+
+	if err != nil {
+		return nil, err
+	}
+
+	live, err := client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName:      aws.String(os.Getenv("table")),
+		ConsistentRead: aws.Bool(true),
+		Key:            signInKey(address),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if live.Item == nil {
+		return nil, ErrInvalidLink
+	}
+
+	link := &signIn{}
+
+	if err := attributevalue.UnmarshalMap(live.Item, link); err != nil {
+		panic(err)
+	}
+
+	// Checked again when the link is used up
+	if link.Nonce != nonce || link.ExpiresAt <= time.Now().Unix() {
+		return nil, ErrInvalidLink
+	}
+
+	accountID, err := lookupEmail(address, client)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sameSession := sessionNonce != "" && subtle.ConstantTimeCompare([]byte(sessionNonce), []byte(linkSessionNonce)) == 1
+	merge := sameSession && accountID != "" && accountID != userID
+
+	if merge && confirmMerge != address {
+		return nil, ErrConfirmMerge
+	}
+
+	_, err = client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName:           aws.String(os.Getenv("table")),
+		Key:                 signInKey(address),
+		ConditionExpression: aws.String("nonce = :nonce and expiresAt > :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":nonce": &types.AttributeValueMemberS{Value: nonce},
+			":now":   &types.AttributeValueMemberN{Value: fmt.Sprint(time.Now().Unix())},
+		},
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return nil, ErrInvalidLink
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if accountID == "" {
+		if !sameSession {
+			return linkEmail(address, uuid.NewV4().String(), client)
+		}
+
+		return linkEmail(address, userID, client)
+	}
+
+	if merge {
+		err = Merge(userID, accountID, client)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return Get(accountID, client)
+}
+
+// SignInAddress is the address a sign in link is for, to ask the user before merging into its account
+func SignInAddress(token string, secret string) (string, error) {
+	_, _, address, err := parseSignIn(token, secret)
+
+	return address, err
+}
+
+func parseSignIn(token string, secret string) (string, string, string, error) {
+	payload, err := signing.Verify(secret, token)
+
+	if err != nil {
+		return "", "", "", ErrInvalidLink
+	}
+
+	parts := strings.SplitN(payload, ":", 4)
+
+	if len(parts) != 4 || parts[0] != "signin" {
+		return "", "", "", ErrInvalidLink
+	}
+
+	return parts[1], parts[2], parts[3], nil
+}
+
+// Merge moves everything fromID has over to toID, including the phone number and email they can be recovered with
+func Merge(fromID string, toID string, client *dynamodb.Client) error {
+	if fromID == toID {
+		return nil
+	}
+
+	err := room.MergeUser(fromID, toID, client)
+
+	if err != nil {
+		return err
+	}
+
+	err = template.Reassign(fromID, toID, client)
+
+	if err != nil {
+		return err
+	}
+
+	err = reassignTokens(fromID, toID, client)
+
+	if err != nil {
+		return err
+	}
+
+	from, err := Get(fromID, client)
+
+	if err != nil {
+		return err
+	}
+
+	values := map[string]types.AttributeValue{
+		":from": &types.AttributeValueMemberS{Value: fromID},
+		":to":   &types.AttributeValueMemberS{Value: toID},
+	}
+
+	if from.Phone != "" && from.PhoneVerifiedAt != nil {
+		err = movePhone(*from, toID, client)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// Signing in with the old address leads to the account from now on
+	if from.Email != "" {
+		err = updateIgnoringCondition(emailKey(from.Email), "set userID = :to", "userID = :from", values, client)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// So does signing in with the identity provider
+	if from.OidcSubject != "" {
+		err = updateIgnoringCondition(identityKey(from.OidcIssuer, from.OidcSubject), "set userID = :to", "userID = :from", values, client)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// linkEmail makes userID the account for the address, replacing any address they linked before
+func linkEmail(address string, userID string, client *dynamodb.Client) (*User, error) {
+	existing, err := Get(userID, client)
+
+	if err != nil {
+		return nil, err
+	}
+
+	item, err := attributevalue.MarshalMap(emailAddress{
+		PK:     fmt.Sprintf("EMAIL#%s", address),
+		SK:     fmt.Sprintf("EMAIL#%s", address),
+		Type:   dynamodbTypes.Email,
+		UserID: userID,
+	})
+
+	if err != nil {
+		panic(err)
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	transactItems := []types.TransactWriteItem{
+		{
+			Put: &types.Put{
+				TableName:           aws.String(os.Getenv("table")),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_not_exists(PK)"),
+			},
+		},
+		{
+			Update: &types.Update{
+				TableName:        aws.String(os.Getenv("table")),
+				Key:              key(userID),
+				UpdateExpression: aws.String("set #type = :type, id = :userID, email = :email, emailVerifiedAt = :now, createdAt = if_not_exists(createdAt, :now)"),
+				// type is a reserved word
+				ExpressionAttributeNames: map[string]string{
+					"#type": "type",
+				},
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":type":   &types.AttributeValueMemberS{Value: dynamodbTypes.User},
+					":userID": &types.AttributeValueMemberS{Value: userID},
+					":email":  &types.AttributeValueMemberS{Value: address},
+					":now":    &types.AttributeValueMemberS{Value: now},
+				},
+			},
+		},
+	}
+
+	if existing.Email != "" && existing.Email != address {
+		transactItems = append(transactItems, types.TransactWriteItem{
+			Delete: &types.Delete{
+				TableName:           aws.String(os.Getenv("table")),
+				Key:                 emailKey(existing.Email),
+				ConditionExpression: aws.String("userID = :userID"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":userID": &types.AttributeValueMemberS{Value: userID},
+				},
+			},
+		})
+	}
+
+	_, err = client.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{
+		TransactItems: transactItems,
+	})
+
+	var cancelled *types.TransactionCanceledException
+	if errors.As(err, &cancelled) {
+		return nil, ErrEmailTaken
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return Get(userID, client)
+}
+
+// lookupEmail is the account an address is linked to, if any
+func lookupEmail(address string, client *dynamodb.Client) (string, error) {
+	res, err := client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName:      aws.String(os.Getenv("table")),
+		ConsistentRead: aws.Bool(true),
+		Key:            emailKey(address),
+	})
+
+	if err != nil || res.Item == nil {
+		return "", err
+	}
+
+	linked := &emailAddress{}
+
+	if err := attributevalue.UnmarshalMap(res.Item, linked); err != nil {
+		panic(err)
+	}
+
+	return linked.UserID, nil
+}
+
+// updateIgnoringCondition treats a failed condition as already done
+func updateIgnoringCondition(key map[string]types.AttributeValue, update string, condition string, values map[string]types.AttributeValue, client *dynamodb.Client) error {
+	_, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(os.Getenv("table")),
+		Key:                       key,
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeValues: values,
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return nil
+	}
+
+	return err
+}
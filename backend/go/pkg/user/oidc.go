@@ -0,0 +1,219 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"picker/backend/go/pkg/dynamodbTypes"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/twinj/uuid"
+)
+
+type ConfirmOidcRequest struct {
+	// ConfirmMerge is the OidcAccountName of the account the user agreed to move this device's rooms into
+	ConfirmMerge string `json:"confirmMerge" binding:"required,max=1000"`
+}
+
+// identity points an identity provider's subject at the account it signed in as
+type identity struct {
+	// DynamoDB
+	PK   string `dynamodbav:"PK"`
+	SK   string `dynamodbav:"SK"`
+	Type string `dynamodbav:"type"`
+
+	UserID string `dynamodbav:"userID"`
+}
+
+func identityKey(issuer string, subject string) map[string]types.AttributeValue {
+	id := fmt.Sprintf("OIDC#%s#%s", issuer, subject)
+
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: id},
+		"SK": &types.AttributeValueMemberS{Value: id},
+	}
+}
+
+// SignInWithOidc returns the account for a verified subject, email is the verified address from the ID token, if any.
+//
+// Like signing in by email, the first user ID to sign in as a subject becomes its account and later ones are merged
+// into it once confirmMerge is the account's OidcAccountName, until then ErrConfirmMerge is returned.
+// A user ID that is already someone, with an email, phone number or another subject, is never merged or linked,
+// that person gets a new account instead.
+func SignInWithOidc(issuer string, subject string, email string, userID string, confirmMerge string, client *dynamodb.Client) (*User, error) {
+	accountID, err := lookupIdentity(issuer, subject, client)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if accountID != "" && accountID == userID {
+		return updateOidcEmail(accountID, email, client)
+	}
+
+	current, err := Get(userID, client)
+
+	if err != nil {
+		return nil, err
+	}
+
+	signedInAsSomeoneElse := current.Email != "" || (current.Phone != "" && current.PhoneVerifiedAt != nil) ||
+		(current.OidcSubject != "" && (current.OidcIssuer != issuer || current.OidcSubject != subject))
+
+	if accountID == "" {
+		if signedInAsSomeoneElse {
+			userID = uuid.NewV4().String()
+		}
+
+		return linkIdentity(issuer, subject, email, userID, client)
+	}
+
+	if !signedInAsSomeoneElse {
+		if confirmMerge != OidcAccountName(subject, email) {
+			return nil, ErrConfirmMerge
+		}
+
+		err = Merge(userID, accountID, client)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return updateOidcEmail(accountID, email, client)
+}
+
+// OidcAccountName is how the account is named when asking before merging into it, the subject if there is no verified address
+func OidcAccountName(subject string, email string) string {
+	if email != "" {
+		return email
+	}
+
+	return subject
+}
+
+// linkIdentity makes userID the account for the subject
+func linkIdentity(issuer string, subject string, email string, userID string, client *dynamodb.Client) (*User, error) {
+	item, err := attributevalue.MarshalMap(identity{
+		Type:   dynamodbTypes.Identity,
+		UserID: userID,
+	})
+
+	if err != nil {
+		panic(err)
+	}
+
+	for k, v := range identityKey(issuer, subject) {
+		item[k] = v
+	}
+
+	update := oidcUpdate(userID, email, "oidcIssuer = :issuer, oidcSubject = :subject, #type = :type, id = :userID, createdAt = if_not_exists(createdAt, :now), ")
+	// type is a reserved word
+	update.ExpressionAttributeNames = map[string]string{
+		"#type": "type",
+	}
+	update.ExpressionAttributeValues[":issuer"] = &types.AttributeValueMemberS{Value: issuer}
+	update.ExpressionAttributeValues[":subject"] = &types.AttributeValueMemberS{Value: subject}
+	update.ExpressionAttributeValues[":type"] = &types.AttributeValueMemberS{Value: dynamodbTypes.User}
+	update.ExpressionAttributeValues[":userID"] = &types.AttributeValueMemberS{Value: userID}
+
+	_, err = client.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				Put: &types.Put{
+					TableName:           aws.String(os.Getenv("table")),
+					Item:                item,
+					ConditionExpression: aws.String("attribute_not_exists(PK)"),
+				},
+			},
+			{
+				Update: update,
+			},
+		},
+	})
+
+	// Someone else signed in as the same subject at the same time, their account is the one to use
+	var cancelled *types.TransactionCanceledException
+	if errors.As(err, &cancelled) {
+		accountID, err := lookupIdentity(issuer, subject, client)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return Get(accountID, client)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return Get(userID, client)
+}
+
+// updateOidcEmail keeps the address from the latest sign in, the issuer can change it
+func updateOidcEmail(userID string, email string, client *dynamodb.Client) (*User, error) {
+	update := oidcUpdate(userID, email, "")
+
+	res, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:                 update.TableName,
+		Key:                       update.Key,
+		UpdateExpression:          update.UpdateExpression,
+		ExpressionAttributeValues: update.ExpressionAttributeValues,
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	user := Unmarshal(res.Attributes)
+
+	return &user, nil
+}
+
+// oidcUpdate records the sign in on the profile, set is any other assignments to make, each followed by a comma
+func oidcUpdate(userID string, email string, set string) *types.Update {
+	update := &types.Update{
+		TableName:        aws.String(os.Getenv("table")),
+		Key:              key(userID),
+		UpdateExpression: aws.String(fmt.Sprintf("set %soidcSignedInAt = :now remove oidcEmail", set)),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
+		},
+	}
+
+	// An address the issuer no longer vouches for is dropped
+	if email != "" {
+		update.UpdateExpression = aws.String(fmt.Sprintf("set %soidcSignedInAt = :now, oidcEmail = :email", set))
+		update.ExpressionAttributeValues[":email"] = &types.AttributeValueMemberS{Value: email}
+	}
+
+	return update
+}
+
+// lookupIdentity is the account a subject signed in as, if any
+func lookupIdentity(issuer string, subject string, client *dynamodb.Client) (string, error) {
+	res, err := client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName:      aws.String(os.Getenv("table")),
+		ConsistentRead: aws.Bool(true),
+		Key:            identityKey(issuer, subject),
+	})
+
+	if err != nil || res.Item == nil {
+		return "", err
+	}
+
+	linked := &identity{}
+
+	if err := attributevalue.UnmarshalMap(res.Item, linked); err != nil {
+		panic(err)
+	}
+
+	return linked.UserID, nil
+}
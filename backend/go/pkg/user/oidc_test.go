@@ -0,0 +1,277 @@
+package user_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"picker/backend/go/pkg/oidc"
+	"picker/backend/go/pkg/oidc/oidctest"
+	"picker/backend/go/pkg/user"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/twinj/uuid"
+)
+
+const clientID = "picker"
+const redirectURL = "https://picknow.example/api/oidc/callback"
+
+// These sign in at the mock issuer, then hand the verified claims to SignInWithOidc the way the callback does.
+// They run against DynamoDB Local, e.g. DYNAMODB_ENDPOINT=http://localhost:8000 go test ./pkg/user
+
+func TestSignInLinksCurrentUser(t *testing.T) {
+	issuer, p, client := setup(t)
+	deviceID := uuid.NewV4().String()
+
+	claims := signIn(t, p, "someone@example.com", false)
+
+	account, err := user.SignInWithOidc(issuer.URL, claims.Subject, claims.VerifiedEmail(), deviceID, "", client)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if account.ID != deviceID {
+		t.Errorf("signed in as %s, want the device's user %s", account.ID, deviceID)
+	}
+
+	if account.OidcSubject != claims.Subject || account.OidcIssuer != issuer.URL {
+		t.Errorf("signed in as %s at %s, want %s at %s", account.OidcSubject, account.OidcIssuer, claims.Subject, issuer.URL)
+	}
+
+	if account.OidcEmail != "someone@example.com" {
+		t.Errorf("email %q, want someone@example.com", account.OidcEmail)
+	}
+}
+
+func TestSignInOnAnotherDevice(t *testing.T) {
+	issuer, p, client := setup(t)
+	firstID := uuid.NewV4().String()
+	secondID := uuid.NewV4().String()
+
+	claims := signIn(t, p, "someone@example.com", false)
+
+	if _, err := user.SignInWithOidc(issuer.URL, claims.Subject, claims.VerifiedEmail(), firstID, "", client); err != nil {
+		t.Fatal(err)
+	}
+
+	claims = signIn(t, p, "someone@example.com", false)
+
+	// Nothing is moved until the person agrees
+	if _, err := user.SignInWithOidc(issuer.URL, claims.Subject, claims.VerifiedEmail(), secondID, "", client); !errors.Is(err, user.ErrConfirmMerge) {
+		t.Fatalf("got %v, want ErrConfirmMerge", err)
+	}
+
+	account, err := user.SignInWithOidc(issuer.URL, claims.Subject, claims.VerifiedEmail(), secondID, user.OidcAccountName(claims.Subject, claims.VerifiedEmail()), client)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if account.ID != firstID {
+		t.Errorf("signed in as %s, want the first device's user %s", account.ID, firstID)
+	}
+}
+
+func TestSignInAsSomeoneElse(t *testing.T) {
+	issuer, p, client := setup(t)
+	deviceID := uuid.NewV4().String()
+
+	claims := signIn(t, p, "someone@example.com", false)
+
+	if _, err := user.SignInWithOidc(issuer.URL, claims.Subject, claims.VerifiedEmail(), deviceID, "", client); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new subject on a device that is already someone gets their own account
+	claims = signIn(t, p, "someone.else@example.com", false)
+
+	account, err := user.SignInWithOidc(issuer.URL, claims.Subject, claims.VerifiedEmail(), deviceID, "", client)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if account.ID == deviceID {
+		t.Fatal("signed in as the device's user, want a new account")
+	}
+
+	if account.OidcSubject != claims.Subject {
+		t.Errorf("signed in as %s, want %s", account.OidcSubject, claims.Subject)
+	}
+
+	// and signing in as them again doesn't merge the device's user into theirs
+	again, err := user.SignInWithOidc(issuer.URL, claims.Subject, claims.VerifiedEmail(), deviceID, "", client)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again.ID != account.ID {
+		t.Errorf("signed in as %s, want %s", again.ID, account.ID)
+	}
+
+	device, err := user.Get(deviceID, client)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if device.OidcSubject != oidctest.Subject("someone@example.com") {
+		t.Errorf("the device's user is signed in as %s, want the first subject", device.OidcSubject)
+	}
+}
+
+func TestSignInUnverifiedEmail(t *testing.T) {
+	issuer, p, client := setup(t)
+	deviceID := uuid.NewV4().String()
+
+	claims := signIn(t, p, "someone@example.com", false)
+
+	if _, err := user.SignInWithOidc(issuer.URL, claims.Subject, claims.VerifiedEmail(), deviceID, "", client); err != nil {
+		t.Fatal(err)
+	}
+
+	// The issuer stops vouching for the address
+	claims = signIn(t, p, "someone@example.com", true)
+
+	account, err := user.SignInWithOidc(issuer.URL, claims.Subject, claims.VerifiedEmail(), deviceID, "", client)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if account.OidcEmail != "" {
+		t.Errorf("email %q, want none", account.OidcEmail)
+	}
+}
+
+// setup starts the mock issuer and makes a table of its own in DynamoDB Local, shaped like the one in cdk
+func setup(t *testing.T) (*oidctest.Issuer, *oidc.Provider, *dynamodb.Client) {
+	t.Helper()
+
+	endpoint := os.Getenv("DYNAMODB_ENDPOINT")
+
+	if endpoint == "" {
+		t.Skip("DYNAMODB_ENDPOINT isn't set, start DynamoDB Local to run these")
+	}
+
+	issuer, err := oidctest.New("", clientID, "")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(issuer.Handler())
+	t.Cleanup(server.Close)
+
+	issuer.URL = server.URL
+
+	client := dynamodb.New(dynamodb.Options{
+		Region:           "local",
+		EndpointResolver: dynamodb.EndpointResolverFromURL(endpoint),
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "local", SecretAccessKey: "local"}, nil
+		}),
+	})
+
+	table := "picker-" + uuid.NewV4().String()
+	t.Setenv("table", table)
+
+	_, err = client.CreateTable(context.Background(), &dynamodb.CreateTableInput{
+		TableName:   aws.String(table),
+		BillingMode: types.BillingModePayPerRequest,
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("PK"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("SK"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("GSI1PK"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("GSI1SK"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("GSI2PK"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("GSI2SK"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("PK"), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String("SK"), KeyType: types.KeyTypeRange},
+		},
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{
+			index("GSI1"),
+			index("GSI2"),
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		client.DeleteTable(context.Background(), &dynamodb.DeleteTableInput{TableName: aws.String(table)})
+	})
+
+	return issuer, oidc.New(server.URL, clientID, "", redirectURL), client
+}
+
+func index(name string) types.GlobalSecondaryIndex {
+	return types.GlobalSecondaryIndex{
+		IndexName: aws.String(name),
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String(name + "PK"), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String(name + "SK"), KeyType: types.KeyTypeRange},
+		},
+		Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+	}
+}
+
+// signIn goes through the issuer's sign in page and the code exchange
+func signIn(t *testing.T, p *oidc.Provider, email string, unverified bool) *oidc.Claims {
+	t.Helper()
+
+	verifier, err := oidc.RandomString()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authURL, err := p.AuthCodeURL(context.Background(), "state", "nonce", verifier)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{"email": {email}}
+	if unverified {
+		form.Set("unverified", "on")
+	}
+
+	browser := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	res, err := browser.PostForm(authURL, form)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res.Body.Close()
+
+	location, err := url.Parse(res.Header.Get("Location"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := p.Exchange(context.Background(), location.Query().Get("code"), verifier, "nonce")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return claims
+}
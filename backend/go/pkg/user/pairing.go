@@ -0,0 +1,148 @@
+package user
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"picker/backend/go/pkg/dynamodbTypes"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	// Pairing codes are removed by the table's TTL after this long
+	pairingTTL = 5 * time.Minute
+	// Letters and digits that can't be mistaken for each other when typed from another screen
+	pairingAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	pairingLength   = 8
+)
+
+var ErrInvalidPairingCode = errors.New("pairing code is wrong, used or expired")
+
+type PairRequest struct {
+	Code string `json:"code" binding:"required,max=20"`
+}
+
+// pairing lets another device take on userID, the key is a hash so the code itself is never stored
+type pairing struct {
+	// DynamoDB
+	PK        string `dynamodbav:"PK"`
+	SK        string `dynamodbav:"SK"`
+	Type      string `dynamodbav:"type"`
+	ExpiresAt int64  `dynamodbav:"expiresAt"`
+
+	UserID string `dynamodbav:"userID"`
+}
+
+type Pairing struct {
+	Code      string    `json:"code"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// Link opens the pair page with the code filled in, for showing as a QR code
+	Link string `json:"link"`
+}
+
+func pairingKey(code string) map[string]types.AttributeValue {
+	sum := sha256.Sum256([]byte(normalisePairingCode(code)))
+	id := fmt.Sprintf("PAIRING#%s", hex.EncodeToString(sum[:]))
+
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: id},
+		"SK": &types.AttributeValueMemberS{Value: id},
+	}
+}
+
+// normalisePairingCode accepts codes typed in lowercase or with the dash and spaces left in
+func normalisePairingCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToUpper(code))
+}
+
+// CreatePairing makes a single use code that signs another device in as userID
+func CreatePairing(userID string, siteURL string, client *dynamodb.Client) (*Pairing, error) {
+	var sb strings.Builder
+
+	for i := 0; i < pairingLength; i++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(pairingAlphabet))))
+
+		if err != nil {
+			return nil, err
+		}
+
+		sb.WriteByte(pairingAlphabet[n.Int64()])
+	}
+
+	code := sb.String()
+	code = code[:pairingLength/2] + "-" + code[pairingLength/2:]
+	expiresAt := time.Now().UTC().Add(pairingTTL)
+
+	item, err := attributevalue.MarshalMap(pairing{
+		Type:      dynamodbTypes.Pairing,
+		ExpiresAt: expiresAt.Unix(),
+		UserID:    userID,
+	})
+
+	if err != nil {
+		panic(err)
+	}
+
+	for k, v := range pairingKey(code) {
+		item[k] = v
+	}
+
+	_, err = client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName: aws.String(os.Getenv("table")),
+		Item:      item,
+		// Another live code with the same value would be a one in a trillion clash
+		ConditionExpression: aws.String("attribute_not_exists(PK)"),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Pairing{
+		Code:      code,
+		ExpiresAt: expiresAt,
+		Link:      fmt.Sprintf("%s/pair?code=%s", strings.TrimRight(siteURL, "/"), url.QueryEscape(code)),
+	}, nil
+}
+
+// RedeemPairing uses up the code and returns the user ID the new device should take on
+func RedeemPairing(code string, client *dynamodb.Client) (*User, error) {
+	res, err := client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName:           aws.String(os.Getenv("table")),
+		Key:                 pairingKey(code),
+		ConditionExpression: aws.String("attribute_exists(PK) and expiresAt > :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberN{Value: fmt.Sprint(time.Now().Unix())},
+		},
+		ReturnValues: types.ReturnValueAllOld,
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return nil, ErrInvalidPairingCode
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	stored := &pairing{}
+
+	if err := attributevalue.UnmarshalMap(res.Attributes, stored); err != nil {
+		panic(err)
+	}
+
+	return Get(stored.UserID, client)
+}
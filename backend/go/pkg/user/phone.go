@@ -0,0 +1,594 @@
+package user
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"picker/backend/go/pkg/dynamodbTypes"
+	"picker/backend/go/pkg/sms"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// Codes are removed by the table's TTL after this long
+	codeTTL = 10 * time.Minute
+	// A new code for the same number can't be sent any sooner than this
+	resendAfter = time.Minute
+	// A code is thrown away after this many wrong guesses
+	maxCodeAttempts = 5
+)
+
+// Budgets cap what one number or user can use up over a day, whatever codes are sent in between
+const (
+	budgetWindow = 24 * time.Hour
+	// Texts sent to a number and asked for by a user
+	maxDailySends = 5
+	// Guesses at codes for a number and by a user
+	maxDailyGuesses = 20
+)
+
+const (
+	purposeLink    = "link"
+	purposeRecover = "recover"
+)
+
+const (
+	budgetSend   = "SEND"
+	budgetVerify = "VERIFY"
+)
+
+var ErrPhoneTaken = errors.New("phone number is linked to someone else")
+var ErrInvalidCode = errors.New("code is wrong or has expired")
+var ErrTooSoon = errors.New("a code was sent recently, try again in a minute")
+var ErrDailyLimit = errors.New("too many codes today, try again tomorrow")
+
+type PhoneRequest struct {
+	Phone string `json:"phone" binding:"required,e164"`
+}
+
+type VerifyPhoneRequest struct {
+	Phone string `json:"phone" binding:"required,e164"`
+	Code  string `json:"code" binding:"required,len=6,numeric"`
+}
+
+// code is a one time code sent to a phone number, only its hash is stored
+type code struct {
+	// DynamoDB
+	PK        string `dynamodbav:"PK"`
+	SK        string `dynamodbav:"SK"`
+	Type      string `dynamodbav:"type"`
+	ExpiresAt int64  `dynamodbav:"expiresAt"`
+
+	Hash     string `dynamodbav:"hash"`
+	UserID   string `dynamodbav:"userID"`
+	Attempts int    `dynamodbav:"attempts"`
+	SentAt   int64  `dynamodbav:"sentAt"`
+}
+
+// phone looks up who a verified number belongs to
+type phone struct {
+	// DynamoDB
+	PK   string `dynamodbav:"PK"`
+	SK   string `dynamodbav:"SK"`
+	Type string `dynamodbav:"type"`
+
+	UserID string `dynamodbav:"userID"`
+}
+
+func phoneKey(number string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("PHONE#%s", number)},
+		"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("PHONE#%s", number)},
+	}
+}
+
+func codeKey(number string, purpose string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("PHONE#%s", number)},
+		"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("CODE#%s", purpose)},
+	}
+}
+
+// budgetKeys are the number's and the user's budgets for the same thing, both have to have room
+func budgetKeys(number string, userID string, budget string) []map[string]types.AttributeValue {
+	return []map[string]types.AttributeValue{
+		{
+			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("PHONE#%s", number)},
+			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("BUDGET#%s", budget)},
+		},
+		{
+			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", userID)},
+			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("BUDGET#%s", budget)},
+		},
+	}
+}
+
+// RequestLink texts a code to the number, which userID sends back to VerifyLink
+func RequestLink(number string, userID string, sender sms.Sender, client *dynamodb.Client) error {
+	linkedTo, err := lookup(number, client)
+
+	if err != nil {
+		return err
+	}
+
+	if linkedTo != "" && linkedTo != userID {
+		return ErrPhoneTaken
+	}
+
+	if err := spendBudget(number, userID, budgetSend, maxDailySends, client); err != nil {
+		return err
+	}
+
+	return sendCode(number, purposeLink, userID, sender, client)
+}
+
+// VerifyLink links the number to userID, replacing any number they linked before
+func VerifyLink(number string, sent string, userID string, client *dynamodb.Client) (*User, error) {
+	requestedBy, err := checkCode(number, purposeLink, sent, userID, client)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Codes can only be used by whoever asked for them
+	if requestedBy != userID {
+		return nil, ErrInvalidCode
+	}
+
+	existing, err := Get(userID, client)
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	item, err := attributevalue.MarshalMap(phone{
+		PK:     fmt.Sprintf("PHONE#%s", number),
+		SK:     fmt.Sprintf("PHONE#%s", number),
+		Type:   dynamodbTypes.Phone,
+		UserID: userID,
+	})
+
+	if err != nil {
+		panic(err)
+	}
+
+	transactItems := []types.TransactWriteItem{
+		{
+			Put: &types.Put{
+				TableName:           aws.String(os.Getenv("table")),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_not_exists(PK) or userID = :userID"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":userID": &types.AttributeValueMemberS{Value: userID},
+				},
+			},
+		},
+		{
+			Update: &types.Update{
+				TableName:        aws.String(os.Getenv("table")),
+				Key:              key(userID),
+				UpdateExpression: aws.String("set #type = :type, id = :userID, phone = :phone, phoneVerifiedAt = :now, createdAt = if_not_exists(createdAt, :now)"),
+				// type is a reserved word
+				ExpressionAttributeNames: map[string]string{
+					"#type": "type",
+				},
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":type":   &types.AttributeValueMemberS{Value: dynamodbTypes.User},
+					":userID": &types.AttributeValueMemberS{Value: userID},
+					":phone":  &types.AttributeValueMemberS{Value: number},
+					":now":    &types.AttributeValueMemberS{Value: now.Format(time.RFC3339)},
+				},
+			},
+		},
+	}
+
+	// The old number stops recovering the user
+	if existing.Phone != "" && existing.Phone != number {
+		transactItems = append(transactItems, types.TransactWriteItem{
+			Delete: &types.Delete{
+				TableName:           aws.String(os.Getenv("table")),
+				Key:                 phoneKey(existing.Phone),
+				ConditionExpression: aws.String("userID = :userID"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":userID": &types.AttributeValueMemberS{Value: userID},
+				},
+			},
+		})
+	}
+
+	_, err = client.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{
+		TransactItems: transactItems,
+	})
+
+	var cancelled *types.TransactionCanceledException
+	if errors.As(err, &cancelled) && len(cancelled.CancellationReasons) > 0 && aws.ToString(cancelled.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+		return nil, ErrPhoneTaken
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return Get(userID, client)
+}
+
+// Unlink removes userID's number, they can no longer recover with it
+func Unlink(userID string, client *dynamodb.Client) (*User, error) {
+	existing, err := Get(userID, client)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if existing.Phone == "" {
+		return existing, nil
+	}
+
+	_, err = client.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				Delete: &types.Delete{
+					TableName:           aws.String(os.Getenv("table")),
+					Key:                 phoneKey(existing.Phone),
+					ConditionExpression: aws.String("attribute_not_exists(PK) or userID = :userID"),
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":userID": &types.AttributeValueMemberS{Value: userID},
+					},
+				},
+			},
+			{
+				Update: &types.Update{
+					TableName:           aws.String(os.Getenv("table")),
+					Key:                 key(userID),
+					UpdateExpression:    aws.String("remove phone, phoneVerifiedAt"),
+					ConditionExpression: aws.String("phone = :phone"),
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":phone": &types.AttributeValueMemberS{Value: existing.Phone},
+					},
+				},
+			},
+		},
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return Get(userID, client)
+}
+
+// movePhone gives from's number to toID if it doesn't have one, otherwise the number is unlinked.
+// The number and the profile change together, so a number never recovers an account that doesn't show it
+func movePhone(from User, toID string, client *dynamodb.Client) error {
+	_, err := client.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				Update: &types.Update{
+					TableName:           aws.String(os.Getenv("table")),
+					Key:                 phoneKey(from.Phone),
+					UpdateExpression:    aws.String("set userID = :to"),
+					ConditionExpression: aws.String("userID = :from"),
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":from": &types.AttributeValueMemberS{Value: from.ID},
+						":to":   &types.AttributeValueMemberS{Value: toID},
+					},
+				},
+			},
+			{
+				Update: &types.Update{
+					TableName:           aws.String(os.Getenv("table")),
+					Key:                 key(toID),
+					UpdateExpression:    aws.String("set phone = :phone, phoneVerifiedAt = :verifiedAt"),
+					ConditionExpression: aws.String("attribute_exists(PK) and (attribute_not_exists(phone) or phone = :phone)"),
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":phone":      &types.AttributeValueMemberS{Value: from.Phone},
+						":verifiedAt": &types.AttributeValueMemberS{Value: from.PhoneVerifiedAt.Format(time.RFC3339)},
+					},
+				},
+			},
+		},
+	})
+
+	var cancelled *types.TransactionCanceledException
+	if !errors.As(err, &cancelled) || len(cancelled.CancellationReasons) != 2 {
+		return err
+	}
+
+	for _, reason := range cancelled.CancellationReasons {
+		if code := aws.ToString(reason.Code); code != "None" && code != "ConditionalCheckFailed" {
+			return err
+		}
+	}
+
+	// The number was already moved or linked to someone else since
+	if aws.ToString(cancelled.CancellationReasons[1].Code) != "ConditionalCheckFailed" {
+		return nil
+	}
+
+	// The account has its own number, from's stops recovering anyone
+	_, err = client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName:           aws.String(os.Getenv("table")),
+		Key:                 phoneKey(from.Phone),
+		ConditionExpression: aws.String("userID = :from"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":from": &types.AttributeValueMemberS{Value: from.ID},
+		},
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return nil
+	}
+
+	return err
+}
+
+// RequestRecovery texts a code to a linked number. Unknown numbers get nothing but look the same to the caller,
+// so the endpoint can't be used to find out who has linked a number. The budgets are spent either way for the same reason.
+func RequestRecovery(number string, requesterID string, sender sms.Sender, client *dynamodb.Client) error {
+	if err := spendBudget(number, requesterID, budgetSend, maxDailySends, client); err != nil {
+		return err
+	}
+
+	userID, err := lookup(number, client)
+
+	if err != nil || userID == "" {
+		return err
+	}
+
+	return sendCode(number, purposeRecover, userID, sender, client)
+}
+
+// Recover returns the user the number is linked to, for the session to switch to
+func Recover(number string, sent string, requesterID string, client *dynamodb.Client) (*User, error) {
+	userID, err := checkCode(number, purposeRecover, sent, requesterID, client)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The number may have been unlinked since the code was sent
+	linkedTo, err := lookup(number, client)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if linkedTo != userID {
+		return nil, ErrInvalidCode
+	}
+
+	return Get(userID, client)
+}
+
+// lookup is the user ID a number is linked to, if any
+func lookup(number string, client *dynamodb.Client) (string, error) {
+	res, err := client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName:      aws.String(os.Getenv("table")),
+		ConsistentRead: aws.Bool(true),
+		Key:            phoneKey(number),
+	})
+
+	if err != nil || res.Item == nil {
+		return "", err
+	}
+
+	linked := &phone{}
+
+	if err := attributevalue.UnmarshalMap(res.Item, linked); err != nil {
+		panic(err)
+	}
+
+	return linked.UserID, nil
+}
+
+// sendCode replaces any earlier code for the same number and purpose, guesses at a code that hasn't expired carry over
+func sendCode(number string, purpose string, userID string, sender sms.Sender, client *dynamodb.Client) error {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+
+	if err != nil {
+		return err
+	}
+
+	sent := fmt.Sprintf("%06d", n.Int64())
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(sent), bcrypt.DefaultCost)
+
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	item, err := attributevalue.MarshalMap(code{
+		PK:        fmt.Sprintf("PHONE#%s", number),
+		SK:        fmt.Sprintf("CODE#%s", purpose),
+		Type:      dynamodbTypes.Code,
+		ExpiresAt: now.Add(codeTTL).Unix(),
+		Hash:      string(hash),
+		UserID:    userID,
+		SentAt:    now.Unix(),
+	})
+
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName:           aws.String(os.Getenv("table")),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(PK) or expiresAt <= :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberN{Value: fmt.Sprint(now.Unix())},
+		},
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		_, err = client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+			TableName:        aws.String(os.Getenv("table")),
+			Key:              codeKey(number, purpose),
+			UpdateExpression: aws.String("set #hash = :hash, userID = :userID, sentAt = :sentAt, expiresAt = :expiresAt"),
+			// hash is a reserved word
+			ExpressionAttributeNames: map[string]string{
+				"#hash": "hash",
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":hash":        &types.AttributeValueMemberS{Value: string(hash)},
+				":userID":      &types.AttributeValueMemberS{Value: userID},
+				":sentAt":      &types.AttributeValueMemberN{Value: fmt.Sprint(now.Unix())},
+				":expiresAt":   &types.AttributeValueMemberN{Value: fmt.Sprint(now.Add(codeTTL).Unix())},
+				":resendAfter": &types.AttributeValueMemberN{Value: fmt.Sprint(now.Add(-resendAfter).Unix())},
+			},
+			ConditionExpression: aws.String("sentAt <= :resendAfter"),
+		})
+	}
+
+	if errors.As(err, &conditionErr) {
+		return ErrTooSoon
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return sender.Send(context.TODO(), number, fmt.Sprintf("Your picknow code is %s", sent))
+}
+
+// checkCode uses up the code and returns the user ID it was sent for,
+// every guess counts against the code and the number's and guesser's budgets
+func checkCode(number string, purpose string, sent string, guesserID string, client *dynamodb.Client) (string, error) {
+	if err := spendBudget(number, guesserID, budgetVerify, maxDailyGuesses, client); err != nil {
+		return "", err
+	}
+
+	res, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:        aws.String(os.Getenv("table")),
+		Key:              codeKey(number, purpose),
+		UpdateExpression: aws.String("add attempts :one"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+			":max": &types.AttributeValueMemberN{Value: fmt.Sprint(maxCodeAttempts)},
+			":now": &types.AttributeValueMemberN{Value: fmt.Sprint(time.Now().Unix())},
+		},
+		ConditionExpression: aws.String("attribute_exists(PK) and attempts < :max and expiresAt > :now"),
+		ReturnValues:        types.ReturnValueAllNew,
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return "", ErrInvalidCode
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	stored := &code{}
+
+	if err := attributevalue.UnmarshalMap(res.Attributes, stored); err != nil {
+		panic(err)
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(stored.Hash), []byte(sent)) != nil {
+		return "", ErrInvalidCode
+	}
+
+	// Only one request gets to use the code
+	_, err = client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName:           aws.String(os.Getenv("table")),
+		Key:                 codeKey(number, purpose),
+		ConditionExpression: aws.String("#hash = :hash"),
+		// hash is a reserved word
+		ExpressionAttributeNames: map[string]string{
+			"#hash": "hash",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":hash": &types.AttributeValueMemberS{Value: stored.Hash},
+		},
+	})
+
+	if errors.As(err, &conditionErr) {
+		return "", ErrInvalidCode
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return stored.UserID, nil
+}
+
+// spendBudget takes one from the number's and the user's budgets, failing with ErrDailyLimit if either has run out
+func spendBudget(number string, userID string, budget string, max int, client *dynamodb.Client) error {
+	for _, key := range budgetKeys(number, userID, budget) {
+		spent, err := spend(key, max, client)
+
+		if err != nil {
+			return err
+		}
+
+		if !spent {
+			return ErrDailyLimit
+		}
+	}
+
+	return nil
+}
+
+// spend starts a new window if the last one is over, otherwise adds to it as long as it is under max
+func spend(key map[string]types.AttributeValue, max int, client *dynamodb.Client) (bool, error) {
+	now := time.Now()
+
+	_, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:        aws.String(os.Getenv("table")),
+		Key:              key,
+		UpdateExpression: aws.String("set spent = :one, expiresAt = :expiresAt, #type = :type"),
+		// type is a reserved word
+		ExpressionAttributeNames: map[string]string{
+			"#type": "type",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":type":      &types.AttributeValueMemberS{Value: dynamodbTypes.Budget},
+			":one":       &types.AttributeValueMemberN{Value: "1"},
+			":now":       &types.AttributeValueMemberN{Value: fmt.Sprint(now.Unix())},
+			":expiresAt": &types.AttributeValueMemberN{Value: fmt.Sprint(now.Add(budgetWindow).Unix())},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(expiresAt) or expiresAt <= :now"),
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if !errors.As(err, &conditionErr) {
+		return err == nil, err
+	}
+
+	_, err = client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:        aws.String(os.Getenv("table")),
+		Key:              key,
+		UpdateExpression: aws.String("add spent :one"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+			":max": &types.AttributeValueMemberN{Value: fmt.Sprint(max)},
+			":now": &types.AttributeValueMemberN{Value: fmt.Sprint(now.Unix())},
+		},
+		// A window that ended in between counts as spent, the next try starts a new one
+		ConditionExpression: aws.String("spent < :max and expiresAt > :now"),
+	})
+
+	if errors.As(err, &conditionErr) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
@@ -0,0 +1,291 @@
+package user
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"picker/backend/go/pkg/dynamodbTypes"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/twinj/uuid"
+)
+
+const (
+	ScopeReadRooms     = "rooms:read"
+	ScopeWriteRooms    = "rooms:write"
+	ScopeManageOptions = "options:write"
+)
+
+const (
+	// Tokens start with this so they are easy to spot if they are leaked
+	tokenPrefix = "pkn_"
+	maxTokens   = 20
+	// lastUsedAt is only written again once it is this old, so using a token doesn't mean a write every time
+	lastUsedResolution = time.Hour
+)
+
+var ErrInvalidToken = errors.New("API token is invalid or has been revoked")
+var ErrTokenNotFound = errors.New("API token not found")
+var ErrTooManyTokens = errors.New("too many API tokens, revoke one first")
+
+type CreateTokenRequest struct {
+	Name   string   `json:"name" binding:"required,max=100"`
+	Scopes []string `json:"scopes" binding:"required,min=1,max=3,dive,oneof=rooms:read rooms:write options:write"`
+}
+
+// Token is an API token, only the sha256 of the secret is stored and it is the key it is looked up by
+type Token struct {
+	// DynamoDB
+	PK     string `dynamodbav:"PK" json:"-"`
+	SK     string `dynamodbav:"SK" json:"-"`
+	GSI1PK string `dynamodbav:"GSI1PK" json:"-"`
+	GSI1SK string `dynamodbav:"GSI1SK" json:"-"`
+	Type   string `dynamodbav:"type" json:"-"`
+
+	ID         string     `dynamodbav:"id" json:"id"`
+	UserID     string     `dynamodbav:"userID" json:"-"`
+	Name       string     `dynamodbav:"name" json:"name"`
+	Scopes     []string   `dynamodbav:"scopes" json:"scopes"`
+	CreatedAt  time.Time  `dynamodbav:"createdAt" json:"createdAt"`
+	LastUsedAt *time.Time `dynamodbav:"lastUsedAt,omitempty" json:"lastUsedAt,omitempty"`
+}
+
+// CreatedToken is the only time the secret is shown
+type CreatedToken struct {
+	Token
+	Secret string `json:"token"`
+}
+
+func tokenKey(secret string) map[string]types.AttributeValue {
+	sum := sha256.Sum256([]byte(secret))
+	id := fmt.Sprintf("TOKEN#%s", hex.EncodeToString(sum[:]))
+
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: id},
+		"SK": &types.AttributeValueMemberS{Value: id},
+	}
+}
+
+// CreateToken makes a token that acts as userID within scopes
+func CreateToken(request CreateTokenRequest, userID string, client *dynamodb.Client) (*CreatedToken, error) {
+	existing, err := ListTokens(userID, client)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(existing) >= maxTokens {
+		return nil, ErrTooManyTokens
+	}
+
+	b := make([]byte, 32)
+
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	secret := tokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	createdAt := time.Now().UTC()
+	id := uuid.NewV4().String()
+
+	token := Token{
+		GSI1PK:    fmt.Sprintf("USER#%s", userID),
+		GSI1SK:    fmt.Sprintf("TOKEN#%s#%s", createdAt.Format(time.RFC3339), id),
+		Type:      dynamodbTypes.Token,
+		ID:        id,
+		UserID:    userID,
+		Name:      request.Name,
+		Scopes:    uniqueScopes(request.Scopes),
+		CreatedAt: createdAt,
+	}
+
+	key := tokenKey(secret)
+	token.PK = key["PK"].(*types.AttributeValueMemberS).Value
+	token.SK = token.PK
+
+	item, err := attributevalue.MarshalMap(token)
+
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName:           aws.String(os.Getenv("table")),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(PK)"),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &CreatedToken{Token: token, Secret: secret}, nil
+}
+
+func uniqueScopes(scopes []string) []string {
+	seen := map[string]bool{}
+	unique := []string{}
+
+	for _, scope := range scopes {
+		if !seen[scope] {
+			seen[scope] = true
+			unique = append(unique, scope)
+		}
+	}
+
+	return unique
+}
+
+// ResolveToken is the token for an Authorization header's secret
+func ResolveToken(secret string, client *dynamodb.Client) (*Token, error) {
+	if !strings.HasPrefix(secret, tokenPrefix) {
+		return nil, ErrInvalidToken
+	}
+
+	// Consistent so a revoked token stops working straight away
+	res, err := client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName:      aws.String(os.Getenv("table")),
+		ConsistentRead: aws.Bool(true),
+		Key:            tokenKey(secret),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Item == nil || dynamodbTypes.GetType(res.Item) != dynamodbTypes.Token {
+		return nil, ErrInvalidToken
+	}
+
+	token := UnmarshalToken(res.Item)
+
+	now := time.Now().UTC()
+
+	if token.LastUsedAt == nil || token.LastUsedAt.Before(now.Add(-lastUsedResolution)) {
+		// Only a record for the owner, a failed write doesn't stop the request
+		client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+			TableName:           aws.String(os.Getenv("table")),
+			Key:                 tokenKey(secret),
+			UpdateExpression:    aws.String("set lastUsedAt = :now"),
+			ConditionExpression: aws.String("attribute_exists(PK)"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":now": &types.AttributeValueMemberS{Value: now.Format(time.RFC3339)},
+			},
+		})
+	}
+
+	return &token, nil
+}
+
+// ListTokens is userID's tokens, oldest first since GSI1SK starts with when they were made
+func ListTokens(userID string, client *dynamodb.Client) ([]Token, error) {
+	tokens := []Token{}
+
+	paginator := dynamodb.NewQueryPaginator(client, &dynamodb.QueryInput{
+		TableName:              aws.String(os.Getenv("table")),
+		IndexName:              aws.String("GSI1"),
+		KeyConditionExpression: aws.String("GSI1PK = :GSI1PK and begins_with(GSI1SK, :token)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":GSI1PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", userID)},
+			":token":  &types.AttributeValueMemberS{Value: "TOKEN#"},
+		},
+	})
+
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(context.TODO())
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range out.Items {
+			tokens = append(tokens, UnmarshalToken(item))
+		}
+	}
+
+	return tokens, nil
+}
+
+// RevokeToken stops the token working straight away
+func RevokeToken(tokenID string, userID string, client *dynamodb.Client) error {
+	tokens, err := ListTokens(userID, client)
+
+	if err != nil {
+		return err
+	}
+
+	for _, token := range tokens {
+		if token.ID != tokenID {
+			continue
+		}
+
+		_, err = client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+			TableName: aws.String(os.Getenv("table")),
+			Key: map[string]types.AttributeValue{
+				"PK": &types.AttributeValueMemberS{Value: token.PK},
+				"SK": &types.AttributeValueMemberS{Value: token.SK},
+			},
+			ConditionExpression: aws.String("userID = :userID"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":userID": &types.AttributeValueMemberS{Value: userID},
+			},
+		})
+
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return ErrTokenNotFound
+		}
+
+		return err
+	}
+
+	return ErrTokenNotFound
+}
+
+// reassignTokens keeps fromID's tokens working after it is merged into toID
+func reassignTokens(fromID string, toID string, client *dynamodb.Client) error {
+	tokens, err := ListTokens(fromID, client)
+
+	if err != nil {
+		return err
+	}
+
+	values := map[string]types.AttributeValue{
+		":from":   &types.AttributeValueMemberS{Value: fromID},
+		":to":     &types.AttributeValueMemberS{Value: toID},
+		":GSI1PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", toID)},
+	}
+
+	for _, token := range tokens {
+		err := updateIgnoringCondition(map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: token.PK},
+			"SK": &types.AttributeValueMemberS{Value: token.SK},
+		}, "set userID = :to, GSI1PK = :GSI1PK", "userID = :from", values, client)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func UnmarshalToken(item map[string]types.AttributeValue) Token {
+	token := &Token{}
+
+	if err := attributevalue.UnmarshalMap(item, token); err != nil {
+		panic(err)
+	}
+
+	return *token
+}
@@ -0,0 +1,71 @@
+package user
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// User is the profile behind a user ID, only people who have linked something have one
+type User struct {
+	// DynamoDB
+	PK   string `dynamodbav:"PK" json:"-"`
+	SK   string `dynamodbav:"SK" json:"-"`
+	Type string `dynamodbav:"type" json:"-"`
+
+	ID              string     `dynamodbav:"id" json:"id"`
+	Phone           string     `dynamodbav:"phone,omitempty" json:"phone,omitempty"`
+	PhoneVerifiedAt *time.Time `dynamodbav:"phoneVerifiedAt,omitempty" json:"phoneVerifiedAt,omitempty"`
+	Email           string     `dynamodbav:"email,omitempty" json:"email,omitempty"`
+	EmailVerifiedAt *time.Time `dynamodbav:"emailVerifiedAt,omitempty" json:"emailVerifiedAt,omitempty"`
+	// The identity provider subject the user signed in as, OidcEmail is only kept while the provider says it's verified
+	OidcIssuer     string     `dynamodbav:"oidcIssuer,omitempty" json:"oidcIssuer,omitempty"`
+	OidcSubject    string     `dynamodbav:"oidcSubject,omitempty" json:"-"`
+	OidcEmail      string     `dynamodbav:"oidcEmail,omitempty" json:"oidcEmail,omitempty"`
+	OidcSignedInAt *time.Time `dynamodbav:"oidcSignedInAt,omitempty" json:"oidcSignedInAt,omitempty"`
+	CreatedAt      time.Time  `dynamodbav:"createdAt" json:"createdAt"`
+}
+
+func key(userID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", userID)},
+		"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", userID)},
+	}
+}
+
+// Get returns an empty profile for users who haven't linked anything yet
+func Get(userID string, client *dynamodb.Client) (*User, error) {
+	res, err := client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName:      aws.String(os.Getenv("table")),
+		ConsistentRead: aws.Bool(true),
+		Key:            key(userID),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Item == nil {
+		return &User{ID: userID}, nil
+	}
+
+	user := Unmarshal(res.Item)
+
+	return &user, nil
+}
+
+func Unmarshal(item map[string]types.AttributeValue) User {
+	user := &User{}
+
+	if err := attributevalue.UnmarshalMap(item, user); err != nil {
+		panic(err)
+	}
+
+	return *user
+}
@@ -3,6 +3,8 @@ import * as lambda from "@aws-cdk/aws-lambda-go";
 import * as dynamodb from "@aws-cdk/aws-dynamodb";
 import * as iam from "@aws-cdk/aws-iam";
 import * as logs from "@aws-cdk/aws-logs";
+import * as events from "@aws-cdk/aws-events";
+import * as targets from "@aws-cdk/aws-events-targets";
 import { HttpApi, HttpMethod } from "@aws-cdk/aws-apigatewayv2";
 import { LambdaProxyIntegration } from "@aws-cdk/aws-apigatewayv2-integrations";
 import { SSM_BASE_PATH } from "./shared-parameters";
@@ -22,6 +24,8 @@ export class BackendStack extends cdk.Stack {
       partitionKey: { name: "PK", type: dynamodb.AttributeType.STRING },
       sortKey: { name: "SK", type: dynamodb.AttributeType.STRING },
       billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+      // Deleted rooms and options are kept as tombstones until this passes
+      timeToLiveAttribute: "expiresAt",
     });
 
     table.addGlobalSecondaryIndex({
@@ -30,6 +34,13 @@ export class BackendStack extends cdk.Stack {
       indexName: "GSI1",
     });
 
+    // Recurring rooms ordered by when their current cycle ends
+    table.addGlobalSecondaryIndex({
+      partitionKey: { name: "GSI2PK", type: dynamodb.AttributeType.STRING },
+      sortKey: { name: "GSI2SK", type: dynamodb.AttributeType.STRING },
+      indexName: "GSI2",
+    });
+
     const fatLambda = new lambda.GoFunction(this, "handler", {
       entry: "../backend/go/cmd/fat-lambda",
       environment: {
@@ -58,6 +69,24 @@ export class BackendStack extends cdk.Stack {
 
     table.grantReadWriteData(fatLambda);
 
+    const scheduler = new lambda.GoFunction(this, "scheduler", {
+      entry: "../backend/go/cmd/scheduler",
+      environment: {
+        table: table.tableName,
+        region: this.region,
+      },
+      logRetention: logs.RetentionDays.ONE_MONTH,
+      timeout: cdk.Duration.minutes(5),
+    });
+
+    table.grantReadWriteData(scheduler);
+
+    // Cycles end at most 5 minutes late
+    new events.Rule(this, "scheduler-rule", {
+      schedule: events.Schedule.rate(cdk.Duration.minutes(5)),
+      targets: [new targets.LambdaFunction(scheduler)],
+    });
+
     /**
      * This is behind a CloudFront distribution
      *
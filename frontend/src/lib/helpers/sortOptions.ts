@@ -2,6 +2,10 @@ import type { Option, PublicOption } from '$lib/types/Room';
 
 export const sortOptions = <T extends PublicOption | Option>(options: T[]): T[] =>
 	options.sort((a, b) => {
+		if (a.position !== b.position) {
+			return a.position - b.position;
+		}
+
 		if (a.value === b.value) {
 			return a.id.localeCompare(b.id);
 		}
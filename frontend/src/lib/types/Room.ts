@@ -1,8 +1,42 @@
+export interface GridRow {
+	label: string;
+	maxSelections?: number;
+}
+
+export interface Grid {
+	rows: GridRow[];
+	columns: string[];
+}
+
+export interface Seat {
+	row: number;
+	column: number;
+	label: string;
+	blocked?: boolean;
+}
+
+export interface SeatMap {
+	rows: number;
+	columns: number;
+	cells: Seat[];
+	groupSize?: number;
+	adjacent?: boolean;
+}
+
 export interface PublicRoom {
 	id: string;
 	options: PublicOption[];
 	question: string;
 	ownedByMe: boolean;
+	kind: string;
+	grid?: Grid;
+	seatMap?: SeatMap;
+	redirectedFrom?: string;
+	locked?: boolean;
+	allowedDomain?: string;
+	inviteOnly?: boolean;
+	invitedAs?: string;
+	role?: 'owner' | 'editor' | 'viewer';
 }
 
 export interface Room {
@@ -14,13 +48,32 @@ export interface Room {
 export interface SimpleRoom {
 	id: string;
 	question: string;
+	role?: 'owner' | 'editor' | 'viewer';
+}
+
+export interface Price {
+	amount: number;
+	currency: string;
 }
 
 export interface PublicOption {
 	id: string;
 	value: string;
+	description?: string;
+	position: number;
 	available: boolean;
 	selectedByMeAs?: string;
+	changedSinceSelected?: boolean;
+	startsAt?: string;
+	endsAt?: string;
+	row?: number;
+	column?: number;
+	disabled?: boolean;
+	location?: string;
+	url?: string;
+	image?: string;
+	price?: Price;
+	notes?: string;
 }
 
 export interface Option extends PublicOption {
@@ -28,4 +81,7 @@ export interface Option extends PublicOption {
 	value: string;
 	available: boolean;
 	selectedByName?: string;
+	version: number;
+	hidden?: boolean;
+	revealAt?: string;
 }